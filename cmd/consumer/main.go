@@ -4,58 +4,82 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+
+	"social-media-db/internal/dedup"
+	"social-media-db/internal/directory"
+	"social-media-db/internal/dlq"
+	"social-media-db/internal/events"
+	"social-media-db/internal/feed"
+	"social-media-db/internal/shard"
+	"social-media-db/internal/stats"
+	"social-media-db/internal/writes"
 )
 
-// Event types 
-type PostEvent struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
+// Retry policy applied to a topic before a message is dead-lettered
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
 }
 
-type CommentEvent struct {
-	ID        string    `json:"id"`
-	PostID    string    `json:"post_id"`
-	UserID    string    `json:"user_id"`
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
+// Backoff returns how long to wait after the given (1-based) failed attempt
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		backoff *= p.Multiplier
+		if backoff >= float64(p.MaxBackoff) {
+			return p.MaxBackoff
+		}
+	}
+	return time.Duration(backoff)
 }
 
-type LikeEvent struct {
-	ID        string    `json:"id"`
-	PostID    string    `json:"post_id"`
-	UserID    string    `json:"user_id"`
-	Action    string    `json:"action"` // "like" or "unlike"
-	Timestamp time.Time `json:"timestamp"`
+// shardError records which shard a failed write was routed to
+type shardError struct {
+	shardID uint32
+	err     error
 }
 
-// Shard configuration
-type ShardConfig struct {
-	ID               uint32
-	Host             string
-	Port             int
-	Database         string
-	Username         string
-	Password         string
-	ConnectionString string
+func (e *shardError) Error() string { return e.err.Error() }
+func (e *shardError) Unwrap() error { return e.err }
+
+// permanentError marks failures that retrying cannot fix (e.g. malformed payloads)
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// dependencyError marks failures caused by a row that has not been consumed
+// yet, such as the post of a comment. Events keyed differently are read from
+// other partitions and may lag well behind, so these failures are retried
+// with the longer wait policy.
+type dependencyError struct {
+	err error
 }
 
+func (e *dependencyError) Error() string { return e.err.Error() }
+func (e *dependencyError) Unwrap() error { return e.err }
+
 // Metrics
 var (
 	messagesProcessed = prometheus.NewCounterVec(
@@ -81,24 +105,54 @@ var (
 		},
 		[]string{"topic"},
 	)
+	
+	messagesRetried = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "messages_retried_total",
+			Help: "Total number of message processing retries",
+		},
+		[]string{"topic"},
+	)
+	
+	duplicatesSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "duplicate_events_skipped_total",
+			Help: "Total number of events skipped because their shard had already processed them",
+		},
+		[]string{"shard", "event_type"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(messagesProcessed)
 	prometheus.MustRegister(databaseWrites)
 	prometheus.MustRegister(processingDuration)
+	prometheus.MustRegister(messagesRetried)
+	prometheus.MustRegister(duplicatesSkipped)
 }
 
 type ConsumerService struct {
-	consumer    sarama.ConsumerGroup
-	shards      []ShardConfig
-	dbPool      map[uint32]*sql.DB
-	logger      *logrus.Logger
-	ready       chan bool
-	ctx         context.Context
-	cancel      context.CancelFunc
+	consumer      sarama.ConsumerGroup
+	dlqProducer   sarama.SyncProducer
+	retryPolicies map[string]RetryPolicy
+	waitPolicy    RetryPolicy
+	lanes         int
+	router        *shard.Watcher
+	decoder       *events.Registry
+	directory     *directory.Directory
+	placements    shard.Placements
+	feed          feed.Config
+	maxDepth      int
+	retention     time.Duration
+	logger        *logrus.Logger
+	ready         chan bool
+	ctx           context.Context
+	cancel        context.CancelFunc
 }
 
+// Topics consumed by the service
+var topics = []string{"posts", "comments", "likes", "users", "follows"}
+
 func NewConsumerService() (*ConsumerService, error) {
 	logger := logrus.New()
 	logger.SetFormatter(&logrus.JSONFormatter{})
@@ -108,16 +162,29 @@ func NewConsumerService() (*ConsumerService, error) {
 		logger.Warn("No .env file found")
 	}
 	
-	// Load shard configuration
-	shards, err := loadShardConfig(logger)
+	// Load shard configuration and connect to every shard
+	router, err := shard.NewWatcher(logger)
+	if err != nil {
+		return nil, err
+	}
+	
+	placements, err := shard.LoadPlacements()
 	if err != nil {
-		return nil, fmt.Errorf("failed to load shard config: %w", err)
+		router.Close()
+		return nil, err
 	}
 	
-	// Initialize database connections
-	dbPool, err := initDBConnections(shards, logger)
+	feedConfig, err := feed.LoadConfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize DB connections: %w", err)
+		router.Close()
+		return nil, err
+	}
+	
+	// Schemas needed to decode protobuf events, checked for compatibility
+	schemas, err := events.LoadSchemas(getEnv("SCHEMA_REGISTRY", "schemas/registry.json"))
+	if err != nil {
+		router.Close()
+		return nil, err
 	}
 	
 	// Initialize Kafka consumer
@@ -131,96 +198,102 @@ func NewConsumerService() (*ConsumerService, error) {
 	
 	consumer, err := sarama.NewConsumerGroup(kafkaServers, "db-writer-group", config)
 	if err != nil {
+		router.Close()
 		return nil, fmt.Errorf("failed to create consumer group: %w", err)
 	}
 	
+	// Producer used to park messages that keep failing on <topic>.dlq
+	producerConfig := sarama.NewConfig()
+	producerConfig.Producer.RequiredAcks = sarama.WaitForAll
+	producerConfig.Producer.Retry.Max = 3
+	producerConfig.Producer.Return.Successes = true
+	producerConfig.Producer.Return.Errors = true
+	producerConfig.Version = sarama.V2_6_0_0
+	
+	dlqProducer, err := sarama.NewSyncProducer(kafkaServers, producerConfig)
+	if err != nil {
+		consumer.Close()
+		router.Close()
+		return nil, fmt.Errorf("failed to create DLQ producer: %w", err)
+	}
+	
 	ctx, cancel := context.WithCancel(context.Background())
 	
 	return &ConsumerService{
-		consumer: consumer,
-		shards:   shards,
-		dbPool:   dbPool,
-		logger:   logger,
-		ready:    make(chan bool),
-		ctx:      ctx,
-		cancel:   cancel,
+		consumer:      consumer,
+		dlqProducer:   dlqProducer,
+		retryPolicies: loadRetryPolicies(topics),
+		waitPolicy:    loadWaitPolicy(),
+		lanes:         max(getEnvInt("CONSUMER_LANES", 8), 1),
+		router:        router,
+		decoder:       events.NewRegistry(schemas),
+		directory:     directory.New(router.Master()),
+		placements:    placements,
+		feed:          feedConfig,
+		maxDepth:      getEnvInt("COMMENT_MAX_DEPTH", 5),
+		retention:     getEnvDuration("PROCESSED_EVENTS_RETENTION", 7*24*time.Hour),
+		logger:        logger,
+		ready:         make(chan bool),
+		ctx:           ctx,
+		cancel:        cancel,
 	}, nil
 }
 
-func loadShardConfig(logger *logrus.Logger) ([]ShardConfig, error) {
-	// Connect to master database to get shard configuration
-	masterDB, err := sql.Open("postgres", fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		getEnv("PG_MASTER_HOST", "localhost"),
-		getEnv("PG_MASTER_PORT", "5440"),
-		getEnv("PG_MASTER_USER", "postgres"),
-		getEnv("PG_MASTER_PASS", "Genius171317@"),
-		getEnv("PG_MASTER_DB", "master"),
-	))
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to master DB: %w", err)
+// loadRetryPolicies reads the default retry policy from RETRY_* variables and
+// lets each topic override it with <TOPIC>_RETRY_* (e.g. LIKES_RETRY_MAX_ATTEMPTS)
+func loadRetryPolicies(topics []string) map[string]RetryPolicy {
+	defaults := RetryPolicy{
+		MaxAttempts:    getEnvInt("RETRY_MAX_ATTEMPTS", 5),
+		InitialBackoff: getEnvDuration("RETRY_INITIAL_BACKOFF", 200*time.Millisecond),
+		MaxBackoff:     getEnvDuration("RETRY_MAX_BACKOFF", 10*time.Second),
+		Multiplier:     getEnvFloat("RETRY_BACKOFF_MULTIPLIER", 2),
 	}
-	defer masterDB.Close()
 	
-	// Query shard configuration
-	rows, err := masterDB.Query("SELECT shard_id, host, port, db_name, username, password FROM shards ORDER BY shard_id")
-	if err != nil {
-		return nil, fmt.Errorf("failed to query shards: %w", err)
-	}
-	defer rows.Close()
-	
-	var shards []ShardConfig
-	for rows.Next() {
-		var shard ShardConfig
-		err := rows.Scan(&shard.ID, &shard.Host, &shard.Port, &shard.Database, &shard.Username, &shard.Password)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan shard row: %w", err)
+	policies := make(map[string]RetryPolicy, len(topics))
+	for _, topic := range topics {
+		prefix := strings.ToUpper(topic) + "_"
+		policy := RetryPolicy{
+			MaxAttempts:    getEnvInt(prefix+"RETRY_MAX_ATTEMPTS", defaults.MaxAttempts),
+			InitialBackoff: getEnvDuration(prefix+"RETRY_INITIAL_BACKOFF", defaults.InitialBackoff),
+			MaxBackoff:     getEnvDuration(prefix+"RETRY_MAX_BACKOFF", defaults.MaxBackoff),
+			Multiplier:     getEnvFloat(prefix+"RETRY_BACKOFF_MULTIPLIER", defaults.Multiplier),
 		}
-		
-		shard.ConnectionString = fmt.Sprintf(
-			"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-			shard.Host, shard.Port, shard.Username, shard.Password, shard.Database,
-		)
-		
-		shards = append(shards, shard)
-		logger.WithFields(logrus.Fields{
-			"shard_id": shard.ID,
-			"host":     shard.Host,
-			"port":     shard.Port,
-		}).Info("Loaded shard configuration")
+		if policy.MaxAttempts < 1 {
+			policy.MaxAttempts = 1
+		}
+		if policy.Multiplier < 1 {
+			policy.Multiplier = 1
+		}
+		policies[topic] = policy
 	}
 	
-	if len(shards) == 0 {
-		return nil, fmt.Errorf("no shards found in configuration")
+	return policies
+}
+
+// loadWaitPolicy reads the policy of failures on a row that is not consumed
+// yet from DEPENDENCY_RETRY_* variables. Its attempts come on top of the
+// topic's own.
+func loadWaitPolicy() RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts:    getEnvInt("DEPENDENCY_RETRY_MAX_ATTEMPTS", 20),
+		InitialBackoff: getEnvDuration("DEPENDENCY_RETRY_INITIAL_BACKOFF", time.Second),
+		MaxBackoff:     getEnvDuration("DEPENDENCY_RETRY_MAX_BACKOFF", 30*time.Second),
+		Multiplier:     getEnvFloat("DEPENDENCY_RETRY_BACKOFF_MULTIPLIER", 2),
 	}
-	
-	return shards, nil
+	if policy.MaxAttempts < 0 {
+		policy.MaxAttempts = 0
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 1
+	}
+	return policy
 }
 
-func initDBConnections(shards []ShardConfig, logger *logrus.Logger) (map[uint32]*sql.DB, error) {
-	dbPool := make(map[uint32]*sql.DB)
-	
-	for _, shard := range shards {
-		db, err := sql.Open("postgres", shard.ConnectionString)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open connection to shard %d: %w", shard.ID, err)
-		}
-		
-		// Test the connection
-		if err := db.Ping(); err != nil {
-			return nil, fmt.Errorf("failed to ping shard %d: %w", shard.ID, err)
-		}
-		
-		// Configure connection pool
-		db.SetMaxOpenConns(10)
-		db.SetMaxIdleConns(5)
-		db.SetConnMaxLifetime(time.Hour)
-		
-		dbPool[shard.ID] = db
-		logger.WithField("shard_id", shard.ID).Info("Connected to database shard")
+func (c *ConsumerService) retryPolicy(topic string) RetryPolicy {
+	if policy, ok := c.retryPolicies[topic]; ok {
+		return policy
 	}
-	
-	return dbPool, nil
+	return RetryPolicy{MaxAttempts: 1}
 }
 
 func (c *ConsumerService) Close() {
@@ -228,8 +301,11 @@ func (c *ConsumerService) Close() {
 	if c.consumer != nil {
 		c.consumer.Close()
 	}
-	for _, db := range c.dbPool {
-		db.Close()
+	if c.dlqProducer != nil {
+		c.dlqProducer.Close()
+	}
+	if c.router != nil {
+		c.router.Close()
 	}
 }
 
@@ -244,78 +320,327 @@ func (c *ConsumerService) Cleanup(sarama.ConsumerGroupSession) error {
 	return nil
 }
 
-// ConsumeClaim implements sarama.ConsumerGroupHandler
+// ConsumeClaim implements sarama.ConsumerGroupHandler. Messages are spread
+// over ordered lanes by key, so messages of one post or user are processed in
+// order while other keys proceed in parallel.
 func (c *ConsumerService) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	ctx, cancel := context.WithCancel(session.Context())
+	defer cancel()
+	stopWatching := context.AfterFunc(c.ctx, cancel)
+	defer stopWatching()
+	
+	// The first lane to fail stops the claim; the lanes drop their queued
+	// messages and nothing past the failed message is marked
+	var failure error
+	var failOnce sync.Once
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+	
+	offsets := newOffsetTracker(session)
+	lanes := make([]chan *sarama.ConsumerMessage, c.lanes)
+	var wg sync.WaitGroup
+	for i := range lanes {
+		lanes[i] = make(chan *sarama.ConsumerMessage, laneBuffer)
+		wg.Add(1)
+		go func(messages <-chan *sarama.ConsumerMessage) {
+			defer wg.Done()
+			c.runLane(ctx, messages, offsets, fail)
+		}(lanes[i])
+	}
+	
+	c.dispatch(ctx, claim, lanes, offsets)
+	
+	// Let the lanes finish what they hold; after a failure or the end of the
+	// session they skip it instead
+	for _, lane := range lanes {
+		close(lane)
+	}
+	wg.Wait()
+	return failure
+}
+
+// laneBuffer is how many messages may wait for each lane. The claim stops
+// reading when the lane of its next message is full.
+const laneBuffer = 64
+
+// dispatch hands the messages of a claim to the lane of their key until the
+// claim ends or ctx is cancelled
+func (c *ConsumerService) dispatch(ctx context.Context, claim sarama.ConsumerGroupClaim, lanes []chan *sarama.ConsumerMessage, offsets *offsetTracker) {
 	for {
 		select {
 		case message := <-claim.Messages():
 			if message == nil {
-				return nil
+				return
 			}
 			
-			timer := prometheus.NewTimer(processingDuration.WithLabelValues(message.Topic))
-			err := c.processMessage(message)
-			timer.ObserveDuration()
-			
-			if err != nil {
+			offsets.add(message)
+			select {
+			case lanes[laneFor(message.Key, len(lanes))] <- message:
+			case <-ctx.Done():
+				return
+			}
+		
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runLane processes the messages of one lane in order
+func (c *ConsumerService) runLane(ctx context.Context, messages <-chan *sarama.ConsumerMessage, offsets *offsetTracker, fail func(error)) {
+	for message := range messages {
+		if ctx.Err() != nil {
+			// Left unmarked, so it is redelivered after the session restarts
+			continue
+		}
+		
+		if err := c.handleMessage(ctx, message); err != nil {
+			if ctx.Err() == nil {
+				// Neither processed nor dead-lettered: leave the offset unmarked so
+				// the message is redelivered after the session restarts
 				c.logger.WithError(err).WithFields(logrus.Fields{
 					"topic":     message.Topic,
 					"partition": message.Partition,
 					"offset":    message.Offset,
-				}).Error("Failed to process message")
-				messagesProcessed.WithLabelValues(message.Topic, "error").Inc()
-			} else {
-				messagesProcessed.WithLabelValues(message.Topic, "success").Inc()
+				}).Error("Failed to handle message, stopping claim")
 			}
-			
-			session.MarkMessage(message, "")
-			
-		case <-c.ctx.Done():
+			fail(err)
+			continue
+		}
+		
+		offsets.done(message)
+	}
+}
+
+// laneFor picks the lane of a message key. Keys are the post or user whose
+// events must stay in order; messages without one all share lane 0.
+func laneFor(key []byte, lanes int) int {
+	if len(key) == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(lanes))
+}
+
+// offsetTracker marks the messages of a claim as consumed. Lanes finish
+// messages out of order, so a message is only marked once every message
+// before it is done: the committed offset never passes the lowest message in
+// flight. Messages that finished after it are redelivered after a crash and
+// skipped through processed_events.
+type offsetTracker struct {
+	session  sarama.ConsumerGroupSession
+	mu       sync.Mutex
+	pending  []*sarama.ConsumerMessage // dispatched and not marked yet, by offset
+	finished map[int64]bool
+}
+
+func newOffsetTracker(session sarama.ConsumerGroupSession) *offsetTracker {
+	return &offsetTracker{session: session, finished: make(map[int64]bool)}
+}
+
+// add records a message handed to a lane
+func (t *offsetTracker) add(message *sarama.ConsumerMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, message)
+}
+
+// done records a processed message and marks the messages up to the first one
+// still in flight
+func (t *offsetTracker) done(message *sarama.ConsumerMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	
+	t.finished[message.Offset] = true
+	var last *sarama.ConsumerMessage
+	for len(t.pending) > 0 && t.finished[t.pending[0].Offset] {
+		last = t.pending[0]
+		delete(t.finished, last.Offset)
+		t.pending = t.pending[1:]
+	}
+	if last != nil {
+		t.session.MarkMessage(last, "")
+	}
+}
+
+// handleMessage processes a message with the topic's retry policy and sends it
+// to the dead-letter topic once the attempts are exhausted. Failures on a row
+// that is not consumed yet wait with the wait policy instead. A nil
+// return means the message may be marked as consumed.
+func (c *ConsumerService) handleMessage(ctx context.Context, message *sarama.ConsumerMessage) error {
+	policy := c.retryPolicy(message.Topic)
+	
+	attempt, waits := 0, 0
+	for {
+		attempt++
+		
+		timer := prometheus.NewTimer(processingDuration.WithLabelValues(message.Topic))
+		err := c.processMessage(message)
+		timer.ObserveDuration()
+		
+		if err == nil {
+			messagesProcessed.WithLabelValues(message.Topic, "success").Inc()
 			return nil
 		}
+		
+		messagesProcessed.WithLabelValues(message.Topic, "error").Inc()
+		logger := c.logger.WithError(err).WithFields(logrus.Fields{
+			"topic":        message.Topic,
+			"partition":    message.Partition,
+			"offset":       message.Offset,
+			"attempt":      attempt,
+			"max_attempts": policy.MaxAttempts,
+		})
+		
+		var permErr *permanentError
+		var depErr *dependencyError
+		var backoff time.Duration
+		switch {
+		case errors.As(err, &permErr):
+			logger.Error("Failed to process message, not retrying")
+			return c.deadLetter(message, err, attempt)
+		case errors.As(err, &depErr):
+			// Wait for the missing row without using up the topic's attempts
+			if waits >= c.waitPolicy.MaxAttempts {
+				logger.Error("Failed to process message, dependency still missing")
+				return c.deadLetter(message, err, attempt)
+			}
+			waits++
+			backoff = c.waitPolicy.Backoff(waits)
+			logger.WithField("backoff", backoff.String()).Warn("Message depends on a row not consumed yet, waiting")
+		default:
+			if attempt-waits >= policy.MaxAttempts {
+				logger.Error("Failed to process message, retries exhausted")
+				return c.deadLetter(message, err, attempt)
+			}
+			backoff = policy.Backoff(attempt - waits)
+			logger.WithField("backoff", backoff.String()).Warn("Failed to process message, retrying")
+		}
+		messagesRetried.WithLabelValues(message.Topic).Inc()
+		
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
 	}
 }
 
+// deadLetter publishes a message that could not be processed to <topic>.dlq
+func (c *ConsumerService) deadLetter(message *sarama.ConsumerMessage, cause error, attempts int) error {
+	meta := dlq.Metadata{
+		SourceTopic:     message.Topic,
+		SourcePartition: message.Partition,
+		SourceOffset:    message.Offset,
+		Error:           cause.Error(),
+		Attempts:        attempts,
+		FailedAt:        time.Now().UTC(),
+	}
+	
+	var sErr *shardError
+	if errors.As(cause, &sErr) {
+		shardID := sErr.shardID
+		meta.ShardID = &shardID
+	}
+	
+	partition, offset, err := c.dlqProducer.SendMessage(dlq.NewMessage(message, meta))
+	if err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", dlq.TopicFor(message.Topic), err)
+	}
+	
+	messagesProcessed.WithLabelValues(message.Topic, "dead_lettered").Inc()
+	c.logger.WithFields(logrus.Fields{
+		"topic":         message.Topic,
+		"partition":     message.Partition,
+		"offset":        message.Offset,
+		"attempts":      attempts,
+		"dlq_topic":     dlq.TopicFor(message.Topic),
+		"dlq_partition": partition,
+		"dlq_offset":    offset,
+	}).Warn("Message sent to dead-letter topic")
+	
+	return nil
+}
+
 func (c *ConsumerService) processMessage(message *sarama.ConsumerMessage) error {
+	// Old schema versions are upgraded here, so handlers only see the current one
+	envelope, err := c.decoder.Decode(message.Topic, contentType(message), message.Value)
+	if err != nil {
+		return &permanentError{fmt.Errorf("failed to decode event: %w", err)}
+	}
+	
 	c.logger.WithFields(logrus.Fields{
-		"topic":     message.Topic,
-		"partition": message.Partition,
-		"offset":    message.Offset,
-		"key":       string(message.Key),
+		"topic":      message.Topic,
+		"partition":  message.Partition,
+		"offset":     message.Offset,
+		"key":        string(message.Key),
+		"event_type": envelope.EventType,
+		"event_id":   envelope.EventID,
+		"trace_id":   envelope.TraceID,
 	}).Debug("Processing message")
 	
-	switch message.Topic {
-	case "posts":
-		return c.processPostEvent(message)
-	case "comments":
-		return c.processCommentEvent(message)
-	case "likes":
-		return c.processLikeEvent(message)
+	switch envelope.EventType {
+	case events.TypePostCreated:
+		return c.processPostEvent(envelope)
+	case events.TypePostUpdated:
+		return c.processPostUpdated(envelope)
+	case events.TypePostDeleted:
+		return c.processPostDeleted(envelope)
+	case events.TypeCommentCreated:
+		return c.processCommentEvent(envelope)
+	case events.TypeCommentUpdated:
+		return c.processCommentUpdated(envelope)
+	case events.TypeCommentDeleted:
+		return c.processCommentDeleted(envelope)
+	case events.TypeLikeChanged:
+		return c.processLikeEvent(envelope)
+	case events.TypeUserCreated:
+		return c.processUserCreated(envelope)
+	case events.TypeUserUpdated:
+		return c.processUserUpdated(envelope)
+	case events.TypeFollowChanged:
+		return c.processFollowEvent(envelope)
 	default:
-		c.logger.WithField("topic", message.Topic).Warn("Unknown topic")
+		c.logger.WithField("event_type", envelope.EventType).Warn("Unhandled event type")
 		return nil
 	}
 }
 
-func (c *ConsumerService) processPostEvent(message *sarama.ConsumerMessage) error {
-	var event PostEvent
-	if err := json.Unmarshal(message.Value, &event); err != nil {
-		return fmt.Errorf("failed to unmarshal post event: %w", err)
+func (c *ConsumerService) processPostEvent(envelope events.Envelope) error {
+	var event events.Post
+	if err := envelope.Unmarshal(&event); err != nil {
+		return &permanentError{err}
+	}
+	
+	// Record the owner before writing so the directory never misses a stored post
+	if err := c.directory.RegisterPost(context.Background(), event.ID, event.UserID); err != nil {
+		return err
 	}
 	
 	// Determine shard
-	shardID := c.getShardID(event.UserID)
-	db := c.dbPool[shardID]
+	shardID, db := c.shardFor(event.UserID)
 	
 	// Insert into database
 	query := `INSERT INTO posts (id, user_id, content, created_at, updated_at) 
 			  VALUES ($1, $2, $3, $4, $4)
 			  ON CONFLICT (id) DO NOTHING`
 	
-	_, err := db.Exec(query, event.ID, event.UserID, event.Content, event.Timestamp)
+	err := c.writeOnce(db, shardID, envelope, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(query, event.ID, event.UserID, event.Content, event.Timestamp); err != nil {
+			return fmt.Errorf("failed to insert post into shard %d: %w", shardID, err)
+		}
+		return nil
+	})
 	if err != nil {
 		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "posts", "error").Inc()
-		return fmt.Errorf("failed to insert post into shard %d: %w", shardID, err)
+		return err
 	}
 	
 	databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "posts", "success").Inc()
@@ -323,86 +648,419 @@ func (c *ConsumerService) processPostEvent(message *sarama.ConsumerMessage) erro
 		"post_id":  event.ID,
 		"user_id":  event.UserID,
 		"shard_id": shardID,
+		"trace_id": envelope.TraceID,
 	}).Info("Post inserted successfully")
 	
+	// Fanned out even when the insert was skipped: the first attempt may have
+	// failed after committing it
+	if c.feed.Mode == feed.FanOutOnWrite {
+		return c.fanOutPost(event)
+	}
 	return nil
 }
 
-func (c *ConsumerService) processCommentEvent(message *sarama.ConsumerMessage) error {
-	var event CommentEvent
-	if err := json.Unmarshal(message.Value, &event); err != nil {
-		return fmt.Errorf("failed to unmarshal comment event: %w", err)
+// fanOutPost copies a new post into the timeline of every follower of its
+// author. A failure retries the whole event; both writes are idempotent.
+func (c *ConsumerService) fanOutPost(event events.Post) error {
+	router := c.router.Current()
+	followers, err := feed.Followers(context.Background(), router, event.UserID)
+	if err != nil {
+		return err
 	}
 	
-	// Determine shard based on user_id for consistency
-	shardID := c.getShardID(event.UserID)
-	db := c.dbPool[shardID]
+	entry := feed.Entry{PostID: event.ID, AuthorID: event.UserID, CreatedAt: event.Timestamp}
+	for shardID, followerIDs := range feed.ByShard(router, followers) {
+		if err := feed.FanOut(context.Background(), router.DB(shardID), followerIDs, entry); err != nil {
+			databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "timelines", "error").Inc()
+			return &shardError{shardID, err}
+		}
+		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "timelines", "success").Inc()
+	}
 	
-	// Insert into database
-	query := `INSERT INTO comments (id, post_id, user_id, content, created_at, updated_at) 
-			  VALUES ($1, $2, $3, $4, $5, $5)
-			  ON CONFLICT (id) DO NOTHING`
+	c.logger.WithFields(logrus.Fields{
+		"post_id":   event.ID,
+		"user_id":   event.UserID,
+		"followers": len(followers),
+	}).Debug("Post fanned out to timelines")
 	
-	_, err := db.Exec(query, event.ID, event.PostID, event.UserID, event.Content, event.Timestamp)
+	return nil
+}
+
+func (c *ConsumerService) processPostUpdated(envelope events.Envelope) error {
+	var event events.PostUpdated
+	if err := envelope.Unmarshal(&event); err != nil {
+		return &permanentError{err}
+	}
+	
+	shardID, db, ok, err := c.authoredPostShard(event.ID, event.UserID)
+	if err != nil || !ok {
+		return err
+	}
+	
+	// Deleted posts stay deleted; the trigger bumps updated_at
+	query := `UPDATE posts SET content = $1 WHERE id = $2 AND deleted_at IS NULL`
+	
+	updated := false
+	err = c.writeOnce(db, shardID, envelope, func(tx *sql.Tx) error {
+		result, err := tx.Exec(query, event.Content, event.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update post in shard %d: %w", shardID, err)
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return c.unchangedRow(tx, shardID, "posts", event.ID, event.UserID)
+		}
+		updated = true
+		return nil
+	})
+	if err != nil {
+		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "posts", "error").Inc()
+		return err
+	}
+	
+	databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "posts", "success").Inc()
+	if !updated {
+		return nil
+	}
+	
+	c.logger.WithFields(logrus.Fields{
+		"post_id":  event.ID,
+		"user_id":  event.UserID,
+		"shard_id": shardID,
+		"trace_id": envelope.TraceID,
+	}).Info("Post updated successfully")
+	
+	return nil
+}
+
+func (c *ConsumerService) processPostDeleted(envelope events.Envelope) error {
+	var event events.PostDeleted
+	if err := envelope.Unmarshal(&event); err != nil {
+		return &permanentError{err}
+	}
+	
+	shardID, db, ok, err := c.authoredPostShard(event.ID, event.UserID)
+	if err != nil || !ok {
+		return err
+	}
+	
+	// Soft delete: the row stays as a tombstone so a replayed create is a no-op
+	query := `UPDATE posts SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`
+	
+	deleted := false
+	err = c.writeOnce(db, shardID, envelope, func(tx *sql.Tx) error {
+		result, err := tx.Exec(query, event.Timestamp, event.ID)
+		if err != nil {
+			return fmt.Errorf("failed to delete post from shard %d: %w", shardID, err)
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return c.unchangedRow(tx, shardID, "posts", event.ID, event.UserID)
+		}
+		deleted = true
+		return nil
+	})
+	if err != nil {
+		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "posts", "error").Inc()
+		return err
+	}
+	
+	databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "posts", "success").Inc()
+	if !deleted {
+		return nil
+	}
+	
+	c.logger.WithFields(logrus.Fields{
+		"post_id":  event.ID,
+		"user_id":  event.UserID,
+		"shard_id": shardID,
+		"trace_id": envelope.TraceID,
+	}).Info("Post deleted successfully")
+	
+	return nil
+}
+
+// authoredPostShard returns the shard of a post that userID wants to change.
+// ok is false when userID is not the post's author and the change is dropped.
+func (c *ConsumerService) authoredPostShard(postID, userID string) (uint32, *sql.DB, bool, error) {
+	ownerID, found, err := c.directory.PostOwner(context.Background(), postID)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if !found {
+		// The post may not be written yet; the change waits for it
+		return 0, nil, false, &dependencyError{fmt.Errorf("post %s is not in the post directory yet", postID)}
+	}
+	if ownerID != userID {
+		c.logger.WithFields(logrus.Fields{
+			"post_id":  postID,
+			"user_id":  userID,
+			"owner_id": ownerID,
+		}).Warn("Ignoring change to a post by a user other than its author")
+		return 0, nil, false, nil
+	}
+	
+	shardID, db := c.shardFor(ownerID)
+	return shardID, db, true, nil
+}
+
+// unchangedRow explains an edit or delete that matched no row. A row that is
+// already deleted or belongs to someone else needs nothing more; a missing
+// row may still be on its way, so that is retried and the transaction of the
+// change rolled back.
+func (c *ConsumerService) unchangedRow(tx *sql.Tx, shardID uint32, table, id, userID string) error {
+	var ownerID string
+	var deleted bool
+	query := fmt.Sprintf("SELECT user_id, deleted_at IS NOT NULL FROM %s WHERE id = $1", table)
+	err := tx.QueryRow(query, id).Scan(&ownerID, &deleted)
+	if err == sql.ErrNoRows {
+		return &dependencyError{fmt.Errorf("%s row %s is not in shard %d yet", table, id, shardID)}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up %s row %s in shard %d: %w", table, id, shardID, err)
+	}
+	
+	logger := c.logger.WithFields(logrus.Fields{
+		"table":    table,
+		"id":       id,
+		"user_id":  userID,
+		"shard_id": shardID,
+	})
+	if ownerID != userID {
+		logger.WithField("owner_id", ownerID).Warn("Ignoring change by a user other than the author")
+	} else if deleted {
+		logger.Info("Ignoring change to deleted content")
+	}
+	return nil
+}
+
+func (c *ConsumerService) processCommentEvent(envelope events.Envelope) error {
+	var event events.Comment
+	if err := envelope.Unmarshal(&event); err != nil {
+		return &permanentError{err}
+	}
+	
+	// Place the comment in its thread. Ingestion checks replies, but their
+	// parent may not have been consumed yet when the check ran.
+	entry := directory.CommentEntry{CommentID: event.ID, PostID: event.PostID, ParentCommentID: event.ParentCommentID}
+	if event.ParentCommentID != "" {
+		parent, found, err := c.directory.Comment(context.Background(), event.ParentCommentID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return &dependencyError{fmt.Errorf("parent comment %s of %s is not known yet", event.ParentCommentID, event.ID)}
+		}
+		if parent.PostID != event.PostID {
+			return &permanentError{fmt.Errorf("parent comment %s belongs to post %s, not %s", event.ParentCommentID, parent.PostID, event.PostID)}
+		}
+		entry.Depth = parent.Depth + 1
+		if entry.Depth > c.maxDepth {
+			return &permanentError{fmt.Errorf("reply %s is nested %d levels deep, more than %d", event.ID, entry.Depth, c.maxDepth)}
+		}
+	}
+	if err := c.directory.RegisterComment(context.Background(), entry); err != nil {
+		return err
+	}
+	
+	// Let point reads of the post find the shard holding this comment
+	if err := c.directory.AddParticipant(context.Background(), event.PostID, event.UserID); err != nil {
+		return err
+	}
+	
+	// Determine shard from the configured placement
+	shardKey, err := c.placementKey(c.placements.Comments, event.PostID, event.UserID)
+	if err != nil {
+		return err
+	}
+	shardID, db := c.shardFor(shardKey)
+	
+	// Insert into database
+	err = c.writeCounted(db, shardID, envelope, event.PostID, func(tx *sql.Tx) (stats.Delta, error) {
+		return writes.InsertComment(context.Background(), tx, event)
+	})
 	if err != nil {
 		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "comments", "error").Inc()
-		return fmt.Errorf("failed to insert comment into shard %d: %w", shardID, err)
+		return err
 	}
 	
 	databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "comments", "success").Inc()
+	if err := c.applyStats(db, envelope.EventID); err != nil {
+		return err
+	}
 	c.logger.WithFields(logrus.Fields{
 		"comment_id": event.ID,
 		"post_id":    event.PostID,
 		"user_id":    event.UserID,
+		"parent_id":  event.ParentCommentID,
 		"shard_id":   shardID,
+		"trace_id":   envelope.TraceID,
 	}).Info("Comment inserted successfully")
 	
 	return nil
 }
 
-func (c *ConsumerService) processLikeEvent(message *sarama.ConsumerMessage) error {
-	var event LikeEvent
-	if err := json.Unmarshal(message.Value, &event); err != nil {
-		return fmt.Errorf("failed to unmarshal like event: %w", err)
+func (c *ConsumerService) processCommentUpdated(envelope events.Envelope) error {
+	var event events.CommentUpdated
+	if err := envelope.Unmarshal(&event); err != nil {
+		return &permanentError{err}
 	}
 	
-	// Determine shard based on user_id for consistency
-	shardID := c.getShardID(event.UserID)
-	db := c.dbPool[shardID]
+	shardKey, err := c.placementKey(c.placements.Comments, event.PostID, event.UserID)
+	if err != nil {
+		return err
+	}
+	shardID, db := c.shardFor(shardKey)
+	
+	query := `UPDATE comments SET content = $1 
+			  WHERE id = $2 AND post_id = $3 AND user_id = $4 AND deleted_at IS NULL`
+	
+	updated := false
+	err = c.writeOnce(db, shardID, envelope, func(tx *sql.Tx) error {
+		result, err := tx.Exec(query, event.Content, event.ID, event.PostID, event.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to update comment in shard %d: %w", shardID, err)
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return c.unchangedRow(tx, shardID, "comments", event.ID, event.UserID)
+		}
+		updated = true
+		return nil
+	})
+	if err != nil {
+		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "comments", "error").Inc()
+		return err
+	}
+	
+	databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "comments", "success").Inc()
+	if !updated {
+		return nil
+	}
+	
+	c.logger.WithFields(logrus.Fields{
+		"comment_id": event.ID,
+		"post_id":    event.PostID,
+		"user_id":    event.UserID,
+		"shard_id":   shardID,
+		"trace_id":   envelope.TraceID,
+	}).Info("Comment updated successfully")
+	
+	return nil
+}
+
+func (c *ConsumerService) processCommentDeleted(envelope events.Envelope) error {
+	var event events.CommentDeleted
+	if err := envelope.Unmarshal(&event); err != nil {
+		return &permanentError{err}
+	}
+	
+	shardKey, err := c.placementKey(c.placements.Comments, event.PostID, event.UserID)
+	if err != nil {
+		return err
+	}
+	shardID, db := c.shardFor(shardKey)
+	
+	// Soft delete, as for posts
+	deleted := false
+	err = c.writeCounted(db, shardID, envelope, event.PostID, func(tx *sql.Tx) (stats.Delta, error) {
+		delta, err := writes.DeleteComment(context.Background(), tx, event)
+		if err != nil {
+			return delta, err
+		}
+		if delta.IsZero() {
+			return delta, c.unchangedRow(tx, shardID, "comments", event.ID, event.UserID)
+		}
+		deleted = true
+		return delta, nil
+	})
+	if err != nil {
+		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "comments", "error").Inc()
+		return err
+	}
+	
+	databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "comments", "success").Inc()
+	
+	// A retry skips the delete, but may still have to count it
+	if err := c.applyStats(db, envelope.EventID); err != nil {
+		return err
+	}
+	if !deleted {
+		return nil
+	}
+	
+	c.logger.WithFields(logrus.Fields{
+		"comment_id": event.ID,
+		"post_id":    event.PostID,
+		"user_id":    event.UserID,
+		"shard_id":   shardID,
+		"trace_id":   envelope.TraceID,
+	}).Info("Comment deleted successfully")
+	
+	return nil
+}
+
+func (c *ConsumerService) processLikeEvent(envelope events.Envelope) error {
+	var event events.Like
+	if err := envelope.Unmarshal(&event); err != nil {
+		return &permanentError{err}
+	}
+	
+	// Determine shard from the configured placement
+	shardKey, err := c.placementKey(c.placements.Likes, event.PostID, event.UserID)
+	if err != nil {
+		return err
+	}
+	shardID, db := c.shardFor(shardKey)
 	
 	if event.Action == "like" {
-		// Insert like
-		query := `INSERT INTO likes (id, post_id, user_id, created_at) 
-				  VALUES ($1, $2, $3, $4)
-				  ON CONFLICT (post_id, user_id) DO NOTHING`
+		if !events.IsReaction(event.Reaction) {
+			return &permanentError{fmt.Errorf("unknown reaction %q", event.Reaction)}
+		}
+		
+		// Let point reads of the post find the shard holding this like
+		if err := c.directory.AddParticipant(context.Background(), event.PostID, event.UserID); err != nil {
+			return err
+		}
 		
-		_, err := db.Exec(query, event.ID, event.PostID, event.UserID, event.Timestamp)
+		// Insert the reaction, or change the user's earlier one
+		err := c.writeCounted(db, shardID, envelope, event.PostID, func(tx *sql.Tx) (stats.Delta, error) {
+			return writes.SetReaction(context.Background(), tx, event)
+		})
 		if err != nil {
 			databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "likes", "error").Inc()
-			return fmt.Errorf("failed to insert like into shard %d: %w", shardID, err)
+			return err
 		}
 		
 		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "likes", "success").Inc()
+		if err := c.applyStats(db, envelope.EventID); err != nil {
+			return err
+		}
 		c.logger.WithFields(logrus.Fields{
 			"like_id":  event.ID,
 			"post_id":  event.PostID,
 			"user_id":  event.UserID,
 			"action":   event.Action,
+			"reaction": event.Reaction,
 			"shard_id": shardID,
 		}).Info("Like inserted successfully")
 		
 	} else if event.Action == "unlike" {
 		// Remove like
-		query := `DELETE FROM likes WHERE post_id = $1 AND user_id = $2`
-		
-		result, err := db.Exec(query, event.PostID, event.UserID)
+		var rowsAffected int64
+		err := c.writeCounted(db, shardID, envelope, event.PostID, func(tx *sql.Tx) (stats.Delta, error) {
+			delta, err := writes.RemoveReaction(context.Background(), tx, event)
+			if !delta.IsZero() {
+				rowsAffected = 1
+			}
+			return delta, err
+		})
 		if err != nil {
 			databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "likes", "error").Inc()
-			return fmt.Errorf("failed to delete like from shard %d: %w", shardID, err)
+			return err
 		}
 		
-		rowsAffected, _ := result.RowsAffected()
 		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "likes", "success").Inc()
+		if err := c.applyStats(db, envelope.EventID); err != nil {
+			return err
+		}
 		c.logger.WithFields(logrus.Fields{
 			"post_id":       event.PostID,
 			"user_id":       event.UserID,
@@ -415,30 +1073,336 @@ func (c *ConsumerService) processLikeEvent(message *sarama.ConsumerMessage) erro
 	return nil
 }
 
-// Simple hash function to determine shard
-func (c *ConsumerService) getShardID(userID string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(userID))
-	hash := h.Sum32()
-	shardID := hash % uint32(len(c.shards))
+func (c *ConsumerService) processUserCreated(envelope events.Envelope) error {
+	var event events.UserCreated
+	if err := envelope.Unmarshal(&event); err != nil {
+		return &permanentError{err}
+	}
 	
+	// The directory keeps usernames and emails unique across shards; a user
+	// that lost the race for one is parked on the DLQ
+	if err := c.directory.RegisterUser(context.Background(), event.ID, event.Username, event.Email); err != nil {
+		if errors.Is(err, directory.ErrUserTaken) {
+			return &permanentError{err}
+		}
+		return err
+	}
+	
+	// Users live on the shard of their own ID, next to their posts
+	shardID, db := c.shardFor(event.ID)
+	
+	query := `INSERT INTO users (id, username, email, created_at, updated_at) 
+			  VALUES ($1, $2, $3, $4, $4)
+			  ON CONFLICT (id) DO NOTHING`
+	
+	err := c.writeOnce(db, shardID, envelope, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(query, event.ID, event.Username, event.Email, event.Timestamp); err != nil {
+			return fmt.Errorf("failed to insert user into shard %d: %w", shardID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "users", "error").Inc()
+		return err
+	}
+	
+	databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "users", "success").Inc()
 	c.logger.WithFields(logrus.Fields{
-		"user_id":  userID,
-		"hash":     hash,
+		"user_id":  event.ID,
+		"username": event.Username,
 		"shard_id": shardID,
-		"total_shards": len(c.shards),
+		"trace_id": envelope.TraceID,
+	}).Info("User inserted successfully")
+	
+	return nil
+}
+
+func (c *ConsumerService) processUserUpdated(envelope events.Envelope) error {
+	var event events.UserUpdated
+	if err := envelope.Unmarshal(&event); err != nil {
+		return &permanentError{err}
+	}
+	
+	found, err := c.directory.UpdateUser(context.Background(), event.ID, event.Username, event.Email)
+	if errors.Is(err, directory.ErrUserTaken) {
+		return &permanentError{err}
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		// Waits like edits of posts that are not written yet
+		return &dependencyError{fmt.Errorf("user %s is not in the user directory yet", event.ID)}
+	}
+	
+	shardID, db := c.shardFor(event.ID)
+	
+	// Empty fields keep their value; the trigger bumps updated_at
+	query := `UPDATE users SET username = COALESCE(NULLIF($2, ''), username), 
+			  email = COALESCE(NULLIF($3, ''), email) 
+			  WHERE id = $1`
+	
+	err = c.writeOnce(db, shardID, envelope, func(tx *sql.Tx) error {
+		result, err := tx.Exec(query, event.ID, event.Username, event.Email)
+		if err != nil {
+			return fmt.Errorf("failed to update user in shard %d: %w", shardID, err)
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return &dependencyError{fmt.Errorf("user %s is not in shard %d yet", event.ID, shardID)}
+		}
+		return nil
+	})
+	if err != nil {
+		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "users", "error").Inc()
+		return err
+	}
+	
+	databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "users", "success").Inc()
+	
+	c.logger.WithFields(logrus.Fields{
+		"user_id":  event.ID,
+		"shard_id": shardID,
+		"trace_id": envelope.TraceID,
+	}).Info("User updated successfully")
+	
+	return nil
+}
+
+func (c *ConsumerService) processFollowEvent(envelope events.Envelope) error {
+	var event events.Follow
+	if err := envelope.Unmarshal(&event); err != nil {
+		return &permanentError{err}
+	}
+	
+	// Follows live on the follower's shard, next to the follower's timeline
+	shardID, db := c.shardFor(event.FollowerID)
+	
+	if event.Action == "follow" {
+		query := `INSERT INTO follows (id, follower_id, followee_id, created_at) 
+				  VALUES ($1, $2, $3, $4)
+				  ON CONFLICT (follower_id, followee_id) DO NOTHING`
+		
+		err := c.writeOnce(db, shardID, envelope, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(query, event.ID, event.FollowerID, event.FolloweeID, event.Timestamp); err != nil {
+				return fmt.Errorf("failed to insert follow into shard %d: %w", shardID, err)
+			}
+			return nil
+		})
+		if err != nil {
+			databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "follows", "error").Inc()
+			return err
+		}
+		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "follows", "success").Inc()
+		
+		// Start the timeline with the followee's latest posts once the follow is
+		// committed, so posts fanned out without it are not missed. Also run for
+		// a replayed follow: the first attempt may have failed after committing.
+		if c.feed.Mode == feed.FanOutOnWrite {
+			_, authorDB := c.shardFor(event.FolloweeID)
+			if err := feed.BackfillFollow(context.Background(), authorDB, db, event.FollowerID, event.FolloweeID, c.feed.Backfill); err != nil {
+				databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "timelines", "error").Inc()
+				return &shardError{shardID, err}
+			}
+			databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "timelines", "success").Inc()
+		}
+		
+		c.logger.WithFields(logrus.Fields{
+			"follower_id": event.FollowerID,
+			"followee_id": event.FolloweeID,
+			"action":      event.Action,
+			"shard_id":    shardID,
+		}).Info("Follow inserted successfully")
+		
+	} else if event.Action == "unfollow" {
+		query := `DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2`
+		
+		var rowsAffected int64
+		err := c.writeOnce(db, shardID, envelope, func(tx *sql.Tx) error {
+			result, err := tx.Exec(query, event.FollowerID, event.FolloweeID)
+			if err != nil {
+				return fmt.Errorf("failed to delete follow from shard %d: %w", shardID, err)
+			}
+			rowsAffected, _ = result.RowsAffected()
+			
+			// Timelines are kept in write mode only, but clearing them is harmless
+			// and drops entries left over from an earlier switch of FEED_MODE
+			return feed.Remove(context.Background(), tx, event.FollowerID, event.FolloweeID)
+		})
+		if err != nil {
+			databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "follows", "error").Inc()
+			return err
+		}
+		databaseWrites.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "follows", "success").Inc()
+		
+		c.logger.WithFields(logrus.Fields{
+			"follower_id":   event.FollowerID,
+			"followee_id":   event.FolloweeID,
+			"action":        event.Action,
+			"shard_id":      shardID,
+			"rows_affected": rowsAffected,
+		}).Info("Unfollow processed successfully")
+	}
+	
+	return nil
+}
+
+// placementKey returns the user whose shard stores a comment or like: its
+// author, or the author of its post when the placement is by post
+func (c *ConsumerService) placementKey(placement shard.Placement, postID, authorID string) (string, error) {
+	if placement != shard.PlaceByPost {
+		return authorID, nil
+	}
+	
+	ownerID, found, err := c.directory.PostOwner(context.Background(), postID)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		// Posts and their comments are keyed differently, so the post event may
+		// still be waiting on another partition; waiting gives it time to land
+		return "", &dependencyError{fmt.Errorf("post %s is not in the post directory yet", postID)}
+	}
+	return ownerID, nil
+}
+
+// writeOnce runs the writes of an event in a transaction on its shard that
+// also records the event in processed_events. The offset is committed to
+// Kafka only later, so the event may be delivered again; a shard that has
+// already recorded it skips write and returns nil. An error from write rolls
+// the transaction back and the event is retried.
+func (c *ConsumerService) writeOnce(db *sql.DB, shardID uint32, envelope events.Envelope, write func(tx *sql.Tx) error) error {
+	written, err := dedup.WriteOnce(context.Background(), db, envelope.EventID, envelope.EventType, write)
+	if err != nil {
+		return &shardError{shardID, fmt.Errorf("failed to write event %s to shard %d: %w", envelope.EventID, shardID, err)}
+	}
+	if !written {
+		duplicatesSkipped.WithLabelValues(fmt.Sprintf("shard_%d", shardID), envelope.EventType).Inc()
+		c.logger.WithFields(logrus.Fields{
+			"event_id":   envelope.EventID,
+			"event_type": envelope.EventType,
+			"shard_id":   shardID,
+		}).Info("Skipping event already processed by shard")
+	}
+	return nil
+}
+
+// writeCounted runs the write of a comment or like with writeOnce, recording
+// the change it makes to the post's counters alongside. write returns that
+// change; a write that changed nothing returns a zero Delta.
+func (c *ConsumerService) writeCounted(db *sql.DB, shardID uint32, envelope events.Envelope, postID string, write func(tx *sql.Tx) (stats.Delta, error)) error {
+	return c.writeOnce(db, shardID, envelope, stats.Counted(context.Background(), envelope.EventID, postID, write))
+}
+
+// applyStats adds the counter change recorded for an event to post_stats on
+// the post's shard. A post that belongs on the event's own shard is found
+// there without the directory. Otherwise, as in placementKey, the post may not
+// be in the directory yet, and the event waits for it.
+func (c *ConsumerService) applyStats(rowDB *sql.DB, eventID string) error {
+	return stats.Apply(context.Background(), rowDB, eventID, func(postID string) (*sql.DB, error) {
+		var authorID string
+		err := rowDB.QueryRow(`SELECT user_id FROM posts WHERE id = $1`, postID).Scan(&authorID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to look up post %s: %w", postID, err)
+		}
+		if err == nil {
+			// A copy left behind by resharding is not the post's shard
+			if _, db := c.shardFor(authorID); db == rowDB {
+				return rowDB, nil
+			}
+		}
+		
+		ownerID, found, err := c.directory.PostOwner(context.Background(), postID)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, &dependencyError{fmt.Errorf("post %s is not in the post directory yet", postID)}
+		}
+		_, db := c.shardFor(ownerID)
+		return db, nil
+	})
+}
+
+// pruneProcessed forgets processed events and applied counter changes older
+// than the retention once an hour. Kafka does not deliver messages older than
+// its own retention again, so PROCESSED_EVENTS_RETENTION must be at least that
+// long.
+func (c *ConsumerService) pruneProcessed(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	
+	for {
+		router := c.router.Current()
+		before := time.Now().Add(-c.retention)
+		for _, config := range router.All() {
+			for _, ledger := range []struct {
+				table string
+				prune func(ctx context.Context, db *sql.DB, before time.Time) (int64, error)
+			}{
+				{"processed_events", dedup.Prune},
+				{"post_stats_events", stats.Prune},
+			} {
+				pruned, err := ledger.prune(ctx, router.DB(config.ID), before)
+				if err != nil {
+					if ctx.Err() == nil {
+						c.logger.WithError(err).WithFields(logrus.Fields{
+							"shard_id": config.ID,
+							"table":    ledger.table,
+						}).Warn("Failed to prune processed events")
+					}
+					continue
+				}
+				if pruned > 0 {
+					c.logger.WithFields(logrus.Fields{
+						"shard_id": config.ID,
+						"table":    ledger.table,
+						"pruned":   pruned,
+					}).Info("Pruned processed events")
+				}
+			}
+		}
+		
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// contentType returns the encoding of a message from its content-type header
+func contentType(message *sarama.ConsumerMessage) string {
+	for _, header := range message.Headers {
+		if header != nil && string(header.Key) == events.HeaderContentType {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// Consistent-hash lookup to determine shard, taken from a single shard map
+// snapshot so the ID and pool agree even while the map is reloaded
+func (c *ConsumerService) shardFor(userID string) (uint32, *sql.DB) {
+	router := c.router.Current()
+	shardID := router.ShardFor(userID)
+	
+	c.logger.WithFields(logrus.Fields{
+		"user_id":      userID,
+		"shard_id":     shardID,
+		"total_shards": len(router.All()),
 	}).Debug("Calculated shard for user")
 	
-	return shardID
+	return shardID, router.DB(shardID)
 }
 
 func (c *ConsumerService) healthHandler(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
-		"service":   "consumer",
-		"status":    "healthy",
-		"timestamp": time.Now().UTC(),
-		"shards":    len(c.shards),
-		"version":   "1.0.0",
+		"service":           "consumer",
+		"status":            "healthy",
+		"timestamp":         time.Now().UTC(),
+		"shards":            len(c.router.All()),
+		"shard_map_version": c.router.Version(),
+		"version":           "1.0.0",
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
@@ -471,6 +1435,27 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
 func main() {
 	service, err := NewConsumerService()
 	if err != nil {
@@ -481,9 +1466,13 @@ func main() {
 	// Start HTTP server for health checks and metrics
 	service.startHTTPServer()
 	
-	// Start consuming
-	topics := []string{"posts", "comments", "likes"}
+	// Follow shard map changes in the master DB
+	go service.router.Run(service.ctx)
+	
+	// Forget processed events that Kafka can no longer deliver again
+	go service.pruneProcessed(service.ctx)
 	
+	// Start consuming
 	go func() {
 		for {
 			// `Consume` should be called inside an infinite loop
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+// fakeSession records the offsets marked through it
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+	mu     sync.Mutex
+	marked []int64
+}
+
+func (s *fakeSession) MarkMessage(message *sarama.ConsumerMessage, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = append(s.marked, message.Offset)
+}
+
+func (s *fakeSession) Marked() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.marked...)
+}
+
+func messages(offsets ...int64) map[int64]*sarama.ConsumerMessage {
+	out := make(map[int64]*sarama.ConsumerMessage, len(offsets))
+	for _, offset := range offsets {
+		out[offset] = &sarama.ConsumerMessage{
+			Topic:  "comments",
+			Key:    []byte("post-" + strconv.FormatInt(offset%3, 10)),
+			Offset: offset,
+		}
+	}
+	return out
+}
+
+func equalOffsets(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOffsetTrackerMarksInOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		// done lists the offsets that finish, in order; 10 to 14 are dispatched
+		done []int64
+		want []int64
+	}{
+		{"in order", []int64{10, 11, 12, 13, 14}, []int64{10, 11, 12, 13, 14}},
+		{"reversed", []int64{14, 13, 12, 11, 10}, []int64{14}},
+		{"interleaved lanes", []int64{11, 10, 13, 14, 12}, []int64{11, 14}},
+		{"one slow message", []int64{11, 12, 13, 14, 10}, []int64{14}},
+		{"gaps filled one by one", []int64{12, 10, 14, 11, 13}, []int64{10, 12, 14}},
+		{"lowest never finishes", []int64{11, 12, 13, 14}, nil},
+		{"middle never finishes", []int64{10, 11, 13, 14}, []int64{10, 11}},
+		{"last never finishes", []int64{13, 12, 11, 10}, []int64{13}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &fakeSession{}
+			offsets := newOffsetTracker(session)
+			dispatched := messages(10, 11, 12, 13, 14)
+			for offset := int64(10); offset <= 14; offset++ {
+				offsets.add(dispatched[offset])
+			}
+
+			for _, offset := range tt.done {
+				offsets.done(dispatched[offset])
+			}
+
+			if got := session.Marked(); !equalOffsets(got, tt.want) {
+				t.Errorf("marked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerAcrossLanes(t *testing.T) {
+	const lanes = 4
+	tests := []struct {
+		name string
+		// failAt is the offset whose lane fails and stops (-1: none fails)
+		failAt int64
+	}{
+		{"every lane finishes", -1},
+		{"a lane fails early", 3},
+		{"a lane fails late", 180},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &fakeSession{}
+			offsets := newOffsetTracker(session)
+
+			// Dispatch 200 messages to their lanes the way ConsumeClaim does
+			queues := make([][]*sarama.ConsumerMessage, lanes)
+			for offset := int64(0); offset < 200; offset++ {
+				message := &sarama.ConsumerMessage{
+					Topic:  "likes",
+					Key:    []byte("post-" + strconv.FormatInt(offset%7, 10)),
+					Offset: offset,
+				}
+				offsets.add(message)
+				lane := laneFor(message.Key, lanes)
+				queues[lane] = append(queues[lane], message)
+			}
+
+			// Each lane finishes its messages in order, concurrently with the
+			// others; the failing lane stops at failAt and leaves it unmarked
+			var wg sync.WaitGroup
+			for _, queue := range queues {
+				wg.Add(1)
+				go func(queue []*sarama.ConsumerMessage) {
+					defer wg.Done()
+					for _, message := range queue {
+						if message.Offset == tt.failAt {
+							return
+						}
+						offsets.done(message)
+					}
+				}(queue)
+			}
+			wg.Wait()
+
+			marked := session.Marked()
+			for i := 1; i < len(marked); i++ {
+				if marked[i] <= marked[i-1] {
+					t.Fatalf("marked %v, want increasing offsets", marked)
+				}
+			}
+
+			if tt.failAt < 0 {
+				if len(marked) == 0 || marked[len(marked)-1] != 199 {
+					t.Fatalf("marked %v, want the last offset 199 marked", marked)
+				}
+				return
+			}
+			for _, offset := range marked {
+				if offset >= tt.failAt {
+					t.Fatalf("marked %d, at or past the failed offset %d", offset, tt.failAt)
+				}
+			}
+			if tt.failAt > 0 && (len(marked) == 0 || marked[len(marked)-1] != tt.failAt-1) {
+				t.Fatalf("marked %v, want everything before the failed offset %d marked", marked, tt.failAt)
+			}
+		})
+	}
+}
+
+func TestLaneFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   []byte
+		lanes int
+	}{
+		{"no key", nil, 8},
+		{"empty key", []byte{}, 8},
+		{"one lane", []byte("post-1"), 1},
+		{"post key", []byte("post-1"), 8},
+		{"user key", []byte("0d6f1f0e-8d1c-4c3e-9a53-4c1d2f0b7e21"), 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lane := laneFor(tt.key, tt.lanes)
+			if lane < 0 || lane >= tt.lanes {
+				t.Fatalf("laneFor = %d, want a lane in [0, %d)", lane, tt.lanes)
+			}
+			if len(tt.key) == 0 && lane != 0 {
+				t.Errorf("laneFor = %d, want lane 0 for messages without a key", lane)
+			}
+			if again := laneFor(append([]byte(nil), tt.key...), tt.lanes); again != lane {
+				t.Errorf("laneFor = %d, then %d for the same key", lane, again)
+			}
+		})
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
+
+	"social-media-db/internal/dlq"
+	"social-media-db/internal/events"
+)
+
+// Source topics that have a dead-letter topic
+var sourceTopics = []string{"posts", "comments", "likes", "users", "follows"}
+
+// Entry is a single dead-lettered event
+type Entry struct {
+	ID          string          `json:"id"`
+	Topic       string          `json:"topic"`
+	Partition   int32           `json:"partition"`
+	Offset      int64           `json:"offset"`
+	Key         string          `json:"key"`
+	Timestamp   time.Time       `json:"timestamp"`
+	Metadata    dlq.Metadata    `json:"metadata"`
+	ContentType string          `json:"content_type,omitempty"`
+	Payload     []byte          `json:"-"`
+	Resolution  *dlq.Resolution `json:"resolution,omitempty"`
+}
+
+// Filter selects dead-lettered events
+type Filter struct {
+	IDs             map[string]bool
+	ErrorContains   string
+	Key             string
+	ShardID         int
+	Since           time.Duration
+	IncludeResolved bool
+}
+
+func (f Filter) Match(entry Entry) bool {
+	if len(f.IDs) > 0 && !f.IDs[entry.ID] {
+		return false
+	}
+	if entry.Resolution != nil && !f.IncludeResolved {
+		return false
+	}
+	if f.ErrorContains != "" && !strings.Contains(strings.ToLower(entry.Metadata.Error), strings.ToLower(f.ErrorContains)) {
+		return false
+	}
+	if f.Key != "" && entry.Key != f.Key {
+		return false
+	}
+	if f.ShardID >= 0 && (entry.Metadata.ShardID == nil || *entry.Metadata.ShardID != uint32(f.ShardID)) {
+		return false
+	}
+	if f.Since > 0 && entry.Metadata.FailedAt.Before(time.Now().Add(-f.Since)) {
+		return false
+	}
+	return true
+}
+
+type DLQTool struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+	producer sarama.SyncProducer
+	logger   *logrus.Logger
+}
+
+func NewDLQTool(logger *logrus.Logger) (*DLQTool, error) {
+	kafkaServers := strings.Split(getEnv("KAFKA_BOOTSTRAP_SERVERS", "localhost:9092"), ",")
+
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 3
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Version = sarama.V2_6_0_0
+
+	client, err := sarama.NewClient(kafkaServers, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kafka: %w", err)
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
+	}
+
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		consumer.Close()
+		client.Close()
+		return nil, fmt.Errorf("failed to create producer: %w", err)
+	}
+
+	return &DLQTool{
+		client:   client,
+		consumer: consumer,
+		producer: producer,
+		logger:   logger,
+	}, nil
+}
+
+func (t *DLQTool) Close() {
+	t.producer.Close()
+	t.consumer.Close()
+	t.client.Close()
+}
+
+// readTopic returns every message currently stored on a topic.
+// A topic that does not exist yet is treated as empty.
+func (t *DLQTool) readTopic(topic string) ([]*sarama.ConsumerMessage, error) {
+	partitions, err := t.client.Partitions(topic)
+	if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions of %s: %w", topic, err)
+	}
+
+	var messages []*sarama.ConsumerMessage
+	for _, partition := range partitions {
+		oldest, err := t.client.GetOffset(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get oldest offset of %s/%d: %w", topic, partition, err)
+		}
+		newest, err := t.client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get newest offset of %s/%d: %w", topic, partition, err)
+		}
+		if newest <= oldest {
+			continue
+		}
+
+		pc, err := t.consumer.ConsumePartition(topic, partition, oldest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to consume %s/%d: %w", topic, partition, err)
+		}
+
+		for message := range pc.Messages() {
+			messages = append(messages, message)
+			if message.Offset >= newest-1 {
+				break
+			}
+		}
+		pc.Close()
+	}
+
+	return messages, nil
+}
+
+// readResolutions returns the latest resolution recorded for each entry
+func (t *DLQTool) readResolutions() (map[string]dlq.Resolution, error) {
+	messages, err := t.readTopic(dlq.ResolutionsTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	resolutions := make(map[string]dlq.Resolution)
+	for _, message := range messages {
+		var resolution dlq.Resolution
+		if err := json.Unmarshal(message.Value, &resolution); err != nil {
+			t.logger.WithError(err).WithField("offset", message.Offset).Warn("Skipping invalid resolution record")
+			continue
+		}
+		resolutions[resolution.EntryID] = resolution
+	}
+
+	return resolutions, nil
+}
+
+// Entries loads the dead-lettered events of the given source topics that match the filter
+func (t *DLQTool) Entries(topics []string, filter Filter) ([]Entry, error) {
+	resolutions, err := t.readResolutions()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, topic := range topics {
+		dlqTopic := dlq.TopicFor(topic)
+		messages, err := t.readTopic(dlqTopic)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, message := range messages {
+			meta, err := dlq.ParseMetadata(message)
+			if err != nil {
+				t.logger.WithError(err).WithFields(logrus.Fields{
+					"topic":     dlqTopic,
+					"partition": message.Partition,
+					"offset":    message.Offset,
+				}).Warn("Dead-lettered message has invalid metadata")
+			}
+
+			entry := Entry{
+				ID:        dlq.EntryID(dlqTopic, message.Partition, message.Offset),
+				Topic:     dlqTopic,
+				Partition: message.Partition,
+				Offset:    message.Offset,
+				Key:       string(message.Key),
+				Timestamp: message.Timestamp,
+				Metadata:  meta,
+				Payload:   message.Value,
+			}
+			for _, header := range message.Headers {
+				if header != nil && string(header.Key) == events.HeaderContentType {
+					entry.ContentType = string(header.Value)
+				}
+			}
+			if resolution, ok := resolutions[entry.ID]; ok {
+				entry.Resolution = &resolution
+			}
+
+			if filter.Match(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Metadata.FailedAt.Before(entries[j].Metadata.FailedAt)
+	})
+
+	return entries, nil
+}
+
+// Replay re-publishes an entry to its original topic and marks it resolved
+func (t *DLQTool) Replay(entry Entry) error {
+	msg := &sarama.ProducerMessage{
+		Topic: entry.Metadata.SourceTopic,
+		Value: sarama.ByteEncoder(entry.Payload),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(dlq.HeaderReplayedFrom), Value: []byte(entry.ID)},
+		},
+	}
+	if entry.ContentType != "" {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(events.HeaderContentType), Value: []byte(entry.ContentType)})
+	}
+	if entry.Key != "" {
+		msg.Key = sarama.StringEncoder(entry.Key)
+	}
+
+	partition, offset, err := t.producer.SendMessage(msg)
+	if err != nil {
+		return fmt.Errorf("failed to re-publish %s: %w", entry.ID, err)
+	}
+
+	t.logger.WithFields(logrus.Fields{
+		"entry_id":  entry.ID,
+		"topic":     entry.Metadata.SourceTopic,
+		"partition": partition,
+		"offset":    offset,
+	}).Info("Event replayed")
+
+	return t.resolve(entry, dlq.ActionReplayed, "")
+}
+
+// Drop marks an entry resolved without replaying it
+func (t *DLQTool) Drop(entry Entry, reason string) error {
+	if err := t.resolve(entry, dlq.ActionDropped, reason); err != nil {
+		return err
+	}
+
+	t.logger.WithField("entry_id", entry.ID).Info("Event dropped")
+	return nil
+}
+
+func (t *DLQTool) resolve(entry Entry, action, reason string) error {
+	value, err := json.Marshal(dlq.Resolution{
+		EntryID:    entry.ID,
+		Action:     action,
+		ResolvedAt: time.Now().UTC(),
+		Reason:     reason,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal resolution: %w", err)
+	}
+
+	_, _, err = t.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: dlq.ResolutionsTopic,
+		Key:   sarama.StringEncoder(entry.ID),
+		Value: sarama.ByteEncoder(value),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record resolution for %s: %w", entry.ID, err)
+	}
+
+	return nil
+}
+
+// Command line handling
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: dlq <command> [flags]
+
+Commands:
+  list     List dead-lettered events
+  show     Show a dead-lettered event and its payload
+  replay   Re-publish dead-lettered events to their original topic
+  drop     Discard dead-lettered events
+
+Selection flags (list, replay, drop):
+  -topic      posts, comments or likes (default: all)
+  -id         comma separated entry IDs, e.g. posts.dlq/0/42
+  -error      only events whose error contains this text
+  -key        only events with this message key
+  -shard      only events that failed on this shard
+  -since      only events dead-lettered within this duration, e.g. 2h
+  -resolved   include events that were already replayed or dropped
+
+Run 'dlq <command> -h' for the flags of a command.
+`)
+}
+
+func selectionFlags(fs *flag.FlagSet) (*string, *Filter, func()) {
+	filter := &Filter{}
+	topic := fs.String("topic", "", "source topic (posts, comments or likes)")
+	ids := fs.String("id", "", "comma separated entry IDs")
+	fs.StringVar(&filter.ErrorContains, "error", "", "match events whose error contains this text")
+	fs.StringVar(&filter.Key, "key", "", "match events with this message key")
+	fs.IntVar(&filter.ShardID, "shard", -1, "match events that failed on this shard")
+	fs.DurationVar(&filter.Since, "since", 0, "match events dead-lettered within this duration")
+	fs.BoolVar(&filter.IncludeResolved, "resolved", false, "include already resolved events")
+
+	parseIDs := func() {
+		if *ids == "" {
+			return
+		}
+		filter.IDs = make(map[string]bool)
+		for _, id := range strings.Split(*ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				filter.IDs[id] = true
+			}
+		}
+	}
+
+	return topic, filter, parseIDs
+}
+
+func topicsFor(topic string) ([]string, error) {
+	if topic == "" {
+		return sourceTopics, nil
+	}
+
+	topic = dlq.SourceTopic(topic)
+	for _, t := range sourceTopics {
+		if t == topic {
+			return []string{topic}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown topic %q", topic)
+}
+
+func runList(tool *DLQTool, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	topic, filter, parseIDs := selectionFlags(fs)
+	asJSON := fs.Bool("json", false, "print entries as JSON")
+	fs.Parse(args)
+	parseIDs()
+
+	topics, err := topicsFor(*topic)
+	if err != nil {
+		return err
+	}
+
+	entries, err := tool.Entries(topics, *filter)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKEY\tSHARD\tATTEMPTS\tFAILED AT\tSTATUS\tERROR")
+	for _, entry := range entries {
+		shard := "-"
+		if entry.Metadata.ShardID != nil {
+			shard = fmt.Sprint(*entry.Metadata.ShardID)
+		}
+		status := "pending"
+		if entry.Resolution != nil {
+			status = entry.Resolution.Action
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			entry.ID, entry.Key, shard, entry.Metadata.Attempts,
+			entry.Metadata.FailedAt.Format(time.RFC3339), status, truncate(entry.Metadata.Error, 80))
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d event(s)\n", len(entries))
+	return nil
+}
+
+func runShow(tool *DLQTool, args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	id := fs.String("id", "", "entry ID, e.g. posts.dlq/0/42")
+	fs.Parse(args)
+
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	topics, err := topicsFor(strings.SplitN(*id, "/", 2)[0])
+	if err != nil {
+		return err
+	}
+
+	entries, err := tool.Entries(topics, Filter{
+		IDs:             map[string]bool{*id: true},
+		ShardID:         -1,
+		IncludeResolved: true,
+	})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("entry %s not found", *id)
+	}
+
+	entry := entries[0]
+	meta, _ := json.MarshalIndent(entry, "", "  ")
+	fmt.Println(string(meta))
+
+	fmt.Println("\nPayload:")
+	var payload bytes.Buffer
+	if entry.ContentType == events.ContentTypeProtobuf {
+		fmt.Printf("%d bytes of protobuf\n", len(entry.Payload))
+	} else if err := json.Indent(&payload, entry.Payload, "", "  "); err != nil {
+		fmt.Println(string(entry.Payload))
+	} else {
+		fmt.Println(payload.String())
+	}
+
+	return nil
+}
+
+func runResolve(tool *DLQTool, command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	topic, filter, parseIDs := selectionFlags(fs)
+	all := fs.Bool("all", false, "act on every event matching the filters (required when -id is not given)")
+	dryRun := fs.Bool("dry-run", false, "only print the events that would be affected")
+	reason := fs.String("reason", "", "reason recorded with dropped events")
+	fs.Parse(args)
+	parseIDs()
+
+	if len(filter.IDs) == 0 && !*all {
+		return fmt.Errorf("select events with -id or pass -all to %s every matching event", command)
+	}
+
+	topics, err := topicsFor(*topic)
+	if err != nil {
+		return err
+	}
+
+	entries, err := tool.Entries(topics, *filter)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, entry := range entries {
+		if *dryRun {
+			fmt.Printf("would %s %s (key=%s)\n", command, entry.ID, entry.Key)
+			continue
+		}
+
+		if command == "replay" {
+			err = tool.Replay(entry)
+		} else {
+			err = tool.Drop(entry, *reason)
+		}
+		if err != nil {
+			failed++
+			tool.logger.WithError(err).WithField("entry_id", entry.ID).Error("Failed to " + command + " event")
+		}
+	}
+
+	fmt.Printf("%d event(s) selected, %d failed\n", len(entries), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d event(s) could not be processed", failed)
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func main() {
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+
+	if err := godotenv.Load(); err != nil {
+		logger.Debug("No .env file found")
+	}
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	if command == "-h" || command == "--help" || command == "help" {
+		usage()
+		return
+	}
+
+	tool, err := NewDLQTool(logger)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to create DLQ tool")
+	}
+	defer tool.Close()
+
+	switch command {
+	case "list":
+		err = runList(tool, args)
+	case "show":
+		err = runShow(tool, args)
+	case "replay", "drop":
+		err = runResolve(tool, command, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		logger.WithError(err).Fatal("Command failed")
+	}
+}
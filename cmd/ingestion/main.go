@@ -1,13 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/mail"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,48 +33,95 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
-)
 
-// Event types
-type PostEvent struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
-}
+	"social-media-db/internal/directory"
+	"social-media-db/internal/events"
+	"social-media-db/internal/idempotency"
+	"social-media-db/internal/shard"
+	"social-media-db/internal/spool"
+)
 
-type CommentEvent struct {
-	ID        string    `json:"id"`
-	PostID    string    `json:"post_id"`
-	UserID    string    `json:"user_id"`
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
+// Request types
+type CreatePostRequest struct {
+	UserID  string `json:"user_id"`
+	Content string `json:"content"`
 }
 
-type LikeEvent struct {
-	ID        string    `json:"id"`
-	PostID    string    `json:"post_id"`
-	UserID    string    `json:"user_id"`
-	Action    string    `json:"action"` // "like" or "unlike"
-	Timestamp time.Time `json:"timestamp"`
+type CreateCommentRequest struct {
+	PostID          string `json:"post_id"`
+	UserID          string `json:"user_id"`
+	Content         string `json:"content"`
+	ParentCommentID string `json:"parent_comment_id"` // set on replies
 }
 
-// Request types
-type CreatePostRequest struct {
+// UpdatePostRequest edits a post; UserID must be its author
+type UpdatePostRequest struct {
 	UserID  string `json:"user_id"`
 	Content string `json:"content"`
 }
 
-type CreateCommentRequest struct {
+// DeletePostRequest deletes a post; UserID must be its author
+type DeletePostRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// UpdateCommentRequest edits a comment; UserID must be its author
+type UpdateCommentRequest struct {
 	PostID  string `json:"post_id"`
 	UserID  string `json:"user_id"`
 	Content string `json:"content"`
 }
 
-type LikeRequest struct {
+// DeleteCommentRequest deletes a comment; UserID must be its author
+type DeleteCommentRequest struct {
 	PostID string `json:"post_id"`
 	UserID string `json:"user_id"`
-	Action string `json:"action"` // "like" or "unlike"
+}
+
+// CreateUserRequest registers a user
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// UpdateUserRequest changes a user's profile; empty fields are left unchanged
+type UpdateUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+type LikeRequest struct {
+	PostID   string `json:"post_id"`
+	UserID   string `json:"user_id"`
+	Action   string `json:"action"`   // "like" or "unlike"
+	Reaction string `json:"reaction"` // "like" (default), "love", "laugh", ...
+}
+
+// FollowRequest follows or unfollows a user
+type FollowRequest struct {
+	FollowerID string `json:"follower_id"`
+	FolloweeID string `json:"followee_id"`
+	Action     string `json:"action"` // "follow" or "unfollow"
+}
+
+// BatchItem is one entry of a batch request; Type selects which fields apply
+type BatchItem struct {
+	Type            string `json:"type"` // "post", "comment" or "like"
+	PostID          string `json:"post_id"`
+	UserID          string `json:"user_id"`
+	Content         string `json:"content"`
+	ParentCommentID string `json:"parent_comment_id"` // comments only
+	Action          string `json:"action"`            // likes only, defaults to "like"
+	Reaction        string `json:"reaction"`          // likes only, defaults to "like"
+}
+
+// BatchResult reports the outcome of one batch item, in request order
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Type   string `json:"type,omitempty"`
+	Status string `json:"status"` // "accepted", "invalid" or "failed"
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
 }
 
 // Response types
@@ -96,249 +157,1707 @@ var (
 		},
 		[]string{"method", "endpoint"},
 	)
+	
+	batchItems = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "batch_items_total",
+			Help: "Total number of items received in batch requests",
+		},
+		[]string{"type", "status"},
+	)
+	
+	producerInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "producer_in_flight_events",
+			Help: "Events queued by the async producer and not yet acknowledged",
+		},
+	)
+	
+	spoolDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "spool_depth",
+			Help: "Events waiting in the disk spool for Kafka",
+		},
+	)
+	
+	idempotentRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "idempotent_requests_total",
+			Help: "Total number of requests carrying an Idempotency-Key",
+		},
+		[]string{"endpoint", "result"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(requestsTotal)
 	prometheus.MustRegister(eventsPublished)
 	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(batchItems)
+	prometheus.MustRegister(idempotentRequests)
+	prometheus.MustRegister(producerInFlight)
+	prometheus.MustRegister(spoolDepth)
 }
 
 type IngestionService struct {
+	producer    publisher
+	idempotency idempotency.Store
+	logger      *logrus.Logger
+	
+	// Content type each topic's events are encoded with
+	formats map[string]string
+	schemas events.Schemas
+	
+	batchMaxItems    int
+	batchMaxBytes    int64
+	batchConcurrency int
+	
+	// Retry-After sent when the producer is busy
+	retryAfter time.Duration
+	
+	// Events accepted while Kafka is unreachable, drained by spoolProducer
+	spool              *spool.Spool
+	spoolProducer      sarama.SyncProducer
+	spoolDrainInterval time.Duration
+	spoolDrainBatch    int
+	
+	// Set once an async delivery failed, so new events queue behind it in the
+	// spool until the drainer empties it. failedMu keeps the drainer from
+	// clearing it while a failed delivery is being spooled.
+	deliveryFailed atomic.Bool
+	failedMu       sync.Mutex
+	
+	// Master directory. Replies are checked against the comment directory;
+	// users only when REQUIRE_KNOWN_USERS is true. knownUsers caches the users
+	// found in it.
+	master            *sql.DB
+	directory         *directory.Directory
+	requireKnownUsers bool
+	maxCommentDepth   int
+	knownUsers        sync.Map
+}
+
+func NewIngestionService() (*IngestionService, error) {
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	
+	// Load environment variables
+	if err := godotenv.Load(); err != nil {
+		logger.Warn("No .env file found")
+	}
+	
+	kafkaServers := strings.Split(getEnv("KAFKA_BOOTSTRAP_SERVERS", "localhost:9092"), ",")
+	
+	// Dedupe state for Idempotency-Key retries
+	store, err := idempotency.New(getEnv("IDEMPOTENCY_STORE", "memory"), getEnvDuration("IDEMPOTENCY_WINDOW", 24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	
+	formats, err := loadEventFormats(topics)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Protobuf payloads are encoded with the registered schemas
+	schemas, err := events.LoadSchemas(getEnv("SCHEMA_REGISTRY", "schemas/registry.json"))
+	if err != nil {
+		return nil, err
+	}
+	
+	producer, err := newPublisher(kafkaServers, logger)
+	if err != nil {
+		return nil, err
+	}
+	
+	service := &IngestionService{
+		producer:           producer,
+		idempotency:        store,
+		logger:             logger,
+		formats:            formats,
+		schemas:            schemas,
+		batchMaxItems:      getEnvInt("BATCH_MAX_ITEMS", 1000),
+		batchMaxBytes:      int64(getEnvInt("BATCH_MAX_BYTES", 10<<20)),
+		batchConcurrency:   getEnvInt("BATCH_CONCURRENCY", 32),
+		retryAfter:         getEnvDuration("PRODUCER_RETRY_AFTER", time.Second),
+		spoolDrainInterval: getEnvDuration("SPOOL_DRAIN_INTERVAL", time.Second),
+		spoolDrainBatch:    getEnvInt("SPOOL_DRAIN_BATCH", 100),
+	}
+	
+	// Disk spool for events accepted while Kafka is unreachable
+	if getEnv("SPOOL_ENABLED", "true") == "true" {
+		service.spool, err = spool.Open(getEnv("SPOOL_DIR", "spool"), int64(getEnvInt("SPOOL_SEGMENT_BYTES", 64<<20)))
+		if err != nil {
+			producer.Close()
+			return nil, err
+		}
+		spoolDepth.Set(float64(service.spool.Depth()))
+		
+		service.spoolProducer, err = sarama.NewSyncProducer(kafkaServers, producerConfig())
+		if err != nil {
+			service.Close()
+			return nil, fmt.Errorf("failed to create spool producer: %w", err)
+		}
+		
+		// Async deliveries fail after the client got 202; spool those too
+		if async, ok := producer.(*asyncPublisher); ok {
+			async.onError = service.spoolFailedDelivery
+		}
+	}
+	
+	// Directory used to check replies and, optionally, reject events from
+	// users that were never registered
+	service.master, err = shard.OpenMaster()
+	if err != nil {
+		service.Close()
+		return nil, err
+	}
+	service.directory = directory.New(service.master)
+	service.requireKnownUsers = getEnv("REQUIRE_KNOWN_USERS", "false") == "true"
+	service.maxCommentDepth = getEnvInt("COMMENT_MAX_DEPTH", 5)
+	
+	return service, nil
+}
+
+// Topics the service publishes to
+var topics = []string{"posts", "comments", "likes", "users", "follows"}
+
+// loadEventFormats reads the encoding of every topic from EVENT_FORMAT, which
+// <TOPIC>_EVENT_FORMAT overrides (e.g. LIKES_EVENT_FORMAT=protobuf)
+func loadEventFormats(topics []string) (map[string]string, error) {
+	formats := make(map[string]string, len(topics))
+	for _, topic := range topics {
+		key := strings.ToUpper(topic) + "_EVENT_FORMAT"
+		switch format := getEnv(key, getEnv("EVENT_FORMAT", "json")); format {
+		case "json":
+			formats[topic] = events.ContentTypeJSON
+		case "protobuf":
+			formats[topic] = events.ContentTypeProtobuf
+		default:
+			return nil, fmt.Errorf("invalid event format %q for %s: must be json or protobuf", format, topic)
+		}
+	}
+	return formats, nil
+}
+
+// spoolFailedDelivery spools an async delivery that failed because Kafka was
+// unreachable: the client already got 202, so the drainer must retry it.
+// Events published from then on are spooled behind it; only those already
+// queued when it failed may overtake it. Other errors (e.g. a message too
+// large) would fail again, so the event is left lost.
+func (s *IngestionService) spoolFailedDelivery(msg *sarama.ProducerMessage, err error) bool {
+	if !brokerUnavailable(err) {
+		return false
+	}
+	
+	key, _ := msg.Key.Encode()
+	value, _ := msg.Value.Encode()
+	message := spool.Message{Topic: msg.Topic, Key: string(key), Value: value}
+	for _, header := range msg.Headers {
+		if string(header.Key) == events.HeaderContentType {
+			message.ContentType = string(header.Value)
+		}
+	}
+	
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	s.deliveryFailed.Store(true)
+	if err := s.spoolEvent(message); err != nil {
+		s.logger.WithError(err).WithField("topic", msg.Topic).Error("Failed to spool undelivered event")
+		return false
+	}
+	return true
+}
+
+func (s *IngestionService) Close() {
+	if s.producer != nil {
+		s.producer.Close()
+	}
+	if s.spoolProducer != nil {
+		s.spoolProducer.Close()
+	}
+	if s.spool != nil {
+		s.spool.Close()
+	}
+	if s.master != nil {
+		s.master.Close()
+	}
+}
+
+func (s *IngestionService) publishEvent(topic string, key string, eventType string, event interface{}, traceID string) error {
+	envelope, err := events.New(eventType, event, traceID)
+	if err != nil {
+		eventsPublished.WithLabelValues(topic, "error").Inc()
+		return err
+	}
+	
+	contentType := s.formats[topic]
+	value, err := events.Encode(envelope, contentType, s.schemas)
+	if err != nil {
+		eventsPublished.WithLabelValues(topic, "error").Inc()
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	
+	msg := &sarama.ProducerMessage{
+		Topic:   topic,
+		Key:     sarama.StringEncoder(key),
+		Value:   sarama.ByteEncoder(value),
+		Headers: []sarama.RecordHeader{{Key: []byte(events.HeaderContentType), Value: []byte(contentType)}},
+	}
+	
+	if s.spool == nil {
+		return s.producer.Publish(msg)
+	}
+	
+	// Once events are spooled, or an async delivery failed and is about to be,
+	// later ones queue behind them to keep their order
+	message := spool.Message{Topic: topic, Key: key, Value: value, ContentType: contentType}
+	if s.deliveryFailed.Load() || s.spool.Depth() > 0 {
+		return s.spoolEvent(message)
+	}
+	
+	err = s.producer.Publish(msg)
+	if err != nil && brokerUnavailable(err) {
+		s.logger.WithError(err).WithField("topic", topic).Warn("Kafka unavailable, spooling event")
+		return s.spoolEvent(message)
+	}
+	return err
+}
+
+// spoolEvent stores an event on disk until the drainer can publish it
+func (s *IngestionService) spoolEvent(message spool.Message) error {
+	if err := s.spool.Append(message); err != nil {
+		eventsPublished.WithLabelValues(message.Topic, "error").Inc()
+		return fmt.Errorf("failed to spool event: %w", err)
+	}
+	
+	eventsPublished.WithLabelValues(message.Topic, "spooled").Inc()
+	spoolDepth.Set(float64(s.spool.Depth()))
+	return nil
+}
+
+// drainSpool publishes spooled events in order whenever Kafka accepts them
+func (s *IngestionService) drainSpool(ctx context.Context) {
+	ticker := time.NewTicker(s.spoolDrainInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		
+		for ctx.Err() == nil {
+			messages, err := s.spool.Read(s.spoolDrainBatch)
+			if err != nil {
+				s.logger.WithError(err).Error("Failed to read spool")
+				break
+			}
+			if len(messages) == 0 {
+				s.clearDeliveryFailed()
+				break
+			}
+			
+			sent := s.sendSpooled(messages)
+			if err := s.spool.Ack(sent); err != nil {
+				s.logger.WithError(err).Error("Failed to checkpoint spool")
+				break
+			}
+			spoolDepth.Set(float64(s.spool.Depth()))
+			
+			if sent < len(messages) {
+				break // Kafka is still unavailable; retry on the next tick
+			}
+			s.logger.WithFields(logrus.Fields{
+				"events":    sent,
+				"remaining": s.spool.Depth(),
+			}).Info("Drained spooled events to Kafka")
+		}
+	}
+}
+
+// clearDeliveryFailed lets events go straight to Kafka again once the spool
+// is empty and no failed delivery is being spooled
+func (s *IngestionService) clearDeliveryFailed() {
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	if s.spool.Depth() == 0 {
+		s.deliveryFailed.Store(false)
+	}
+}
+
+// sendSpooled publishes spooled messages and returns how many leading ones
+// are done with: delivered, or rejected by Kafka for good
+func (s *IngestionService) sendSpooled(messages []spool.Message) int {
+	batch := make([]*sarama.ProducerMessage, len(messages))
+	for i, message := range messages {
+		batch[i] = &sarama.ProducerMessage{
+			Topic:    message.Topic,
+			Key:      sarama.StringEncoder(message.Key),
+			Value:    sarama.ByteEncoder(message.Value),
+			Metadata: i,
+		}
+		if message.ContentType != "" {
+			batch[i].Headers = []sarama.RecordHeader{{Key: []byte(events.HeaderContentType), Value: []byte(message.ContentType)}}
+		}
+	}
+	
+	err := s.spoolProducer.SendMessages(batch)
+	if err == nil {
+		for _, message := range messages {
+			eventsPublished.WithLabelValues(message.Topic, "success").Inc()
+		}
+		return len(messages)
+	}
+	
+	// Resend from the first failure Kafka may still accept on; anything after
+	// it that did get through is published again, which the consumer's
+	// idempotent writes absorb. Messages Kafka rejects for good are dropped so
+	// they do not hold up the spool.
+	var failures sarama.ProducerErrors
+	if !errors.As(err, &failures) {
+		s.logger.WithError(err).WithField("delivered", 0).Warn("Failed to drain spool")
+		return 0
+	}
+	failed := make(map[int]error, len(failures))
+	for _, failure := range failures {
+		failed[failure.Msg.Metadata.(int)] = failure.Err
+	}
+	
+	sent := 0
+	for ; sent < len(messages); sent++ {
+		message := messages[sent]
+		failure, ok := failed[sent]
+		if !ok {
+			eventsPublished.WithLabelValues(message.Topic, "success").Inc()
+			continue
+		}
+		if brokerUnavailable(failure) {
+			break
+		}
+		eventsPublished.WithLabelValues(message.Topic, "lost").Inc()
+		s.logger.WithError(failure).WithFields(logrus.Fields{
+			"topic": message.Topic,
+			"key":   message.Key,
+		}).Error("Kafka rejected spooled event, event lost")
+	}
+	s.logger.WithError(err).WithField("delivered", sent).Warn("Failed to drain spool")
+	return sent
+}
+
+// retryAfterSeconds formats PRODUCER_RETRY_AFTER for the Retry-After header
+func (s *IngestionService) retryAfterSeconds() string {
+	return strconv.Itoa(int(math.Ceil(s.retryAfter.Seconds())))
+}
+
+// respondPublishError answers a request whose event could not be published:
+// 503 with Retry-After when the producer is busy, 500 otherwise
+func (s *IngestionService) respondPublishError(w http.ResponseWriter, method, endpoint string, err error, message string) {
+	if errors.Is(err, errProducerBusy) {
+		requestsTotal.WithLabelValues(method, endpoint, "503").Inc()
+		w.Header().Set("Retry-After", s.retryAfterSeconds())
+		s.respondWithError(w, http.StatusServiceUnavailable, "Too many pending events, retry later")
+		return
+	}
+	
+	requestsTotal.WithLabelValues(method, endpoint, "500").Inc()
+	s.logger.WithError(err).Error("Failed to publish event")
+	s.respondWithError(w, http.StatusInternalServerError, message)
+}
+
+// errProducerBusy is returned when the async producer has too many undelivered
+// events; clients should retry after a short wait
+var errProducerBusy = errors.New("too many events waiting for delivery")
+
+// publisher hands messages to Kafka
+type publisher interface {
+	Publish(msg *sarama.ProducerMessage) error
+	Close() error
+}
+
+// newPublisher creates the producer selected by PRODUCER_MODE: "sync" (default)
+// waits for every ack; "async" batches messages and acknowledges requests once
+// they are queued.
+func newPublisher(kafkaServers []string, logger *logrus.Logger) (publisher, error) {
+	config := producerConfig()
+	
+	switch mode := getEnv("PRODUCER_MODE", "sync"); mode {
+	case "sync":
+		producer, err := sarama.NewSyncProducer(kafkaServers, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
+		}
+		return &syncPublisher{producer: producer, logger: logger}, nil
+		
+	case "async":
+		compression := getEnv("PRODUCER_COMPRESSION", "snappy")
+		if err := config.Producer.Compression.UnmarshalText([]byte(compression)); err != nil {
+			return nil, fmt.Errorf("invalid PRODUCER_COMPRESSION %q: %w", compression, err)
+		}
+		config.Producer.Flush.Frequency = getEnvDuration("PRODUCER_LINGER", 5*time.Millisecond)
+		config.Producer.Flush.Bytes = getEnvInt("PRODUCER_BATCH_BYTES", 64*1024)
+		
+		producer, err := sarama.NewAsyncProducer(kafkaServers, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
+		}
+		
+		p := &asyncPublisher{
+			producer: producer,
+			inFlight: make(chan struct{}, getEnvInt("PRODUCER_MAX_IN_FLIGHT", 10000)),
+			logger:   logger,
+		}
+		p.wg.Add(2)
+		go p.handleSuccesses()
+		go p.handleErrors()
+		return p, nil
+		
+	default:
+		return nil, fmt.Errorf("invalid PRODUCER_MODE %q: must be \"sync\" or \"async\"", mode)
+	}
+}
+
+// producerConfig returns the Sarama settings shared by every producer
+func producerConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll // Wait for all in-sync replicas to ack
+	config.Producer.Retry.Max = 3                    // Retry up to 3 times to produce the message
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Version = sarama.V2_6_0_0 
+	return config
+}
+
+// brokerUnavailable reports whether a publish failed because Kafka could not
+// be reached, as opposed to a problem with the message itself
+func brokerUnavailable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	for _, target := range []error{
+		sarama.ErrOutOfBrokers,
+		sarama.ErrNotConnected,
+		sarama.ErrClosedClient,
+		sarama.ErrBrokerNotAvailable,
+		sarama.ErrLeaderNotAvailable,
+		sarama.ErrNotLeaderForPartition,
+		sarama.ErrRequestTimedOut,
+		sarama.ErrNotEnoughReplicas,
+		sarama.ErrNotEnoughReplicasAfterAppend,
+		sarama.ErrNetworkException,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncPublisher sends each message and waits for its ack
+type syncPublisher struct {
 	producer sarama.SyncProducer
 	logger   *logrus.Logger
 }
 
-func NewIngestionService() (*IngestionService, error) {
-	logger := logrus.New()
-	logger.SetFormatter(&logrus.JSONFormatter{})
+func (p *syncPublisher) Publish(msg *sarama.ProducerMessage) error {
+	partition, offset, err := p.producer.SendMessage(msg)
+	if err != nil {
+		eventsPublished.WithLabelValues(msg.Topic, "error").Inc()
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	
+	eventsPublished.WithLabelValues(msg.Topic, "success").Inc()
+	p.logger.WithFields(logrus.Fields{
+		"topic":     msg.Topic,
+		"key":       msg.Key,
+		"partition": partition,
+		"offset":    offset,
+	}).Info("Event published successfully")
+	
+	return nil
+}
+
+func (p *syncPublisher) Close() error {
+	return p.producer.Close()
+}
+
+// asyncPublisher queues messages for batched delivery. inFlight bounds how
+// many queued messages may still await their ack. onError may take over a
+// failed delivery (e.g. spool it) by returning true.
+type asyncPublisher struct {
+	producer sarama.AsyncProducer
+	inFlight chan struct{}
+	onError  func(msg *sarama.ProducerMessage, err error) bool
+	logger   *logrus.Logger
+	wg       sync.WaitGroup
+}
+
+func (p *asyncPublisher) Publish(msg *sarama.ProducerMessage) error {
+	select {
+	case p.inFlight <- struct{}{}:
+	default:
+		eventsPublished.WithLabelValues(msg.Topic, "rejected").Inc()
+		return errProducerBusy
+	}
+	
+	producerInFlight.Inc()
+	p.producer.Input() <- msg
+	return nil
+}
+
+func (p *asyncPublisher) handleSuccesses() {
+	defer p.wg.Done()
+	for msg := range p.producer.Successes() {
+		<-p.inFlight
+		producerInFlight.Dec()
+		eventsPublished.WithLabelValues(msg.Topic, "success").Inc()
+		p.logger.WithFields(logrus.Fields{
+			"topic":     msg.Topic,
+			"key":       msg.Key,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+		}).Debug("Event published successfully")
+	}
+}
+
+func (p *asyncPublisher) handleErrors() {
+	defer p.wg.Done()
+	for err := range p.producer.Errors() {
+		<-p.inFlight
+		producerInFlight.Dec()
+		if p.onError != nil && p.onError(err.Msg, err.Err) {
+			continue
+		}
+		// The request was already accepted, so the event is gone
+		eventsPublished.WithLabelValues(err.Msg.Topic, "lost").Inc()
+		p.logger.WithError(err.Err).WithFields(logrus.Fields{
+			"topic": err.Msg.Topic,
+			"key":   err.Msg.Key,
+		}).Error("Failed to deliver accepted event, event lost")
+	}
+}
+
+// Close flushes queued messages and waits for their delivery outcome
+func (p *asyncPublisher) Close() error {
+	p.producer.AsyncClose()
+	p.wg.Wait()
+	return nil
+}
+
+// newPostEvent validates a post request and builds its event
+func newPostEvent(req CreatePostRequest) (events.Post, error) {
+	if req.UserID == "" || req.Content == "" {
+		return events.Post{}, errors.New("user_id and content are required")
+	}
+	if len(req.Content) > 280 {
+		return events.Post{}, errors.New("content must be 280 characters or less")
+	}
+	
+	return events.Post{
+		ID:        uuid.New().String(),
+		UserID:    req.UserID,
+		Content:   req.Content,
+		Timestamp: time.Now().UTC(),
+	}, nil
+}
+
+// newCommentEvent validates a comment request and builds its event
+func newCommentEvent(req CreateCommentRequest) (events.Comment, error) {
+	if req.PostID == "" || req.UserID == "" || req.Content == "" {
+		return events.Comment{}, errors.New("post_id, user_id and content are required")
+	}
+	if len(req.Content) > 280 {
+		return events.Comment{}, errors.New("content must be 280 characters or less")
+	}
+	
+	return events.Comment{
+		ID:              uuid.New().String(),
+		PostID:          req.PostID,
+		UserID:          req.UserID,
+		Content:         req.Content,
+		ParentCommentID: req.ParentCommentID,
+		Timestamp:       time.Now().UTC(),
+	}, nil
+}
+
+// newLikeEvent validates a like request and builds its event. A like sets the
+// user's reaction to the post, an unlike removes whichever reaction it is.
+func newLikeEvent(req LikeRequest) (events.Like, error) {
+	if req.PostID == "" || req.UserID == "" {
+		return events.Like{}, errors.New("post_id and user_id are required")
+	}
+	if req.Action != "like" && req.Action != "unlike" {
+		return events.Like{}, errors.New("action must be 'like' or 'unlike'")
+	}
+	
+	reaction := ""
+	if req.Action == "like" {
+		reaction = req.Reaction
+		if reaction == "" {
+			reaction = "like"
+		}
+		if !events.IsReaction(reaction) {
+			return events.Like{}, fmt.Errorf("reaction must be one of %s", strings.Join(events.Reactions, ", "))
+		}
+	}
+	
+	return events.Like{
+		ID:        uuid.New().String(),
+		PostID:    req.PostID,
+		UserID:    req.UserID,
+		Action:    req.Action,
+		Reaction:  reaction,
+		Timestamp: time.Now().UTC(),
+	}, nil
+}
+
+// newFollowEvent validates a follow request and builds its event
+func newFollowEvent(req FollowRequest) (events.Follow, error) {
+	if req.FollowerID == "" || req.FolloweeID == "" {
+		return events.Follow{}, errors.New("follower_id and followee_id are required")
+	}
+	if req.FollowerID == req.FolloweeID {
+		return events.Follow{}, errors.New("users cannot follow themselves")
+	}
+	if req.Action != "follow" && req.Action != "unfollow" {
+		return events.Follow{}, errors.New("action must be 'follow' or 'unfollow'")
+	}
+	
+	return events.Follow{
+		ID:         uuid.New().String(),
+		FollowerID: req.FollowerID,
+		FolloweeID: req.FolloweeID,
+		Action:     req.Action,
+		Timestamp:  time.Now().UTC(),
+	}, nil
+}
+
+// newPostUpdatedEvent validates a post edit and builds its event
+func newPostUpdatedEvent(postID string, req UpdatePostRequest) (events.PostUpdated, error) {
+	if req.UserID == "" || req.Content == "" {
+		return events.PostUpdated{}, errors.New("user_id and content are required")
+	}
+	if len(req.Content) > 280 {
+		return events.PostUpdated{}, errors.New("content must be 280 characters or less")
+	}
+	
+	return events.PostUpdated{
+		ID:        postID,
+		UserID:    req.UserID,
+		Content:   req.Content,
+		Timestamp: time.Now().UTC(),
+	}, nil
+}
+
+// newCommentUpdatedEvent validates a comment edit and builds its event
+func newCommentUpdatedEvent(commentID string, req UpdateCommentRequest) (events.CommentUpdated, error) {
+	if req.PostID == "" || req.UserID == "" || req.Content == "" {
+		return events.CommentUpdated{}, errors.New("post_id, user_id and content are required")
+	}
+	if len(req.Content) > 280 {
+		return events.CommentUpdated{}, errors.New("content must be 280 characters or less")
+	}
+	
+	return events.CommentUpdated{
+		ID:        commentID,
+		PostID:    req.PostID,
+		UserID:    req.UserID,
+		Content:   req.Content,
+		Timestamp: time.Now().UTC(),
+	}, nil
+}
+
+// usernamePattern is what a username may look like
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,30}$`)
+
+// validateProfile checks the username and email of a user request. Empty
+// values are allowed when updating.
+func validateProfile(username, email string, update bool) error {
+	if !update && (username == "" || email == "") {
+		return errors.New("username and email are required")
+	}
+	if update && username == "" && email == "" {
+		return errors.New("username or email is required")
+	}
+	if username != "" && !usernamePattern.MatchString(username) {
+		return errors.New("username must be 3 to 30 letters, digits or underscores")
+	}
+	if email != "" {
+		if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+			return errors.New("email is not a valid address")
+		}
+	}
+	return nil
+}
+
+// newUserCreatedEvent validates a user registration and builds its event
+func newUserCreatedEvent(req CreateUserRequest) (events.UserCreated, error) {
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if err := validateProfile(req.Username, email, false); err != nil {
+		return events.UserCreated{}, err
+	}
+	
+	return events.UserCreated{
+		ID:        uuid.New().String(),
+		Username:  req.Username,
+		Email:     email,
+		Timestamp: time.Now().UTC(),
+	}, nil
+}
+
+// newUserUpdatedEvent validates a profile change and builds its event
+func newUserUpdatedEvent(userID string, req UpdateUserRequest) (events.UserUpdated, error) {
+	if _, err := uuid.Parse(userID); err != nil {
+		return events.UserUpdated{}, errors.New("user id must be a UUID")
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if err := validateProfile(req.Username, email, true); err != nil {
+		return events.UserUpdated{}, err
+	}
+	
+	return events.UserUpdated{
+		ID:        userID,
+		Username:  req.Username,
+		Email:     email,
+		Timestamp: time.Now().UTC(),
+	}, nil
+}
+
+var errUnknownUser = errors.New("unknown user_id")
+
+// requireUser checks that a user is registered when REQUIRE_KNOWN_USERS is
+// set. Registration is asynchronous, so a user is only found once the
+// consumer has processed its user.created event.
+func (s *IngestionService) requireUser(ctx context.Context, userID string) error {
+	if !s.requireKnownUsers {
+		return nil
+	}
+	if _, ok := s.knownUsers.Load(userID); ok {
+		return nil
+	}
+	
+	exists, err := s.directory.UserExists(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errUnknownUser
+	}
+	
+	// Users are never removed, so a positive answer stays true
+	s.knownUsers.Store(userID, struct{}{})
+	return nil
+}
+
+// respondUserError reports a failed requireUser check
+func (s *IngestionService) respondUserError(w http.ResponseWriter, method, endpoint string, err error) {
+	if errors.Is(err, errUnknownUser) {
+		requestsTotal.WithLabelValues(method, endpoint, "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	s.logger.WithError(err).Error("Failed to look up user")
+	requestsTotal.WithLabelValues(method, endpoint, "503").Inc()
+	s.respondWithError(w, http.StatusServiceUnavailable, "Failed to check user")
+}
+
+var errInvalidReply = errors.New("invalid parent_comment_id")
+
+// requireParent checks that a reply answers a comment on the same post and
+// stays within COMMENT_MAX_DEPTH. Like users, a comment is only found once the
+// consumer has processed it.
+func (s *IngestionService) requireParent(ctx context.Context, postID, parentID string) error {
+	if parentID == "" {
+		return nil
+	}
+	
+	parent, found, err := s.directory.Comment(ctx, parentID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: unknown comment %s", errInvalidReply, parentID)
+	}
+	if parent.PostID != postID {
+		return fmt.Errorf("%w: comment %s is not on post %s", errInvalidReply, parentID, postID)
+	}
+	if parent.Depth+1 > s.maxCommentDepth {
+		return fmt.Errorf("%w: replies cannot be nested more than %d levels deep", errInvalidReply, s.maxCommentDepth)
+	}
+	return nil
+}
+
+// respondParentError reports a failed requireParent check
+func (s *IngestionService) respondParentError(w http.ResponseWriter, method, endpoint string, err error) {
+	if errors.Is(err, errInvalidReply) {
+		requestsTotal.WithLabelValues(method, endpoint, "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	s.logger.WithError(err).Error("Failed to look up parent comment")
+	requestsTotal.WithLabelValues(method, endpoint, "503").Inc()
+	s.respondWithError(w, http.StatusServiceUnavailable, "Failed to check parent comment")
+}
+
+func (s *IngestionService) handleCreatePost(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("POST", "/api/posts"))
+	defer timer.ObserveDuration()
+	
+	var req CreatePostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestsTotal.WithLabelValues("POST", "/api/posts", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	
+	// Validate and create event
+	event, err := newPostEvent(req)
+	if err != nil {
+		requestsTotal.WithLabelValues("POST", "/api/posts", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	if err := s.requireUser(r.Context(), req.UserID); err != nil {
+		s.respondUserError(w, r.Method, "/api/posts", err)
+		return
+	}
+	
+	// Publish to Kafka
+	if err := s.publishEvent("posts", req.UserID, events.TypePostCreated, event, traceID(r)); err != nil {
+		s.respondPublishError(w, r.Method, "/api/posts", err, "Failed to process post")
+		return
+	}
+	
+	requestsTotal.WithLabelValues("POST", "/api/posts", "202").Inc()
+	s.respondWithJSON(w, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: "Post accepted for processing",
+		Data: map[string]string{
+			"post_id": event.ID,
+		},
+	})
+}
+
+func (s *IngestionService) handleCreateComment(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("POST", "/api/comments"))
+	defer timer.ObserveDuration()
+	
+	var req CreateCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestsTotal.WithLabelValues("POST", "/api/comments", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	
+	// Validate and create event
+	event, err := newCommentEvent(req)
+	if err != nil {
+		requestsTotal.WithLabelValues("POST", "/api/comments", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	if err := s.requireUser(r.Context(), req.UserID); err != nil {
+		s.respondUserError(w, r.Method, "/api/comments", err)
+		return
+	}
+	
+	if err := s.requireParent(r.Context(), req.PostID, req.ParentCommentID); err != nil {
+		s.respondParentError(w, r.Method, "/api/comments", err)
+		return
+	}
+	
+	// Publish to Kafka (key by post_id to ensure ordering per post)
+	if err := s.publishEvent("comments", req.PostID, events.TypeCommentCreated, event, traceID(r)); err != nil {
+		s.respondPublishError(w, r.Method, "/api/comments", err, "Failed to process comment")
+		return
+	}
+	
+	requestsTotal.WithLabelValues("POST", "/api/comments", "202").Inc()
+	s.respondWithJSON(w, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: "Comment accepted for processing",
+		Data: map[string]string{
+			"comment_id": event.ID,
+		},
+	})
+}
+
+func (s *IngestionService) handleLike(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("POST", "/api/likes"))
+	defer timer.ObserveDuration()
+	
+	var req LikeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestsTotal.WithLabelValues("POST", "/api/likes", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	
+	// Validate and create event
+	event, err := newLikeEvent(req)
+	if err != nil {
+		requestsTotal.WithLabelValues("POST", "/api/likes", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	if err := s.requireUser(r.Context(), req.UserID); err != nil {
+		s.respondUserError(w, r.Method, "/api/likes", err)
+		return
+	}
+	
+	// Publish to Kafka (key by post_id to ensure ordering per post)
+	if err := s.publishEvent("likes", req.PostID, events.TypeLikeChanged, event, traceID(r)); err != nil {
+		s.respondPublishError(w, r.Method, "/api/likes", err, "Failed to process like")
+		return
+	}
+	
+	requestsTotal.WithLabelValues("POST", "/api/likes", "202").Inc()
+	s.respondWithJSON(w, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("%s accepted for processing", strings.Title(req.Action)),
+		Data: map[string]string{
+			"like_id": event.ID,
+		},
+	})
+}
+
+// POST /api/follows - Follow or unfollow a user
+func (s *IngestionService) handleFollow(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("POST", "/api/follows"))
+	defer timer.ObserveDuration()
+	
+	var req FollowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestsTotal.WithLabelValues("POST", "/api/follows", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	
+	event, err := newFollowEvent(req)
+	if err != nil {
+		requestsTotal.WithLabelValues("POST", "/api/follows", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	for _, userID := range []string{req.FollowerID, req.FolloweeID} {
+		if err := s.requireUser(r.Context(), userID); err != nil {
+			s.respondUserError(w, r.Method, "/api/follows", err)
+			return
+		}
+	}
+	
+	// Key by follower_id so a user's follows and unfollows are applied in order
+	if err := s.publishEvent("follows", req.FollowerID, events.TypeFollowChanged, event, traceID(r)); err != nil {
+		s.respondPublishError(w, r.Method, "/api/follows", err, "Failed to process follow")
+		return
+	}
+	
+	requestsTotal.WithLabelValues("POST", "/api/follows", "202").Inc()
+	s.respondWithJSON(w, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("%s accepted for processing", strings.Title(req.Action)),
+		Data: map[string]string{
+			"follow_id": event.ID,
+		},
+	})
+}
+
+// PUT /api/posts/{id} - Edit a post
+func (s *IngestionService) handleUpdatePost(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("PUT", "/api/posts/{id}"))
+	defer timer.ObserveDuration()
 	
-	// Load environment variables
-	if err := godotenv.Load(); err != nil {
-		logger.Warn("No .env file found")
+	var req UpdatePostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestsTotal.WithLabelValues("PUT", "/api/posts/{id}", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
 	}
 	
-	kafkaServers := strings.Split(getEnv("KAFKA_BOOTSTRAP_SERVERS", "localhost:9092"), ",")
+	event, err := newPostUpdatedEvent(mux.Vars(r)["id"], req)
+	if err != nil {
+		requestsTotal.WithLabelValues("PUT", "/api/posts/{id}", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	
-	// Configure Sarama
-	config := sarama.NewConfig()
-	config.Producer.RequiredAcks = sarama.WaitForAll // Wait for all in-sync replicas to ack
-	config.Producer.Retry.Max = 3                    // Retry up to 3 times to produce the message
-	config.Producer.Return.Successes = true
-	config.Producer.Return.Errors = true
-	config.Version = sarama.V2_6_0_0 
+	if err := s.requireUser(r.Context(), req.UserID); err != nil {
+		s.respondUserError(w, r.Method, "/api/posts/{id}", err)
+		return
+	}
 	
-	producer, err := sarama.NewSyncProducer(kafkaServers, config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
+	// Keyed like the create so the edit is applied after it
+	if err := s.publishEvent("posts", req.UserID, events.TypePostUpdated, event, traceID(r)); err != nil {
+		s.respondPublishError(w, r.Method, "/api/posts/{id}", err, "Failed to process post update")
+		return
 	}
 	
-	return &IngestionService{
-		producer: producer,
-		logger:   logger,
-	}, nil
+	requestsTotal.WithLabelValues("PUT", "/api/posts/{id}", "202").Inc()
+	s.respondWithJSON(w, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: "Post update accepted for processing",
+		Data: map[string]string{
+			"post_id": event.ID,
+		},
+	})
 }
 
-func (s *IngestionService) Close() {
-	if s.producer != nil {
-		s.producer.Close()
+// DELETE /api/posts/{id} - Soft-delete a post
+func (s *IngestionService) handleDeletePost(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("DELETE", "/api/posts/{id}"))
+	defer timer.ObserveDuration()
+	
+	var req DeletePostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestsTotal.WithLabelValues("DELETE", "/api/posts/{id}", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
 	}
-}
-
-func (s *IngestionService) publishEvent(topic string, key string, event interface{}) error {
-	value, err := json.Marshal(event)
-	if err != nil {
-		eventsPublished.WithLabelValues(topic, "error").Inc()
-		return fmt.Errorf("failed to marshal event: %w", err)
+	if req.UserID == "" {
+		requestsTotal.WithLabelValues("DELETE", "/api/posts/{id}", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, "user_id is required")
+		return
 	}
 	
-	msg := &sarama.ProducerMessage{
-		Topic: topic,
-		Key:   sarama.StringEncoder(key),
-		Value: sarama.StringEncoder(value),
+	event := events.PostDeleted{
+		ID:        mux.Vars(r)["id"],
+		UserID:    req.UserID,
+		Timestamp: time.Now().UTC(),
 	}
 	
-	partition, offset, err := s.producer.SendMessage(msg)
-	if err != nil {
-		eventsPublished.WithLabelValues(topic, "error").Inc()
-		return fmt.Errorf("failed to send message: %w", err)
+	if err := s.requireUser(r.Context(), req.UserID); err != nil {
+		s.respondUserError(w, r.Method, "/api/posts/{id}", err)
+		return
 	}
 	
-	eventsPublished.WithLabelValues(topic, "success").Inc()
-	s.logger.WithFields(logrus.Fields{
-		"topic":     topic,
-		"key":       key,
-		"partition": partition,
-		"offset":    offset,
-	}).Info("Event published successfully")
+	if err := s.publishEvent("posts", req.UserID, events.TypePostDeleted, event, traceID(r)); err != nil {
+		s.respondPublishError(w, r.Method, "/api/posts/{id}", err, "Failed to process post deletion")
+		return
+	}
 	
-	return nil
+	requestsTotal.WithLabelValues("DELETE", "/api/posts/{id}", "202").Inc()
+	s.respondWithJSON(w, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: "Post deletion accepted for processing",
+		Data: map[string]string{
+			"post_id": event.ID,
+		},
+	})
 }
 
-func (s *IngestionService) handleCreatePost(w http.ResponseWriter, r *http.Request) {
-	timer := prometheus.NewTimer(requestDuration.WithLabelValues("POST", "/api/posts"))
+// PUT /api/comments/{id} - Edit a comment
+func (s *IngestionService) handleUpdateComment(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("PUT", "/api/comments/{id}"))
 	defer timer.ObserveDuration()
 	
-	var req CreatePostRequest
+	var req UpdateCommentRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		requestsTotal.WithLabelValues("POST", "/api/posts", "400").Inc()
+		requestsTotal.WithLabelValues("PUT", "/api/comments/{id}", "400").Inc()
 		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 	
-	// Validation
-	if req.UserID == "" || req.Content == "" {
-		requestsTotal.WithLabelValues("POST", "/api/posts", "400").Inc()
-		s.respondWithError(w, http.StatusBadRequest, "user_id and content are required")
+	event, err := newCommentUpdatedEvent(mux.Vars(r)["id"], req)
+	if err != nil {
+		requestsTotal.WithLabelValues("PUT", "/api/comments/{id}", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	
-	if len(req.Content) > 280 {
-		requestsTotal.WithLabelValues("POST", "/api/posts", "400").Inc()
-		s.respondWithError(w, http.StatusBadRequest, "content must be 280 characters or less")
+	if err := s.requireUser(r.Context(), req.UserID); err != nil {
+		s.respondUserError(w, r.Method, "/api/comments/{id}", err)
 		return
 	}
 	
-	// Create event
-	event := PostEvent{
-		ID:        uuid.New().String(),
+	// Keyed by post_id like the create so the edit is applied after it
+	if err := s.publishEvent("comments", req.PostID, events.TypeCommentUpdated, event, traceID(r)); err != nil {
+		s.respondPublishError(w, r.Method, "/api/comments/{id}", err, "Failed to process comment update")
+		return
+	}
+	
+	requestsTotal.WithLabelValues("PUT", "/api/comments/{id}", "202").Inc()
+	s.respondWithJSON(w, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: "Comment update accepted for processing",
+		Data: map[string]string{
+			"comment_id": event.ID,
+		},
+	})
+}
+
+// DELETE /api/comments/{id} - Soft-delete a comment
+func (s *IngestionService) handleDeleteComment(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("DELETE", "/api/comments/{id}"))
+	defer timer.ObserveDuration()
+	
+	var req DeleteCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestsTotal.WithLabelValues("DELETE", "/api/comments/{id}", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.PostID == "" || req.UserID == "" {
+		requestsTotal.WithLabelValues("DELETE", "/api/comments/{id}", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, "post_id and user_id are required")
+		return
+	}
+	
+	event := events.CommentDeleted{
+		ID:        mux.Vars(r)["id"],
+		PostID:    req.PostID,
 		UserID:    req.UserID,
-		Content:   req.Content,
 		Timestamp: time.Now().UTC(),
 	}
 	
-	// Publish to Kafka
-	if err := s.publishEvent("posts", req.UserID, event); err != nil {
-		requestsTotal.WithLabelValues("POST", "/api/posts", "500").Inc()
-		s.logger.WithError(err).Error("Failed to publish post event")
-		s.respondWithError(w, http.StatusInternalServerError, "Failed to process post")
+	if err := s.requireUser(r.Context(), req.UserID); err != nil {
+		s.respondUserError(w, r.Method, "/api/comments/{id}", err)
 		return
 	}
 	
-	requestsTotal.WithLabelValues("POST", "/api/posts", "202").Inc()
+	if err := s.publishEvent("comments", req.PostID, events.TypeCommentDeleted, event, traceID(r)); err != nil {
+		s.respondPublishError(w, r.Method, "/api/comments/{id}", err, "Failed to process comment deletion")
+		return
+	}
+	
+	requestsTotal.WithLabelValues("DELETE", "/api/comments/{id}", "202").Inc()
 	s.respondWithJSON(w, http.StatusAccepted, APIResponse{
 		Success: true,
-		Message: "Post accepted for processing",
+		Message: "Comment deletion accepted for processing",
 		Data: map[string]string{
-			"post_id": event.ID,
+			"comment_id": event.ID,
 		},
 	})
 }
 
-func (s *IngestionService) handleCreateComment(w http.ResponseWriter, r *http.Request) {
-	timer := prometheus.NewTimer(requestDuration.WithLabelValues("POST", "/api/comments"))
+// POST /api/users - Register a user
+func (s *IngestionService) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("POST", "/api/users"))
 	defer timer.ObserveDuration()
 	
-	var req CreateCommentRequest
+	var req CreateUserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		requestsTotal.WithLabelValues("POST", "/api/comments", "400").Inc()
+		requestsTotal.WithLabelValues("POST", "/api/users", "400").Inc()
 		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 	
-	// Validation
-	if req.PostID == "" || req.UserID == "" || req.Content == "" {
-		requestsTotal.WithLabelValues("POST", "/api/comments", "400").Inc()
-		s.respondWithError(w, http.StatusBadRequest, "post_id, user_id and content are required")
+	event, err := newUserCreatedEvent(req)
+	if err != nil {
+		requestsTotal.WithLabelValues("POST", "/api/users", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	
-	if len(req.Content) > 280 {
-		requestsTotal.WithLabelValues("POST", "/api/comments", "400").Inc()
-		s.respondWithError(w, http.StatusBadRequest, "content must be 280 characters or less")
+	if !s.profileAvailable(w, r, "/api/users", event.ID, event.Username, event.Email) {
 		return
 	}
 	
-	// Create event
-	event := CommentEvent{
-		ID:        uuid.New().String(),
-		PostID:    req.PostID,
-		UserID:    req.UserID,
-		Content:   req.Content,
-		Timestamp: time.Now().UTC(),
-	}
-	
-	// Publish to Kafka (key by post_id to ensure ordering per post)
-	if err := s.publishEvent("comments", req.PostID, event); err != nil {
-		requestsTotal.WithLabelValues("POST", "/api/comments", "500").Inc()
-		s.logger.WithError(err).Error("Failed to publish comment event")
-		s.respondWithError(w, http.StatusInternalServerError, "Failed to process comment")
+	// Keyed by user_id so a user's updates are applied after its creation
+	if err := s.publishEvent("users", event.ID, events.TypeUserCreated, event, traceID(r)); err != nil {
+		s.respondPublishError(w, r.Method, "/api/users", err, "Failed to process user")
 		return
 	}
 	
-	requestsTotal.WithLabelValues("POST", "/api/comments", "202").Inc()
+	requestsTotal.WithLabelValues("POST", "/api/users", "202").Inc()
 	s.respondWithJSON(w, http.StatusAccepted, APIResponse{
 		Success: true,
-		Message: "Comment accepted for processing",
+		Message: "User accepted for processing",
 		Data: map[string]string{
-			"comment_id": event.ID,
+			"user_id": event.ID,
 		},
 	})
 }
 
-func (s *IngestionService) handleLike(w http.ResponseWriter, r *http.Request) {
-	timer := prometheus.NewTimer(requestDuration.WithLabelValues("POST", "/api/likes"))
+// PUT /api/users/{id} - Change a user's username or email
+func (s *IngestionService) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("PUT", "/api/users/{id}"))
 	defer timer.ObserveDuration()
 	
-	var req LikeRequest
+	var req UpdateUserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		requestsTotal.WithLabelValues("POST", "/api/likes", "400").Inc()
+		requestsTotal.WithLabelValues("PUT", "/api/users/{id}", "400").Inc()
 		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 	
-	// Validation
-	if req.PostID == "" || req.UserID == "" {
-		requestsTotal.WithLabelValues("POST", "/api/likes", "400").Inc()
-		s.respondWithError(w, http.StatusBadRequest, "post_id and user_id are required")
+	event, err := newUserUpdatedEvent(mux.Vars(r)["id"], req)
+	if err != nil {
+		requestsTotal.WithLabelValues("PUT", "/api/users/{id}", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	
-	if req.Action != "like" && req.Action != "unlike" {
-		requestsTotal.WithLabelValues("POST", "/api/likes", "400").Inc()
-		s.respondWithError(w, http.StatusBadRequest, "action must be 'like' or 'unlike'")
+	if err := s.requireUser(r.Context(), event.ID); err != nil {
+		s.respondUserError(w, r.Method, "/api/users/{id}", err)
 		return
 	}
-	
-	// Create event
-	event := LikeEvent{
-		ID:        uuid.New().String(),
-		PostID:    req.PostID,
-		UserID:    req.UserID,
-		Action:    req.Action,
-		Timestamp: time.Now().UTC(),
+	if !s.profileAvailable(w, r, "/api/users/{id}", event.ID, event.Username, event.Email) {
+		return
 	}
 	
-	// Publish to Kafka (key by post_id to ensure ordering per post)
-	if err := s.publishEvent("likes", req.PostID, event); err != nil {
-		requestsTotal.WithLabelValues("POST", "/api/likes", "500").Inc()
-		s.logger.WithError(err).Error("Failed to publish like event")
-		s.respondWithError(w, http.StatusInternalServerError, "Failed to process like")
+	if err := s.publishEvent("users", event.ID, events.TypeUserUpdated, event, traceID(r)); err != nil {
+		s.respondPublishError(w, r.Method, "/api/users/{id}", err, "Failed to process user update")
 		return
 	}
 	
-	requestsTotal.WithLabelValues("POST", "/api/likes", "202").Inc()
+	requestsTotal.WithLabelValues("PUT", "/api/users/{id}", "202").Inc()
 	s.respondWithJSON(w, http.StatusAccepted, APIResponse{
 		Success: true,
-		Message: fmt.Sprintf("%s accepted for processing", strings.Title(req.Action)),
+		Message: "User update accepted for processing",
 		Data: map[string]string{
-			"like_id": event.ID,
+			"user_id": event.ID,
 		},
 	})
 }
 
+// profileAvailable answers 409 when the user directory already gives the
+// username or email to another user. Unless REQUIRE_KNOWN_USERS is set the
+// consumer is the only check, and a taken profile ends up on users.dlq.
+func (s *IngestionService) profileAvailable(w http.ResponseWriter, r *http.Request, endpoint, userID, username, email string) bool {
+	if !s.requireKnownUsers {
+		return true
+	}
+	
+	taken, err := s.directory.UserTaken(r.Context(), userID, username, email)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to check username and email")
+		requestsTotal.WithLabelValues(r.Method, endpoint, "503").Inc()
+		s.respondWithError(w, http.StatusServiceUnavailable, "Failed to check username and email")
+		return false
+	}
+	if taken {
+		requestsTotal.WithLabelValues(r.Method, endpoint, "409").Inc()
+		s.respondWithError(w, http.StatusConflict, directory.ErrUserTaken.Error())
+		return false
+	}
+	return true
+}
+
+// POST /api/batch - Publish a mix of posts, comments and likes in one request
+func (s *IngestionService) handleBatch(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(requestDuration.WithLabelValues("POST", "/api/batch"))
+	defer timer.ObserveDuration()
+	
+	r.Body = http.MaxBytesReader(w, r.Body, s.batchMaxBytes)
+	items, err := readBatch(r)
+	if errors.Is(err, errBatchTooLarge) {
+		requestsTotal.WithLabelValues("POST", "/api/batch", "413").Inc()
+		s.respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("batch must be %d bytes or less", s.batchMaxBytes))
+		return
+	}
+	if err != nil {
+		requestsTotal.WithLabelValues("POST", "/api/batch", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	if len(items) == 0 {
+		requestsTotal.WithLabelValues("POST", "/api/batch", "400").Inc()
+		s.respondWithError(w, http.StatusBadRequest, "batch is empty")
+		return
+	}
+	
+	if len(items) > s.batchMaxItems {
+		requestsTotal.WithLabelValues("POST", "/api/batch", "413").Inc()
+		s.respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("batch must have %d items or less", s.batchMaxItems))
+		return
+	}
+	
+	// A retry of a partial batch with the same Idempotency-Key keeps the
+	// results of the items that did not fail
+	earlier := earlierBatchResults(r, len(items))
+	
+	// Validate every item and group the valid ones by partition key
+	results := make([]BatchResult, len(items))
+	groups := make(map[string][]batchEvent)
+	var order []string
+	for i, data := range items {
+		results[i].Index = i
+		if earlier != nil && earlier[i].Status != "failed" {
+			results[i] = earlier[i]
+			continue
+		}
+		
+		event, err := newBatchEvent(data)
+		results[i].Type = event.itemType
+		if err != nil {
+			results[i].Status = "invalid"
+			results[i].Error = err.Error()
+			batchItems.WithLabelValues(event.itemType, "invalid").Inc()
+			continue
+		}
+		
+		if err := s.requireUser(r.Context(), event.userID); err != nil {
+			if errors.Is(err, errUnknownUser) {
+				results[i].Status = "invalid"
+				results[i].Error = err.Error()
+			} else {
+				s.logger.WithError(err).WithField("index", i).Error("Failed to look up user")
+				results[i].Status = "failed"
+				results[i].Error = "failed to check user"
+			}
+			batchItems.WithLabelValues(event.itemType, results[i].Status).Inc()
+			continue
+		}
+		
+		// A reply cannot answer a comment from the same batch, which is not
+		// consumed yet
+		if err := s.requireParent(r.Context(), event.key, event.parentID); err != nil {
+			if errors.Is(err, errInvalidReply) {
+				results[i].Status = "invalid"
+				results[i].Error = err.Error()
+			} else {
+				s.logger.WithError(err).WithField("index", i).Error("Failed to look up parent comment")
+				results[i].Status = "failed"
+				results[i].Error = "failed to check parent comment"
+			}
+			batchItems.WithLabelValues(event.itemType, results[i].Status).Inc()
+			continue
+		}
+		
+		event.index = i
+		results[i].ID = event.id
+		group := event.topic + "/" + event.key
+		if _, ok := groups[group]; !ok {
+			order = append(order, group)
+		}
+		groups[group] = append(groups[group], event)
+	}
+	
+	// Publish groups concurrently so the producer can batch them, but each
+	// group in request order so per-key ordering is kept
+	trace := traceID(r)
+	sem := make(chan struct{}, s.batchConcurrency)
+	var wg sync.WaitGroup
+	var busy atomic.Bool
+	for _, group := range order {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(pending []batchEvent) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			
+			var failed error
+			for _, event := range pending {
+				result := &results[event.index]
+				if failed == nil {
+					failed = s.publishEvent(event.topic, event.key, event.eventType, event.event, trace)
+					if errors.Is(failed, errProducerBusy) {
+						busy.Store(true)
+						result.Error = "too many pending events, retry later"
+					} else if failed != nil {
+						s.logger.WithError(failed).WithField("index", event.index).Error("Failed to publish batch item")
+						result.Error = "failed to publish"
+					}
+				} else {
+					// Publishing later events would reorder them past the failed one
+					result.Error = "not published after an earlier failure for the same key"
+				}
+				
+				if result.Error != "" {
+					result.Status = "failed"
+					result.ID = ""
+				} else {
+					result.Status = "accepted"
+				}
+				batchItems.WithLabelValues(event.itemType, result.Status).Inc()
+			}
+		}(groups[group])
+	}
+	wg.Wait()
+	
+	accepted := 0
+	for _, result := range results {
+		if result.Status == "accepted" {
+			accepted++
+		}
+	}
+	
+	status := http.StatusAccepted
+	if accepted < len(results) {
+		status = http.StatusMultiStatus
+	}
+	if busy.Load() {
+		w.Header().Set("Retry-After", s.retryAfterSeconds())
+	}
+	
+	requestsTotal.WithLabelValues("POST", "/api/batch", strconv.Itoa(status)).Inc()
+	s.respondWithJSON(w, status, APIResponse{
+		Success: accepted == len(results),
+		Message: fmt.Sprintf("%d of %d items accepted for processing", accepted, len(results)),
+		Data:    results,
+	})
+}
+
+// batchEvent is a validated batch item ready to publish
+type batchEvent struct {
+	index     int
+	itemType  string
+	topic     string
+	eventType string
+	key       string
+	id        string
+	userID    string
+	parentID  string
+	event     interface{}
+}
+
+// newBatchEvent validates one batch item with the same rules as the single
+// endpoints and builds its event
+func newBatchEvent(data json.RawMessage) (batchEvent, error) {
+	var item BatchItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return batchEvent{}, errors.New("invalid item")
+	}
+	
+	switch item.Type {
+	case "post":
+		event, err := newPostEvent(CreatePostRequest{UserID: item.UserID, Content: item.Content})
+		return batchEvent{itemType: item.Type, topic: "posts", eventType: events.TypePostCreated, key: event.UserID, id: event.ID, userID: event.UserID, event: event}, err
+	case "comment":
+		event, err := newCommentEvent(CreateCommentRequest{PostID: item.PostID, UserID: item.UserID, Content: item.Content, ParentCommentID: item.ParentCommentID})
+		return batchEvent{itemType: item.Type, topic: "comments", eventType: events.TypeCommentCreated, key: event.PostID, id: event.ID, userID: event.UserID, parentID: event.ParentCommentID, event: event}, err
+	case "like":
+		action := item.Action
+		if action == "" {
+			action = "like"
+		}
+		event, err := newLikeEvent(LikeRequest{PostID: item.PostID, UserID: item.UserID, Action: action, Reaction: item.Reaction})
+		return batchEvent{itemType: item.Type, topic: "likes", eventType: events.TypeLikeChanged, key: event.PostID, id: event.ID, userID: event.UserID, event: event}, err
+	default:
+		return batchEvent{itemType: item.Type}, errors.New("type must be 'post', 'comment' or 'like'")
+	}
+}
+
+// traceID returns the caller's X-Trace-ID, or a new ID to correlate the events
+// of this request in consumer logs
+func traceID(r *http.Request) string {
+	if id := r.Header.Get("X-Trace-ID"); id != "" && len(id) <= 128 {
+		return id
+	}
+	return uuid.New().String()
+}
+
+var errBatchTooLarge = errors.New("batch body too large")
+
+// batchReadError reports a body that could not be read, telling an oversized
+// body apart from a malformed one
+func batchReadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errBatchTooLarge
+	}
+	return errors.New("invalid request body")
+}
+
+// readBatch splits a batch body into its items. The body is either a JSON
+// array or NDJSON (one item per line, Content-Type application/x-ndjson).
+func readBatch(r *http.Request) ([]json.RawMessage, error) {
+	reader := bufio.NewReader(r.Body)
+	
+	// Skip leading whitespace to tell an array from NDJSON
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, batchReadError(err)
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		reader.ReadByte()
+	}
+	
+	if b, _ := reader.Peek(1); b[0] == '[' && !strings.Contains(r.Header.Get("Content-Type"), "ndjson") {
+		var items []json.RawMessage
+		if err := json.NewDecoder(reader).Decode(&items); err != nil {
+			return nil, batchReadError(err)
+		}
+		return items, nil
+	}
+	
+	var items []json.RawMessage
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, json.RawMessage(append([]byte(nil), line...)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, batchReadError(err)
+	}
+	return items, nil
+}
+
+// Maximum length of an Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// idempotent lets clients retry a write safely. A request that repeats the
+// Idempotency-Key of an earlier one within IDEMPOTENCY_WINDOW gets the
+// original response (and so the original event ID) without publishing again.
+// A partial batch is not replayed: the retry publishes the items that failed
+// and keeps the results of the others.
+func (s *IngestionService) idempotent(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		
+		if len(key) > maxIdempotencyKeyLength {
+			requestsTotal.WithLabelValues(r.Method, endpoint, "400").Inc()
+			s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be %d characters or less", maxIdempotencyKeyLength))
+			return
+		}
+		
+		// The fingerprint ties the key to this exact request
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			requestsTotal.WithLabelValues(r.Method, endpoint, "400").Inc()
+			s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+		
+		record, err := s.idempotency.Reserve(r.Context(), key, fingerprint)
+		switch {
+		case errors.Is(err, idempotency.ErrInProgress):
+			idempotentRequests.WithLabelValues(endpoint, "in_progress").Inc()
+			requestsTotal.WithLabelValues(r.Method, endpoint, "409").Inc()
+			s.respondWithError(w, http.StatusConflict, err.Error())
+			return
+		case errors.Is(err, idempotency.ErrMismatch):
+			idempotentRequests.WithLabelValues(endpoint, "mismatch").Inc()
+			requestsTotal.WithLabelValues(r.Method, endpoint, "422").Inc()
+			s.respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		case err != nil:
+			requestsTotal.WithLabelValues(r.Method, endpoint, "500").Inc()
+			s.logger.WithError(err).Error("Failed to reserve idempotency key")
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to process idempotency key")
+			return
+		case record != nil && !record.Partial:
+			idempotentRequests.WithLabelValues(endpoint, "replayed").Inc()
+			requestsTotal.WithLabelValues(r.Method, endpoint, strconv.Itoa(record.Status)).Inc()
+			w.Header().Set("Content-Type", record.ContentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.Status)
+			w.Write(record.Body)
+			return
+		}
+		
+		result := "new"
+		if record != nil {
+			result = "resumed"
+			r = r.WithContext(context.WithValue(r.Context(), earlierResponseKey{}, record))
+		}
+		idempotentRequests.WithLabelValues(endpoint, result).Inc()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			// Free the key if the handler failed so the client can retry
+			if !completed {
+				if err := s.idempotency.Release(context.Background(), key); err != nil {
+					s.logger.WithError(err).Error("Failed to release idempotency key")
+				}
+			}
+		}()
+		
+		next(recorder, r)
+		
+		// Server errors are not remembered: the retry should try again
+		if recorder.status >= http.StatusInternalServerError {
+			return
+		}
+		
+		err = s.idempotency.Complete(context.Background(), key, idempotency.Record{
+			Status:      recorder.status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+			CreatedAt:   time.Now().UTC(),
+			Partial:     recorder.status == http.StatusMultiStatus,
+		})
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to store idempotent response")
+			return
+		}
+		completed = true
+	}
+}
+
+// earlierResponseKey carries the partial response that a retry finishes
+type earlierResponseKey struct{}
+
+// earlierBatchResults returns the item results of the partial batch response
+// a retry finishes, or nil on a first attempt
+func earlierBatchResults(r *http.Request, count int) []BatchResult {
+	record, ok := r.Context().Value(earlierResponseKey{}).(*idempotency.Record)
+	if !ok {
+		return nil
+	}
+	
+	var response struct {
+		Data []BatchResult `json:"data"`
+	}
+	if err := json.Unmarshal(record.Body, &response); err != nil || len(response.Data) != count {
+		return nil
+	}
+	return response.Data
+}
+
+// responseRecorder copies a response so it can be replayed
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
 func (s *IngestionService) handleHealth(w http.ResponseWriter, r *http.Request) {
 	s.respondWithJSON(w, http.StatusOK, APIResponse{
 		Success: true,
 		Message: "Ingestion service is healthy",
 		Data: map[string]interface{}{
-			"timestamp": time.Now().UTC(),
-			"service":   "ingestion",
-			"version":   "1.0.0",
+			"timestamp":   time.Now().UTC(),
+			"service":     "ingestion",
+			"version":     "1.0.0",
+			"spool_depth": s.spoolDepth(),
 		},
 	})
 }
 
+func (s *IngestionService) spoolDepth() int {
+	if s.spool == nil {
+		return 0
+	}
+	return s.spool.Depth()
+}
+
 func (s *IngestionService) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	response, _ := json.Marshal(payload)
 	w.Header().Set("Content-Type", "application/json")
@@ -358,9 +1877,17 @@ func (s *IngestionService) setupRoutes() *mux.Router {
 	
 	// API routes
 	api := r.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/posts", s.handleCreatePost).Methods("POST")
-	api.HandleFunc("/comments", s.handleCreateComment).Methods("POST")
-	api.HandleFunc("/likes", s.handleLike).Methods("POST")
+	api.HandleFunc("/posts", s.idempotent("/api/posts", s.handleCreatePost)).Methods("POST")
+	api.HandleFunc("/posts/{id}", s.idempotent("/api/posts/{id}", s.handleUpdatePost)).Methods("PUT")
+	api.HandleFunc("/posts/{id}", s.idempotent("/api/posts/{id}", s.handleDeletePost)).Methods("DELETE")
+	api.HandleFunc("/comments", s.idempotent("/api/comments", s.handleCreateComment)).Methods("POST")
+	api.HandleFunc("/comments/{id}", s.idempotent("/api/comments/{id}", s.handleUpdateComment)).Methods("PUT")
+	api.HandleFunc("/comments/{id}", s.idempotent("/api/comments/{id}", s.handleDeleteComment)).Methods("DELETE")
+	api.HandleFunc("/likes", s.idempotent("/api/likes", s.handleLike)).Methods("POST")
+	api.HandleFunc("/follows", s.idempotent("/api/follows", s.handleFollow)).Methods("POST")
+	api.HandleFunc("/users", s.idempotent("/api/users", s.handleCreateUser)).Methods("POST")
+	api.HandleFunc("/users/{id}", s.idempotent("/api/users/{id}", s.handleUpdateUser)).Methods("PUT")
+	api.HandleFunc("/batch", s.idempotent("/api/batch", s.handleBatch)).Methods("POST")
 	
 	// Health and metrics
 	r.HandleFunc("/health", s.handleHealth).Methods("GET")
@@ -376,6 +1903,20 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
 func main() {
 	service, err := NewIngestionService()
 	if err != nil {
@@ -385,11 +1926,23 @@ func main() {
 	
 	router := service.setupRoutes()
 	
+	// Publish spooled events once Kafka is reachable again
+	drainCtx, stopDrain := context.WithCancel(context.Background())
+	defer stopDrain()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		if service.spool != nil {
+			service.drainSpool(drainCtx)
+		}
+	}()
+	
 	// CORS middleware
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"}, // In production, specify actual origins
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders: []string{"*"},
+		ExposedHeaders: []string{"Idempotent-Replayed"},
 	})
 	
 	handler := c.Handler(router)
@@ -421,6 +1974,8 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		service.logger.WithError(err).Fatal("Server forced to shutdown")
 	}
+	stopDrain()
+	<-drained
 	
 	service.logger.Info("Ingestion service stopped")
 }
\ No newline at end of file
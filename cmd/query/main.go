@@ -1,56 +1,88 @@
 package main
 
 import (
+	"container/heap"
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"hash/fnv"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
+
+	"social-media-db/internal/directory"
+	"social-media-db/internal/feed"
+	"social-media-db/internal/shard"
+	"social-media-db/internal/stats"
 )
 
 // Data types
-type Post struct {
+type User struct {
 	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Content   string    `json:"content"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
-type Comment struct {
+type Post struct {
 	ID        string    `json:"id"`
-	PostID    string    `json:"post_id"`
 	UserID    string    `json:"user_id"`
 	Content   string    `json:"content"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+type Comment struct {
+	ID              string    `json:"id"`
+	PostID          string    `json:"post_id"`
+	UserID          string    `json:"user_id"`
+	Content         string    `json:"content"`
+	ParentCommentID string    `json:"parent_comment_id,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// CommentNode is a comment in a thread with a page of its replies. Deleted
+// comments are kept, without author or content, while they have replies.
+type CommentNode struct {
+	Comment
+	Deleted    bool           `json:"deleted,omitempty"`
+	ReplyCount int            `json:"reply_count"`
+	Replies    []*CommentNode `json:"replies,omitempty"`
+	NextCursor string         `json:"next_cursor,omitempty"` // more replies, with parent_id set to this comment
+}
+
 type Like struct {
 	ID        string    `json:"id"`
 	PostID    string    `json:"post_id"`
 	UserID    string    `json:"user_id"`
+	Reaction  string    `json:"reaction"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// PostWithStats is a post with its counts. LikeCount counts every reaction;
+// Reactions breaks it down by type.
 type PostWithStats struct {
 	Post
-	CommentCount int `json:"comment_count"`
-	LikeCount    int `json:"like_count"`
+	CommentCount int            `json:"comment_count"`
+	LikeCount    int            `json:"like_count"`
+	Reactions    map[string]int `json:"reactions"`
 }
 
 type UserStats struct {
@@ -67,17 +99,13 @@ type APIResponse struct {
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
 	Count   *int        `json:"count,omitempty"`
-}
-
-// Shard configuration
-type ShardConfig struct {
-	ID               uint32
-	Host             string
-	Port             int
-	Database         string
-	Username         string
-	Password         string
-	ConnectionString string
+	
+	// Opaque token for the next page; empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+	
+	// Set when some shards of a cross-shard query failed or timed out
+	Partial      bool     `json:"partial,omitempty"`
+	FailedShards []uint32 `json:"failed_shards,omitempty"`
 }
 
 // Metrics
@@ -105,18 +133,40 @@ var (
 		},
 		[]string{"shard", "status"},
 	)
+	
+	partialResponses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "partial_responses_total",
+			Help: "Total number of responses missing data from failed shards",
+		},
+		[]string{"endpoint"},
+	)
+	
+	directoryLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "post_directory_lookups_total",
+			Help: "Total number of post directory lookups",
+		},
+		[]string{"result"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(queriesTotal)
 	prometheus.MustRegister(queryDuration)
 	prometheus.MustRegister(shardQueries)
+	prometheus.MustRegister(partialResponses)
+	prometheus.MustRegister(directoryLookups)
 }
 
 type QueryService struct {
-	shards   []ShardConfig
-	dbPool   map[uint32]*sql.DB
-	logger   *logrus.Logger
+	router            *shard.Watcher
+	directory         *directory.Directory
+	directoryFallback bool
+	placements        shard.Placements
+	feed              feed.Config
+	shardTimeout      time.Duration
+	logger            *logrus.Logger
 }
 
 func NewQueryService() (*QueryService, error) {
@@ -128,105 +178,99 @@ func NewQueryService() (*QueryService, error) {
 		logger.Warn("No .env file found")
 	}
 	
-	// Load shard configuration
-	shards, err := loadShardConfig(logger)
+	// Load shard configuration and connect to every shard
+	router, err := shard.NewWatcher(logger)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load shard config: %w", err)
+		return nil, err
 	}
 	
-	// Initialize database connections
-	dbPool, err := initDBConnections(shards, logger)
+	placements, err := shard.LoadPlacements()
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize DB connections: %w", err)
+		router.Close()
+		return nil, err
+	}
+	
+	feedConfig, err := feed.LoadConfig()
+	if err != nil {
+		router.Close()
+		return nil, err
 	}
 	
 	return &QueryService{
-		shards: shards,
-		dbPool: dbPool,
-		logger: logger,
+		router:            router,
+		directory:         directory.New(router.Master()),
+		directoryFallback: getEnv("POST_DIRECTORY_FALLBACK", "true") == "true",
+		placements:        placements,
+		feed:              feedConfig,
+		shardTimeout:      getEnvDuration("SHARD_QUERY_TIMEOUT", 2*time.Second),
+		logger:            logger,
 	}, nil
 }
 
-func loadShardConfig(logger *logrus.Logger) ([]ShardConfig, error) {
-	// Connect to master database to get shard configuration
-	masterDB, err := sql.Open("postgres", fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		getEnv("PG_MASTER_HOST", "localhost"),
-		getEnv("PG_MASTER_PORT", "5440"),
-		getEnv("PG_MASTER_USER", "postgres"),
-		getEnv("PG_MASTER_PASS", "Genius171317@"),
-		getEnv("PG_MASTER_DB", "master"),
-	))
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to master DB: %w", err)
+func (q *QueryService) Close() {
+	q.router.Close()
+}
+
+// dbPool returns the connection pool of every shard keyed by shard ID
+func (q *QueryService) dbPool() map[uint32]*sql.DB {
+	router := q.router.Current()
+	pools := make(map[uint32]*sql.DB)
+	for _, config := range router.All() {
+		pools[config.ID] = router.DB(config.ID)
 	}
-	defer masterDB.Close()
+	return pools
+}
+
+// GET /api/users/{user_id} - Get a user's profile
+func (q *QueryService) getUser(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(queryDuration.WithLabelValues("GET", "/api/users/{user_id}"))
+	defer timer.ObserveDuration()
 	
-	rows, err := masterDB.Query("SELECT shard_id, host, port, db_name, username, password FROM shards ORDER BY shard_id")
-	if err != nil {
-		return nil, fmt.Errorf("failed to query shards: %w", err)
-	}
-	defer rows.Close()
+	userID := mux.Vars(r)["user_id"]
 	
-	var shards []ShardConfig
-	for rows.Next() {
-		var shard ShardConfig
-		err := rows.Scan(&shard.ID, &shard.Host, &shard.Port, &shard.Database, &shard.Username, &shard.Password)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan shard row: %w", err)
-		}
-		
-		shard.ConnectionString = fmt.Sprintf(
-			"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-			shard.Host, shard.Port, shard.Username, shard.Password, shard.Database,
-		)
-		
-		shards = append(shards, shard)
-		logger.WithFields(logrus.Fields{
-			"shard_id": shard.ID,
-			"host":     shard.Host,
-			"port":     shard.Port,
-		}).Info("Loaded shard configuration")
+	// users.id is a UUID column, so anything else cannot match
+	if _, err := uuid.Parse(userID); err != nil {
+		queriesTotal.WithLabelValues("GET", "/api/users/{user_id}", "404").Inc()
+		q.respondWithError(w, http.StatusNotFound, "User not found")
+		return
 	}
 	
-	return shards, nil
-}
-
-func initDBConnections(shards []ShardConfig, logger *logrus.Logger) (map[uint32]*sql.DB, error) {
-	dbPool := make(map[uint32]*sql.DB)
+	// Users are stored on the shard of their own ID
+	router := q.router.Current()
+	shardIDs := []uint32{router.ShardFor(userID)}
 	
-	for _, shard := range shards {
-		db, err := sql.Open("postgres", shard.ConnectionString)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open connection to shard %d: %w", shard.ID, err)
-		}
+	var user *User
+	errs := q.scatter(r.Context(), router, shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+		query := `SELECT id, username, email, created_at, updated_at FROM users WHERE id = $1`
 		
-		if err := db.Ping(); err != nil {
-			return nil, fmt.Errorf("failed to ping shard %d: %w", shard.ID, err)
+		var u User
+		err := db.QueryRowContext(ctx, query, userID).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt, &u.UpdatedAt)
+		if err == sql.ErrNoRows {
+			return nil
 		}
-		
-		db.SetMaxOpenConns(10)
-		db.SetMaxIdleConns(5)
-		db.SetConnMaxLifetime(time.Hour)
-		
-		dbPool[shard.ID] = db
-		logger.WithField("shard_id", shard.ID).Info("Connected to database shard")
+		if err != nil {
+			return err
+		}
+		user = &u
+		return nil
+	})
+	if errs[0] != nil {
+		q.respondUnavailable(w, "GET", "/api/users/{user_id}", shardIDs)
+		return
 	}
 	
-	return dbPool, nil
-}
-
-func (q *QueryService) Close() {
-	for _, db := range q.dbPool {
-		db.Close()
+	if user == nil {
+		queriesTotal.WithLabelValues("GET", "/api/users/{user_id}", "404").Inc()
+		q.respondWithError(w, http.StatusNotFound, "User not found")
+		return
 	}
-}
-
-// Hash function to determine shard
-func (q *QueryService) getShardID(userID string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(userID))
-	return h.Sum32() % uint32(len(q.shards))
+	
+	queriesTotal.WithLabelValues("GET", "/api/users/{user_id}", "200").Inc()
+	q.respondWithJSON(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "User retrieved successfully",
+		Data:    user,
+	})
 }
 
 // GET /api/users/{user_id}/posts - Get posts by user
@@ -243,7 +287,7 @@ func (q *QueryService) getUserPosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// Get limit and offset from query parameters
+	// Get limit, offset and cursor from query parameters
 	limitStr := r.URL.Query().Get("limit")
 	offsetStr := r.URL.Query().Get("offset")
 	
@@ -261,50 +305,77 @@ func (q *QueryService) getUserPosts(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	
-	// Determine which shard contains this user's data
-	shardID := q.getShardID(userID)
-	db := q.dbPool[shardID]
-	
-	query := `SELECT id, user_id, content, created_at, updated_at 
-			  FROM posts 
-			  WHERE user_id = $1 
-			  ORDER BY created_at DESC 
-			  LIMIT $2 OFFSET $3`
-	
-	rows, err := db.Query(query, userID, limit, offset)
+	// A cursor replaces the offset: it resumes right after the last post returned
+	cursor, err := decodeCursor(r.URL.Query().Get("cursor"))
 	if err != nil {
-		queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/posts", "500").Inc()
-		shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "error").Inc()
-		q.logger.WithError(err).Error("Failed to query user posts")
-		q.respondWithError(w, http.StatusInternalServerError, "Failed to retrieve posts")
+		queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/posts", "400").Inc()
+		q.respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer rows.Close()
+	var after *cursorPosition
+	if cursor != nil {
+		after = &cursor.Last
+		offset = 0
+	}
+	
+	// Posts are stored on the shard of their author
+	router := q.router.Current()
+	shardIDs := []uint32{router.ShardFor(userID)}
 	
 	var posts []Post
-	for rows.Next() {
-		var post Post
-		err := rows.Scan(&post.ID, &post.UserID, &post.Content, &post.CreatedAt, &post.UpdatedAt)
+	errs := q.scatter(r.Context(), router, shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+		// Fetch one extra row to know whether there is a next page
+		condition, args := postsAfter(after, 2)
+		query := fmt.Sprintf(`SELECT id, user_id, content, created_at, updated_at 
+				  FROM posts 
+				  WHERE user_id = $1 AND deleted_at IS NULL AND %s 
+				  ORDER BY created_at DESC, id DESC 
+				  LIMIT %d OFFSET %d`, condition, limit+1, offset)
+		
+		rows, err := db.QueryContext(ctx, query, append([]interface{}{userID}, args...)...)
 		if err != nil {
-			q.logger.WithError(err).Error("Failed to scan post row")
-			continue
+			return err
 		}
-		posts = append(posts, post)
+		defer rows.Close()
+		
+		for rows.Next() {
+			var post Post
+			if err := rows.Scan(&post.ID, &post.UserID, &post.Content, &post.CreatedAt, &post.UpdatedAt); err != nil {
+				return err
+			}
+			posts = append(posts, post)
+		}
+		return rows.Err()
+	})
+	if errs[0] != nil {
+		q.respondUnavailable(w, "GET", "/api/users/{user_id}/posts", shardIDs)
+		return
+	}
+	
+	var nextCursor string
+	if len(posts) > limit {
+		posts = posts[:limit]
+		last := posts[len(posts)-1]
+		nextCursor = encodeCursor(pageCursor{Last: cursorPosition{CreatedAt: last.CreatedAt, ID: last.ID}})
 	}
 	
-	shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "success").Inc()
 	queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/posts", "200").Inc()
 	
 	count := len(posts)
 	q.respondWithJSON(w, http.StatusOK, APIResponse{
-		Success: true,
-		Message: fmt.Sprintf("Retrieved %d posts for user %s", count, userID),
-		Data:    posts,
-		Count:   &count,
+		Success:    true,
+		Message:    fmt.Sprintf("Retrieved %d posts for user %s", count, userID),
+		Data:       posts,
+		Count:      &count,
+		NextCursor: nextCursor,
 	})
 }
 
 // GET /api/posts/{post_id} - Get post by ID with comments and likes
+//
+// Only a preview of the comments (the oldest) and likes (the newest) is
+// returned, `preview` of each; the counters in stats give the totals and
+// /api/posts/{post_id}/comments pages through every comment.
 func (q *QueryService) getPost(w http.ResponseWriter, r *http.Request) {
 	timer := prometheus.NewTimer(queryDuration.WithLabelValues("GET", "/api/posts/{post_id}"))
 	defer timer.ObserveDuration()
@@ -318,245 +389,1451 @@ func (q *QueryService) getPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	var post *Post
+	preview := intParam(r, "preview", 10, 0, 100)
 	
-	for _, db := range q.dbPool {
-		query := `SELECT id, user_id, content, created_at, updated_at FROM posts WHERE id = $1`
-		row := db.QueryRow(query, postID)
-		
-		var p Post
-		err := row.Scan(&p.ID, &p.UserID, &p.Content, &p.CreatedAt, &p.UpdatedAt)
-		if err == nil {
-			post = &p
-			break
-		}
+	requireAll, err := requireAllShards(r)
+	if err != nil {
+		queriesTotal.WithLabelValues("GET", "/api/posts/{post_id}", "400").Inc()
+		q.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 	
+	// Resolve the shards holding the post from one shard map snapshot
+	router := q.router.Current()
+	location := q.locatePost(r.Context(), router, postID)
+	failures := make(shardFailures)
+	
+	post, postShard, errs := q.findPost(r.Context(), router, location.postShards, postID)
+	failures.add(location.postShards, errs)
+	
 	if post == nil {
+		// A shard that did not answer may hold the post
+		if len(failures) > 0 {
+			q.respondUnavailable(w, "GET", "/api/posts/{post_id}", failures.IDs())
+			return
+		}
 		queriesTotal.WithLabelValues("GET", "/api/posts/{post_id}", "404").Inc()
 		q.respondWithError(w, http.StatusNotFound, "Post not found")
 		return
 	}
 	
-	// Get comments for this post 
-	var comments []Comment
-	for shardID, db := range q.dbPool {
-		query := `SELECT id, post_id, user_id, content, created_at, updated_at 
-				  FROM comments WHERE post_id = $1 ORDER BY created_at ASC`
-		rows, err := db.Query(query, postID)
+	// Counters are kept next to the post by the consumer
+	var counts stats.Counts
+	errs = q.scatter(r.Context(), router, []uint32{postShard}, func(ctx context.Context, i int, db *sql.DB) error {
+		var err error
+		counts, err = stats.Read(ctx, db, postID)
+		return err
+	})
+	failures.add([]uint32{postShard}, errs)
+	
+	// Get the first comments of this post; each shard returns at most a preview
+	commentResults := make([][]Comment, len(location.commentShards))
+	errs = q.scatter(r.Context(), router, location.commentShards, func(ctx context.Context, i int, db *sql.DB) error {
+		query := `SELECT id, post_id, user_id, content, COALESCE(parent_comment_id, ''), created_at, updated_at 
+				  FROM comments WHERE post_id = $1 AND deleted_at IS NULL 
+				  ORDER BY created_at, id 
+				  LIMIT $2`
+		rows, err := db.QueryContext(ctx, query, postID, preview)
 		if err != nil {
-			shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "error").Inc()
-			continue
+			return err
 		}
+		defer rows.Close()
 		
 		for rows.Next() {
 			var comment Comment
-			err := rows.Scan(&comment.ID, &comment.PostID, &comment.UserID, &comment.Content, &comment.CreatedAt, &comment.UpdatedAt)
-			if err == nil {
-				comments = append(comments, comment)
+			if err := rows.Scan(&comment.ID, &comment.PostID, &comment.UserID, &comment.Content, &comment.ParentCommentID, &comment.CreatedAt, &comment.UpdatedAt); err != nil {
+				return err
 			}
+			commentResults[i] = append(commentResults[i], comment)
 		}
-		rows.Close()
-		shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "success").Inc()
-	}
-	
-	// Get likes for this post 
-	var likes []Like
-	for shardID, db := range q.dbPool {
-		query := `SELECT id, post_id, user_id, created_at FROM likes WHERE post_id = $1`
-		rows, err := db.Query(query, postID)
+		return rows.Err()
+	})
+	failures.add(location.commentShards, errs)
+	
+	// Get the latest likes of this post, a preview from each shard
+	likeResults := make([][]Like, len(location.likeShards))
+	errs = q.scatter(r.Context(), router, location.likeShards, func(ctx context.Context, i int, db *sql.DB) error {
+		query := `SELECT id, post_id, user_id, reaction, created_at FROM likes WHERE post_id = $1 
+				  ORDER BY created_at DESC, id DESC 
+				  LIMIT $2`
+		rows, err := db.QueryContext(ctx, query, postID, preview)
 		if err != nil {
-			shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "error").Inc()
-			continue
+			return err
 		}
+		defer rows.Close()
 		
 		for rows.Next() {
 			var like Like
-			err := rows.Scan(&like.ID, &like.PostID, &like.UserID, &like.CreatedAt)
-			if err == nil {
-				likes = append(likes, like)
+			if err := rows.Scan(&like.ID, &like.PostID, &like.UserID, &like.Reaction, &like.CreatedAt); err != nil {
+				return err
 			}
+			likeResults[i] = append(likeResults[i], like)
+		}
+		return rows.Err()
+	})
+	failures.add(location.likeShards, errs)
+	
+	if requireAll && len(failures) > 0 {
+		q.respondUnavailable(w, "GET", "/api/posts/{post_id}", failures.IDs())
+		return
+	}
+	
+	var comments []Comment
+	for _, result := range commentResults {
+		comments = append(comments, result...)
+	}
+	var likes []Like
+	for _, result := range likeResults {
+		likes = append(likes, result...)
+	}
+	
+	// Results from several shards arrive grouped by shard; merge them and keep
+	// the preview
+	sort.Slice(comments, func(i, j int) bool {
+		if !comments[i].CreatedAt.Equal(comments[j].CreatedAt) {
+			return comments[i].CreatedAt.Before(comments[j].CreatedAt)
 		}
-		rows.Close()
-		shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "success").Inc()
+		return comments[i].ID < comments[j].ID
+	})
+	if len(comments) > preview {
+		comments = comments[:preview]
+	}
+	sort.Slice(likes, func(i, j int) bool {
+		if !likes[i].CreatedAt.Equal(likes[j].CreatedAt) {
+			return likes[i].CreatedAt.After(likes[j].CreatedAt)
+		}
+		return likes[i].ID > likes[j].ID
+	})
+	if len(likes) > preview {
+		likes = likes[:preview]
 	}
 	
 	queriesTotal.WithLabelValues("GET", "/api/posts/{post_id}", "200").Inc()
 	
 	result := map[string]interface{}{
-		"post":     post,
+		"post": PostWithStats{
+			Post:         *post,
+			CommentCount: counts.Comments,
+			LikeCount:    counts.Likes,
+			Reactions:    counts.Reactions,
+		},
 		"comments": comments,
 		"likes":    likes,
 		"stats": map[string]int{
-			"comment_count": len(comments),
-			"like_count":    len(likes),
+			"comment_count": counts.Comments,
+			"like_count":    counts.Likes,
 		},
 	}
 	
-	q.respondWithJSON(w, http.StatusOK, APIResponse{
+	q.respondWithJSON(w, http.StatusOK, q.withFailures(APIResponse{
 		Success: true,
 		Message: "Post retrieved successfully",
 		Data:    result,
-	})
+	}, "/api/posts/{post_id}", failures))
 }
 
-// GET /api/users/{user_id}/stats - Get user statistics
-func (q *QueryService) getUserStats(w http.ResponseWriter, r *http.Request) {
-	timer := prometheus.NewTimer(queryDuration.WithLabelValues("GET", "/api/users/{user_id}/stats"))
+// GET /api/posts/{post_id}/comments - Get the comment threads of a post
+//
+// Returns a page of top-level comments (or, with parent_id, of replies to one
+// comment), oldest first, each with up to `replies` replies nested `depth`
+// levels deep. A comment with more replies than shown carries a next_cursor
+// for them; comments below the depth limit only report their reply_count.
+func (q *QueryService) getPostComments(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(queryDuration.WithLabelValues("GET", "/api/posts/{post_id}/comments"))
 	defer timer.ObserveDuration()
 	
-	vars := mux.Vars(r)
-	userID := vars["user_id"]
+	postID := mux.Vars(r)["post_id"]
+	parentID := r.URL.Query().Get("parent_id")
+	limit := intParam(r, "limit", 20, 1, 100)
+	replies := intParam(r, "replies", 3, 1, 20)
+	depth := intParam(r, "depth", 2, 0, 5)
 	
-	if userID == "" {
-		queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/stats", "400").Inc()
-		q.respondWithError(w, http.StatusBadRequest, "user_id is required")
+	requireAll, err := requireAllShards(r)
+	if err != nil {
+		queriesTotal.WithLabelValues("GET", "/api/posts/{post_id}/comments", "400").Inc()
+		q.respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	
-	// Get stats from the user's shard
-	shardID := q.getShardID(userID)
-	db := q.dbPool[shardID]
+	cursor, err := decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		queriesTotal.WithLabelValues("GET", "/api/posts/{post_id}/comments", "400").Inc()
+		q.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var after *cursorPosition
+	if cursor != nil {
+		after = &cursor.Last
+	}
 	
-	var stats UserStats
-	stats.UserID = userID
+	router := q.router.Current()
+	location := q.locatePost(r.Context(), router, postID)
+	failures := make(shardFailures)
 	
-	// Get post count
-	err := db.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = $1", userID).Scan(&stats.PostCount)
-	if err != nil {
-		q.logger.WithError(err).Error("Failed to get post count")
+	post, _, errs := q.findPost(r.Context(), router, location.postShards, postID)
+	failures.add(location.postShards, errs)
+	if post == nil {
+		if len(failures) > 0 {
+			q.respondUnavailable(w, "GET", "/api/posts/{post_id}/comments", failures.IDs())
+			return
+		}
+		queriesTotal.WithLabelValues("GET", "/api/posts/{post_id}/comments", "404").Inc()
+		q.respondWithError(w, http.StatusNotFound, "Post not found")
+		return
 	}
 	
-	// Get comment count
-	err = db.QueryRow("SELECT COUNT(*) FROM comments WHERE user_id = $1", userID).Scan(&stats.CommentCount)
-	if err != nil {
-		q.logger.WithError(err).Error("Failed to get comment count")
+	threads := newCommentReader(q, router, location.commentShards, postID, failures)
+	
+	if parentID != "" {
+		parent, found := threads.find(r.Context(), parentID)
+		if !found || !threads.visible(r.Context(), parent) {
+			// A shard that did not answer may hold the comment or its replies
+			if len(failures) > 0 {
+				q.respondUnavailable(w, "GET", "/api/posts/{post_id}/comments", failures.IDs())
+				return
+			}
+			queriesTotal.WithLabelValues("GET", "/api/posts/{post_id}/comments", "404").Inc()
+			q.respondWithError(w, http.StatusNotFound, "Comment not found")
+			return
+		}
 	}
 	
-	// Get like count
-	err = db.QueryRow("SELECT COUNT(*) FROM likes WHERE user_id = $1", userID).Scan(&stats.LikeCount)
-	if err != nil {
-		q.logger.WithError(err).Error("Failed to get like count")
+	nodes, nextCursor := threads.nodes(r.Context(), parentID, after, limit, replies, depth)
+	
+	if requireAll && len(failures) > 0 {
+		q.respondUnavailable(w, "GET", "/api/posts/{post_id}/comments", failures.IDs())
+		return
 	}
 	
-	shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "success").Inc()
-	queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/stats", "200").Inc()
+	queriesTotal.WithLabelValues("GET", "/api/posts/{post_id}/comments", "200").Inc()
+	count := len(nodes)
 	
-	q.respondWithJSON(w, http.StatusOK, APIResponse{
-		Success: true,
-		Message: "User statistics retrieved successfully",
-		Data:    stats,
-	})
+	q.respondWithJSON(w, http.StatusOK, q.withFailures(APIResponse{
+		Success:    true,
+		Message:    fmt.Sprintf("Retrieved %d comments", count),
+		Data:       nodes,
+		Count:      &count,
+		NextCursor: nextCursor,
+	}, "/api/posts/{post_id}/comments", failures))
 }
 
-// GET /api/posts - Get recent posts across all shards
-func (q *QueryService) getRecentPosts(w http.ResponseWriter, r *http.Request) {
-	timer := prometheus.NewTimer(queryDuration.WithLabelValues("GET", "/api/posts"))
-	defer timer.ObserveDuration()
+// findPost reads a post that is not deleted from the shards that may hold it,
+// and returns the shard it was found on. The post is nil when none of the
+// shards that answered has it.
+func (q *QueryService) findPost(ctx context.Context, router shard.Router, shardIDs []uint32, postID string) (*Post, uint32, []error) {
+	found := make([]*Post, len(shardIDs))
+	errs := q.scatter(ctx, router, shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+		query := `SELECT id, user_id, content, created_at, updated_at FROM posts WHERE id = $1 AND deleted_at IS NULL`
+		
+		var p Post
+		err := db.QueryRowContext(ctx, query, postID).Scan(&p.ID, &p.UserID, &p.Content, &p.CreatedAt, &p.UpdatedAt)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found[i] = &p
+		return nil
+	})
 	
-	limitStr := r.URL.Query().Get("limit")
-	limit := 20 // default
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
+	for i, p := range found {
+		if p != nil {
+			return p, shardIDs[i], errs
 		}
 	}
+	return nil, 0, errs
+}
+
+// threadComment is a comment row read to build a comment tree
+type threadComment struct {
+	Comment
+	deleted bool
+}
+
+// threadColumns are the columns scanned by scanThreadComment
+const threadColumns = `id, post_id, user_id, content, COALESCE(parent_comment_id, ''), created_at, updated_at, deleted_at IS NOT NULL`
+
+func scanThreadComment(scan func(dest ...interface{}) error) (threadComment, error) {
+	var c threadComment
+	err := scan(&c.ID, &c.PostID, &c.UserID, &c.Content, &c.ParentCommentID, &c.CreatedAt, &c.UpdatedAt, &c.deleted)
+	return c, err
+}
+
+// commentReader reads the comment threads of a post with keyset queries on the
+// shards that hold its comments, a whole level of the tree per query. Deleted
+// comments are only visible while they have visible replies. Shards that fail
+// are recorded in failures and left out of the results.
+type commentReader struct {
+	q        *QueryService
+	router   shard.Router
+	shardIDs []uint32
+	postID   string
+	failures shardFailures
+	
+	// summaries and shown cache what was read of the replies to each comment
+	// and which deleted comments are visible
+	summaries map[string]*replySummary
+	shown     map[string]bool
+}
+
+// replySummary is what the shards hold of the replies to one comment
+type replySummary struct {
+	live    int
+	deleted []string
+}
+
+func newCommentReader(q *QueryService, router shard.Router, shardIDs []uint32, postID string, failures shardFailures) *commentReader {
+	return &commentReader{
+		q:         q,
+		router:    router,
+		shardIDs:  shardIDs,
+		postID:    postID,
+		failures:  failures,
+		summaries: make(map[string]*replySummary),
+		shown:     make(map[string]bool),
+	}
+}
+
+// find reads a comment of the post, deleted or not
+func (cr *commentReader) find(ctx context.Context, commentID string) (threadComment, bool) {
+	found := make([]*threadComment, len(cr.shardIDs))
+	errs := cr.q.scatter(ctx, cr.router, cr.shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+		query := fmt.Sprintf(`SELECT %s FROM comments WHERE id = $1 AND post_id = $2`, threadColumns)
+		
+		c, err := scanThreadComment(db.QueryRowContext(ctx, query, commentID, cr.postID).Scan)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found[i] = &c
+		return nil
+	})
+	cr.failures.add(cr.shardIDs, errs)
 	
-	// Query all shards and merge results
-	var allPosts []Post
-	
-	for shardID, db := range q.dbPool {
-		query := `SELECT id, user_id, content, created_at, updated_at 
-				  FROM posts 
-				  ORDER BY created_at DESC 
-				  LIMIT $1`
+	for _, c := range found {
+		if c != nil {
+			return *c, true
+		}
+	}
+	return threadComment{}, false
+}
+
+// read returns up to n replies to parentID ("" for top-level comments) that
+// come after a position, oldest first and deleted ones included, and whether
+// there are more. Each shard returns its next n+1 replies, so the merged
+// page tells whether any shard has more.
+func (cr *commentReader) read(ctx context.Context, parentID string, after *cursorPosition, n int) ([]threadComment, bool) {
+	results := make([][]threadComment, len(cr.shardIDs))
+	errs := cr.q.scatter(ctx, cr.router, cr.shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+		condition, args := commentsAfter(after, 3)
+		query := fmt.Sprintf(`SELECT %s 
+				  FROM comments 
+				  WHERE post_id = $1 AND parent_comment_id IS NOT DISTINCT FROM NULLIF($2, '') AND %s 
+				  ORDER BY created_at, id 
+				  LIMIT %d`, threadColumns, condition, n+1)
 		
-		rows, err := db.Query(query, limit)
+		rows, err := db.QueryContext(ctx, query, append([]interface{}{cr.postID, parentID}, args...)...)
 		if err != nil {
-			shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "error").Inc()
-			q.logger.WithError(err).WithField("shard_id", shardID).Error("Failed to query posts")
-			continue
+			return err
 		}
+		defer rows.Close()
 		
 		for rows.Next() {
-			var post Post
-			err := rows.Scan(&post.ID, &post.UserID, &post.Content, &post.CreatedAt, &post.UpdatedAt)
-			if err == nil {
-				allPosts = append(allPosts, post)
+			c, err := scanThreadComment(rows.Scan)
+			if err != nil {
+				return err
 			}
+			results[i] = append(results[i], c)
 		}
-		rows.Close()
-		shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "success").Inc()
-	}
+		return rows.Err()
+	})
+	cr.failures.add(cr.shardIDs, errs)
 	
-	// Sort by created_at descending and limit
-	// Simple bubble sort for small datasets
-	for i := 0; i < len(allPosts)-1; i++ {
-		for j := 0; j < len(allPosts)-i-1; j++ {
-			if allPosts[j].CreatedAt.Before(allPosts[j+1].CreatedAt) {
-				allPosts[j], allPosts[j+1] = allPosts[j+1], allPosts[j]
+	merged := mergeThread(results)
+	if len(merged) > n {
+		return merged[:n], true
+	}
+	return merged, false
+}
+
+// firstReplies reads the first n visible replies to each of the comments,
+// with one query per shard. The deleted replies must have been resolved.
+func (cr *commentReader) firstReplies(ctx context.Context, parentIDs []string, n int) map[string][]threadComment {
+	var shown []string
+	for _, id := range parentIDs {
+		for _, reply := range cr.summaries[id].deleted {
+			if cr.shown[reply] {
+				shown = append(shown, reply)
 			}
 		}
 	}
 	
-	// Apply limit
-	if len(allPosts) > limit {
-		allPosts = allPosts[:limit]
-	}
-	
-	queriesTotal.WithLabelValues("GET", "/api/posts", "200").Inc()
-	count := len(allPosts)
+	results := make([][]threadComment, len(cr.shardIDs))
+	errs := cr.q.scatter(ctx, cr.router, cr.shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+		query := fmt.Sprintf(`SELECT %s 
+				  FROM (SELECT *, row_number() OVER (PARTITION BY parent_comment_id ORDER BY created_at, id) AS n 
+				        FROM comments 
+				        WHERE post_id = $1 AND parent_comment_id = ANY($2) AND (deleted_at IS NULL OR id = ANY($3))) comments 
+				  WHERE n <= $4 
+				  ORDER BY created_at, id`, threadColumns)
+		
+		rows, err := db.QueryContext(ctx, query, cr.postID, pq.Array(parentIDs), pq.Array(shown), n)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		
+		for rows.Next() {
+			c, err := scanThreadComment(rows.Scan)
+			if err != nil {
+				return err
+			}
+			results[i] = append(results[i], c)
+		}
+		return rows.Err()
+	})
+	cr.failures.add(cr.shardIDs, errs)
 	
-	q.respondWithJSON(w, http.StatusOK, APIResponse{
-		Success: true,
-		Message: fmt.Sprintf("Retrieved %d recent posts", count),
-		Data:    allPosts,
-		Count:   &count,
+	replies := make(map[string][]threadComment, len(parentIDs))
+	for _, c := range mergeThread(results) {
+		if len(replies[c.ParentCommentID]) < n {
+			replies[c.ParentCommentID] = append(replies[c.ParentCommentID], c)
+		}
+	}
+	return replies
+}
+
+// mergeThread merges the comments read from each shard, oldest first
+func mergeThread(results [][]threadComment) []threadComment {
+	var merged []threadComment
+	for _, result := range results {
+		merged = append(merged, result...)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if !merged[i].CreatedAt.Equal(merged[j].CreatedAt) {
+			return merged[i].CreatedAt.Before(merged[j].CreatedAt)
+		}
+		return merged[i].ID < merged[j].ID
 	})
+	return merged
 }
 
-// GET /health
-func (q *QueryService) handleHealth(w http.ResponseWriter, r *http.Request) {
-	// Check database connections
-	healthyShards := 0
-	for shardID, db := range q.dbPool {
-		if err := db.Ping(); err == nil {
-			healthyShards++
-		} else {
-			q.logger.WithError(err).WithField("shard_id", shardID).Warn("Unhealthy shard")
+// summarize reads how many live replies each comment has and which of its
+// replies are deleted, with one query per shard for the comments not read yet
+func (cr *commentReader) summarize(ctx context.Context, commentIDs []string) {
+	var missing []string
+	for _, id := range commentIDs {
+		if _, ok := cr.summaries[id]; !ok {
+			cr.summaries[id] = &replySummary{}
+			missing = append(missing, id)
 		}
 	}
-	
-	status := "healthy"
-	if healthyShards < len(q.dbPool) {
-		status = "degraded"
+	if len(missing) == 0 {
+		return
 	}
 	
-	response := map[string]interface{}{
-		"service":        "query",
-		"status":         status,
-		"timestamp":      time.Now().UTC(),
-		"total_shards":   len(q.dbPool),
-		"healthy_shards": healthyShards,
-		"version":        "1.0.0",
-	}
+	results := make([]map[string]*replySummary, len(cr.shardIDs))
+	errs := cr.q.scatter(ctx, cr.router, cr.shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+		query := `SELECT parent_comment_id, COUNT(*) FILTER (WHERE deleted_at IS NULL), 
+				         COALESCE(array_agg(id) FILTER (WHERE deleted_at IS NOT NULL), '{}') 
+				  FROM comments 
+				  WHERE post_id = $1 AND parent_comment_id = ANY($2) 
+				  GROUP BY 1`
+		
+		rows, err := db.QueryContext(ctx, query, cr.postID, pq.Array(missing))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		
+		results[i] = make(map[string]*replySummary)
+		for rows.Next() {
+			var parentID string
+			var s replySummary
+			if err := rows.Scan(&parentID, &s.live, pq.Array(&s.deleted)); err != nil {
+				return err
+			}
+			results[i][parentID] = &s
+		}
+		return rows.Err()
+	})
+	cr.failures.add(cr.shardIDs, errs)
 	
-	statusCode := http.StatusOK
-	if status == "degraded" {
-		statusCode = http.StatusServiceUnavailable
+	for _, result := range results {
+		for parentID, s := range result {
+			summary := cr.summaries[parentID]
+			summary.live += s.live
+			summary.deleted = append(summary.deleted, s.deleted...)
+		}
 	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(response)
 }
 
-func (q *QueryService) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	response, _ := json.Marshal(payload)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	w.Write(response)
-}
+// resolve works out which deleted comments are visible: those with a live
+// reply or a visible deleted one. It reads down the deleted replies a level
+// per query, then resolves the levels bottom-up.
+func (cr *commentReader) resolve(ctx context.Context, deletedIDs []string) {
+	var levels [][]string
+	level := cr.unresolved(deletedIDs)
+	for len(level) > 0 {
+		cr.summarize(ctx, level)
+		levels = append(levels, level)
+		
+		var next []string
+		for _, id := range level {
+			next = append(next, cr.summaries[id].deleted...)
+		}
+		level = cr.unresolved(next)
+	}
+	
+	for i := len(levels) - 1; i >= 0; i-- {
+		for _, id := range levels[i] {
+			summary := cr.summaries[id]
+			shown := summary.live > 0
+			for _, reply := range summary.deleted {
+				shown = shown || cr.shown[reply]
+			}
+			cr.shown[id] = shown
+		}
+	}
+}
+
+// unresolved returns the deleted comments whose visibility is not known yet
+func (cr *commentReader) unresolved(deletedIDs []string) []string {
+	var out []string
+	for _, id := range deletedIDs {
+		if _, ok := cr.shown[id]; !ok {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// visible reports whether a comment is shown: it is not deleted, or one of
+// its replies is visible
+func (cr *commentReader) visible(ctx context.Context, c threadComment) bool {
+	if !c.deleted {
+		return true
+	}
+	cr.resolve(ctx, []string{c.ID})
+	return cr.shown[c.ID]
+}
+
+// replyCount counts the visible replies to a comment whose summary was read
+// and whose deleted replies were resolved
+func (cr *commentReader) replyCount(commentID string) int {
+	summary := cr.summaries[commentID]
+	count := summary.live
+	for _, reply := range summary.deleted {
+		if cr.shown[reply] {
+			count++
+		}
+	}
+	return count
+}
+
+// page returns up to limit visible replies to parentID that come after a
+// position, and whether there are more. Deleted replies without visible
+// replies of their own are skipped, reading further when they leave the page
+// short.
+func (cr *commentReader) page(ctx context.Context, parentID string, after *cursorPosition, limit int) ([]threadComment, bool) {
+	var page []threadComment
+	for {
+		batch, more := cr.read(ctx, parentID, after, limit+1-len(page))
+		
+		var deleted []string
+		for _, c := range batch {
+			if c.deleted {
+				deleted = append(deleted, c.ID)
+			}
+		}
+		cr.resolve(ctx, deleted)
+		
+		for _, c := range batch {
+			if c.deleted && !cr.shown[c.ID] {
+				continue
+			}
+			if len(page) == limit {
+				return page, true
+			}
+			page = append(page, c)
+		}
+		if !more {
+			return page, false
+		}
+		last := batch[len(batch)-1]
+		after = &cursorPosition{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+}
+
+// nodes returns up to limit visible replies to parentID that come after a
+// position, with their own replies nested depth levels deep, and the cursor of
+// the next page ("" on the last page)
+func (cr *commentReader) nodes(ctx context.Context, parentID string, after *cursorPosition, limit, replies, depth int) ([]*CommentNode, string) {
+	page, more := cr.page(ctx, parentID, after, limit)
+	nodes := cr.expand(ctx, page, replies, depth)
+	
+	if !more {
+		return nodes, ""
+	}
+	last := page[len(page)-1]
+	return nodes, encodeCursor(pageCursor{Last: cursorPosition{CreatedAt: last.CreatedAt, ID: last.ID}})
+}
+
+// expand builds the nodes of comments with up to `replies` of their replies
+// nested depth levels deep. Each level of the tree costs a fixed number of
+// queries, however many comments it has.
+func (cr *commentReader) expand(ctx context.Context, comments []threadComment, replies, depth int) []*CommentNode {
+	ids := make([]string, len(comments))
+	for i, c := range comments {
+		ids[i] = c.ID
+	}
+	cr.summarize(ctx, ids)
+	
+	var deleted []string
+	for _, id := range ids {
+		deleted = append(deleted, cr.summaries[id].deleted...)
+	}
+	cr.resolve(ctx, deleted)
+	
+	nodes := make([]*CommentNode, len(comments))
+	var parents []string
+	for i, c := range comments {
+		nodes[i] = &CommentNode{Comment: c.Comment, Deleted: c.deleted, ReplyCount: cr.replyCount(c.ID)}
+		if c.deleted {
+			nodes[i].UserID = ""
+			nodes[i].Content = ""
+		}
+		if depth > 0 && nodes[i].ReplyCount > 0 {
+			parents = append(parents, c.ID)
+		}
+	}
+	if len(parents) == 0 {
+		return nodes
+	}
+	
+	shown := cr.firstReplies(ctx, parents, replies)
+	var next []threadComment
+	for _, id := range parents {
+		next = append(next, shown[id]...)
+	}
+	children := cr.expand(ctx, next, replies, depth-1)
+	
+	for _, node := range nodes {
+		n := len(shown[node.ID])
+		if depth == 0 || n == 0 {
+			continue
+		}
+		node.Replies, children = children[:n], children[n:]
+		if node.ReplyCount > n {
+			last := shown[node.ID][n-1]
+			node.NextCursor = encodeCursor(pageCursor{Last: cursorPosition{CreatedAt: last.CreatedAt, ID: last.ID}})
+		}
+	}
+	return nodes
+}
+
+// intParam reads an integer query parameter, falling back to defaultValue
+// when it is missing, malformed or below min and capping it at max
+func intParam(r *http.Request, name string, defaultValue, min, max int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || value < min {
+		return defaultValue
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// postLocation lists the shards that may hold a post and its comments and likes
+type postLocation struct {
+	postShards    []uint32
+	commentShards []uint32
+	likeShards    []uint32
+}
+
+// locatePost resolves a post through the post directory. Comments and likes
+// placed by post live on the post's shard; those placed by author live on the
+// shards of the post's participants. Posts the directory does not know about
+// (written before it existed) and directory failures fall back to scanning
+// every shard unless POST_DIRECTORY_FALLBACK is disabled.
+func (q *QueryService) locatePost(ctx context.Context, router shard.Router, postID string) postLocation {
+	ownerID, found, err := q.directory.PostOwner(ctx, postID)
+	if err == nil && found {
+		postShard := router.ShardFor(ownerID)
+		
+		var participantShards []uint32
+		if q.placements.Comments == shard.PlaceByAuthor || q.placements.Likes == shard.PlaceByAuthor {
+			var participants []string
+			participants, err = q.directory.Participants(ctx, postID)
+			
+			seen := make(map[uint32]bool)
+			for _, userID := range participants {
+				shardID := router.ShardFor(userID)
+				if !seen[shardID] {
+					seen[shardID] = true
+					participantShards = append(participantShards, shardID)
+				}
+			}
+		}
+		
+		if err == nil {
+			directoryLookups.WithLabelValues("hit").Inc()
+			
+			location := postLocation{
+				postShards:    []uint32{postShard},
+				commentShards: participantShards,
+				likeShards:    participantShards,
+			}
+			if q.placements.Comments == shard.PlaceByPost {
+				location.commentShards = location.postShards
+			}
+			if q.placements.Likes == shard.PlaceByPost {
+				location.likeShards = location.postShards
+			}
+			return location
+		}
+	}
+	
+	if err != nil {
+		directoryLookups.WithLabelValues("error").Inc()
+		q.logger.WithError(err).WithField("post_id", postID).Warn("Post directory lookup failed")
+	} else {
+		directoryLookups.WithLabelValues("miss").Inc()
+	}
+	
+	if !q.directoryFallback {
+		return postLocation{}
+	}
+	
+	all := allShards(router)
+	return postLocation{postShards: all, commentShards: all, likeShards: all}
+}
+
+// userShards returns the shards that may hold a user's rows of a table: the
+// user's own shard, or every shard when the table is placed by post
+func (q *QueryService) userShards(router shard.Router, table, userID string) []uint32 {
+	if q.placements.For(table) == shard.PlaceByPost {
+		return allShards(router)
+	}
+	return []uint32{router.ShardFor(userID)}
+}
+
+func allShards(router shard.Router) []uint32 {
+	var ids []uint32
+	for _, config := range router.All() {
+		ids = append(ids, config.ID)
+	}
+	return ids
+}
+
+// GET /api/users/{user_id}/stats - Get user statistics
+func (q *QueryService) getUserStats(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(queryDuration.WithLabelValues("GET", "/api/users/{user_id}/stats"))
+	defer timer.ObserveDuration()
+	
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+	
+	if userID == "" {
+		queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/stats", "400").Inc()
+		q.respondWithError(w, http.StatusBadRequest, "user_id is required")
+		return
+	}
+	
+	requireAll, err := requireAllShards(r)
+	if err != nil {
+		queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/stats", "400").Inc()
+		q.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	// Get stats from the user's shard, or from every shard for tables placed by post
+	router := q.router.Current()
+	failures := make(shardFailures)
+	
+	var stats UserStats
+	stats.UserID = userID
+	
+	// Deleted posts and comments are not counted
+	for _, counter := range []struct {
+		table     string
+		condition string
+		count     *int
+	}{
+		{"posts", "user_id = $1 AND deleted_at IS NULL", &stats.PostCount},
+		{"comments", "user_id = $1 AND deleted_at IS NULL", &stats.CommentCount},
+		{"likes", "user_id = $1", &stats.LikeCount},
+	} {
+		shardIDs := q.userShards(router, counter.table, userID)
+		counts := make([]int, len(shardIDs))
+		
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", counter.table, counter.condition)
+		errs := q.scatter(r.Context(), router, shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+			return db.QueryRowContext(ctx, query, userID).Scan(&counts[i])
+		})
+		failures.add(shardIDs, errs)
+		
+		for _, count := range counts {
+			*counter.count += count
+		}
+	}
+	
+	if requireAll && len(failures) > 0 {
+		q.respondUnavailable(w, "GET", "/api/users/{user_id}/stats", failures.IDs())
+		return
+	}
+	
+	queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/stats", "200").Inc()
+	
+	q.respondWithJSON(w, http.StatusOK, q.withFailures(APIResponse{
+		Success: true,
+		Message: "User statistics retrieved successfully",
+		Data:    stats,
+	}, "/api/users/{user_id}/stats", failures))
+}
+
+// GET /api/users/{user_id}/feed - Get recent posts of everyone a user follows
+func (q *QueryService) getUserFeed(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(queryDuration.WithLabelValues("GET", "/api/users/{user_id}/feed"))
+	defer timer.ObserveDuration()
+	
+	userID := mux.Vars(r)["user_id"]
+	
+	limit := 20
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	
+	requireAll, err := requireAllShards(r)
+	if err != nil {
+		queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/feed", "400").Inc()
+		q.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	cursor, err := decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/feed", "400").Inc()
+		q.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	if q.feed.Mode == feed.FanOutOnWrite {
+		q.timelineFeed(w, r, userID, limit, cursor, requireAll)
+	} else {
+		q.mergedFeed(w, r, userID, limit, cursor, requireAll)
+	}
+}
+
+// mergedFeed builds a feed on read. It merges the latest posts of every
+// followed user, asking only the shards that store some of them, and pages
+// like the global feed.
+func (q *QueryService) mergedFeed(w http.ResponseWriter, r *http.Request, userID string, limit int, cursor *pageCursor, requireAll bool) {
+	router := q.router.Current()
+	
+	// Follows are stored on the follower's shard
+	followShard := []uint32{router.ShardFor(userID)}
+	var followees []string
+	errs := q.scatter(r.Context(), router, followShard, func(ctx context.Context, i int, db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, `SELECT followee_id FROM follows WHERE follower_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		
+		for rows.Next() {
+			var followeeID string
+			if err := rows.Scan(&followeeID); err != nil {
+				return err
+			}
+			followees = append(followees, followeeID)
+		}
+		return rows.Err()
+	})
+	if errs[0] != nil {
+		q.respondUnavailable(w, "GET", "/api/users/{user_id}/feed", followShard)
+		return
+	}
+	
+	// Work out where each shard holding followed users resumes
+	groups := feed.ByShard(router, followees)
+	var shardIDs []uint32
+	var positions []*cursorPosition
+	for _, shardID := range allShards(router) {
+		if len(groups[shardID]) == 0 {
+			continue
+		}
+		position, exhausted := cursor.position(shardID)
+		if !exhausted {
+			shardIDs = append(shardIDs, shardID)
+			positions = append(positions, position)
+		}
+	}
+	
+	results := make([][]Post, len(shardIDs))
+	errs = q.scatter(r.Context(), router, shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+		condition, args := postsAfter(positions[i], 2)
+		query := fmt.Sprintf(`SELECT id, user_id, content, created_at, updated_at 
+				  FROM posts 
+				  WHERE user_id = ANY($1) AND deleted_at IS NULL AND %s 
+				  ORDER BY created_at DESC, id DESC 
+				  LIMIT %d`, condition, limit+1)
+		
+		rows, err := db.QueryContext(ctx, query, append([]interface{}{pq.Array(groups[shardIDs[i]])}, args...)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		
+		results[i], err = scanPosts(rows)
+		return err
+	})
+	
+	failures := make(shardFailures)
+	failures.add(shardIDs, errs)
+	if requireAll && len(failures) > 0 {
+		q.respondUnavailable(w, "GET", "/api/users/{user_id}/feed", failures.IDs())
+		return
+	}
+	
+	posts, taken := mergePosts(results, limit)
+	nextCursor := nextPageCursor(shardIDs, positions, results, taken, errs, posts, limit)
+	
+	q.respondWithFeed(w, userID, posts, nextCursor, failures)
+}
+
+// timelineFeed reads a feed fanned out on write. The user's timeline gives
+// the page in order; the posts are then read from their authors' shards, so
+// edits show up and deleted posts drop out.
+func (q *QueryService) timelineFeed(w http.ResponseWriter, r *http.Request, userID string, limit int, cursor *pageCursor, requireAll bool) {
+	router := q.router.Current()
+	
+	// Timelines are stored on the follower's shard
+	timelineShard := []uint32{router.ShardFor(userID)}
+	var entries []feed.Entry
+	errs := q.scatter(r.Context(), router, timelineShard, func(ctx context.Context, i int, db *sql.DB) error {
+		condition, args := "TRUE", []interface{}{userID}
+		if cursor != nil {
+			condition = "(created_at, post_id) < ($2, $3)"
+			args = append(args, cursor.Last.CreatedAt, cursor.Last.ID)
+		}
+		query := fmt.Sprintf(`SELECT post_id, author_id, created_at 
+				  FROM timelines 
+				  WHERE user_id = $1 AND %s 
+				  ORDER BY created_at DESC, post_id DESC 
+				  LIMIT %d`, condition, limit+1)
+		
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		
+		for rows.Next() {
+			var entry feed.Entry
+			if err := rows.Scan(&entry.PostID, &entry.AuthorID, &entry.CreatedAt); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return rows.Err()
+	})
+	if errs[0] != nil {
+		q.respondUnavailable(w, "GET", "/api/users/{user_id}/feed", timelineShard)
+		return
+	}
+	
+	// The cursor follows the timeline, whether or not its posts still exist
+	var nextCursor string
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[len(entries)-1]
+		nextCursor = encodeCursor(pageCursor{Last: cursorPosition{CreatedAt: last.CreatedAt, ID: last.PostID}})
+	}
+	
+	// Posts are stored on their author's shard
+	postIDs := make(map[uint32][]string)
+	for _, entry := range entries {
+		shardID := router.ShardFor(entry.AuthorID)
+		postIDs[shardID] = append(postIDs[shardID], entry.PostID)
+	}
+	var shardIDs []uint32
+	for _, shardID := range allShards(router) {
+		if len(postIDs[shardID]) > 0 {
+			shardIDs = append(shardIDs, shardID)
+		}
+	}
+	
+	results := make([][]Post, len(shardIDs))
+	errs = q.scatter(r.Context(), router, shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+		query := `SELECT id, user_id, content, created_at, updated_at 
+				  FROM posts WHERE id = ANY($1) AND deleted_at IS NULL`
+		
+		rows, err := db.QueryContext(ctx, query, pq.Array(postIDs[shardIDs[i]]))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		
+		results[i], err = scanPosts(rows)
+		return err
+	})
+	
+	failures := make(shardFailures)
+	failures.add(shardIDs, errs)
+	if requireAll && len(failures) > 0 {
+		q.respondUnavailable(w, "GET", "/api/users/{user_id}/feed", failures.IDs())
+		return
+	}
+	
+	found := make(map[string]Post)
+	for _, result := range results {
+		for _, post := range result {
+			found[post.ID] = post
+		}
+	}
+	posts := make([]Post, 0, len(entries))
+	for _, entry := range entries {
+		if post, ok := found[entry.PostID]; ok {
+			posts = append(posts, post)
+		}
+	}
+	
+	q.respondWithFeed(w, userID, posts, nextCursor, failures)
+}
+
+func (q *QueryService) respondWithFeed(w http.ResponseWriter, userID string, posts []Post, nextCursor string, failures shardFailures) {
+	queriesTotal.WithLabelValues("GET", "/api/users/{user_id}/feed", "200").Inc()
+	count := len(posts)
+	
+	q.respondWithJSON(w, http.StatusOK, q.withFailures(APIResponse{
+		Success:    true,
+		Message:    fmt.Sprintf("Retrieved %d feed posts for user %s", count, userID),
+		Data:       posts,
+		Count:      &count,
+		NextCursor: nextCursor,
+	}, "/api/users/{user_id}/feed", failures))
+}
+
+// scanPosts reads rows of id, user_id, content, created_at, updated_at
+func scanPosts(rows *sql.Rows) ([]Post, error) {
+	var posts []Post
+	for rows.Next() {
+		var post Post
+		if err := rows.Scan(&post.ID, &post.UserID, &post.Content, &post.CreatedAt, &post.UpdatedAt); err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+// GET /api/posts - Get recent posts across all shards
+func (q *QueryService) getRecentPosts(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(queryDuration.WithLabelValues("GET", "/api/posts"))
+	defer timer.ObserveDuration()
+	
+	limitStr := r.URL.Query().Get("limit")
+	limit := 20 // default
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+	
+	requireAll, err := requireAllShards(r)
+	if err != nil {
+		queriesTotal.WithLabelValues("GET", "/api/posts", "400").Inc()
+		q.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	cursor, err := decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		queriesTotal.WithLabelValues("GET", "/api/posts", "400").Inc()
+		q.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	// Work out where each shard resumes; shards that ran out are skipped
+	router := q.router.Current()
+	var shardIDs []uint32
+	var positions []*cursorPosition
+	for _, shardID := range allShards(router) {
+		position, exhausted := cursor.position(shardID)
+		if !exhausted {
+			shardIDs = append(shardIDs, shardID)
+			positions = append(positions, position)
+		}
+	}
+	
+	// Query the shards concurrently; each returns its next posts already sorted,
+	// plus one extra row to tell whether it has more
+	results := make([][]Post, len(shardIDs))
+	
+	errs := q.scatter(r.Context(), router, shardIDs, func(ctx context.Context, i int, db *sql.DB) error {
+		condition, args := postsAfter(positions[i], 1)
+		query := fmt.Sprintf(`SELECT id, user_id, content, created_at, updated_at 
+				  FROM posts 
+				  WHERE deleted_at IS NULL AND %s 
+				  ORDER BY created_at DESC, id DESC 
+				  LIMIT %d`, condition, limit+1)
+		
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		
+		for rows.Next() {
+			var post Post
+			if err := rows.Scan(&post.ID, &post.UserID, &post.Content, &post.CreatedAt, &post.UpdatedAt); err != nil {
+				return err
+			}
+			results[i] = append(results[i], post)
+		}
+		return rows.Err()
+	})
+	
+	failures := make(shardFailures)
+	failures.add(shardIDs, errs)
+	if requireAll && len(failures) > 0 {
+		q.respondUnavailable(w, "GET", "/api/posts", failures.IDs())
+		return
+	}
+	
+	allPosts, taken := mergePosts(results, limit)
+	
+	nextCursor := nextPageCursor(shardIDs, positions, results, taken, errs, allPosts, limit)
+	
+	queriesTotal.WithLabelValues("GET", "/api/posts", "200").Inc()
+	count := len(allPosts)
+	
+	q.respondWithJSON(w, http.StatusOK, q.withFailures(APIResponse{
+		Success:    true,
+		Message:    fmt.Sprintf("Retrieved %d recent posts", count),
+		Data:       allPosts,
+		Count:      &count,
+		NextCursor: nextCursor,
+	}, "/api/posts", failures))
+}
+
+// nextPageCursor returns the cursor of the page after a merged cross-shard
+// query, or "" when no shard has older posts. Every shard advances past the
+// posts it contributed. Failed shards keep the position they were queried
+// from so the next page retries them; those that have never been read are
+// listed as unread.
+func nextPageCursor(shardIDs []uint32, positions []*cursorPosition, results [][]Post, taken []int, errs []error, merged []Post, limit int) string {
+	if len(merged) == 0 {
+		return ""
+	}
+	
+	last := merged[len(merged)-1]
+	next := pageCursor{
+		Last:   cursorPosition{CreatedAt: last.CreatedAt, ID: last.ID},
+		Shards: make(map[uint32]*cursorPosition),
+	}
+	more := false
+	for i, shardID := range shardIDs {
+		position := positions[i]
+		if taken[i] > 0 {
+			post := results[i][taken[i]-1]
+			position = &cursorPosition{CreatedAt: post.CreatedAt, ID: post.ID}
+		} else if errs[i] == nil {
+			position = &next.Last
+		}
+		
+		if errs[i] == nil && len(results[i]) <= limit && taken[i] == len(results[i]) {
+			next.Shards[shardID] = nil // no older posts left
+			continue
+		}
+		
+		more = true
+		if position == nil {
+			next.Unread = append(next.Unread, shardID)
+			continue
+		}
+		next.Shards[shardID] = position
+	}
+	
+	if !more {
+		return ""
+	}
+	return encodeCursor(next)
+}
+
+// cursorPosition is a place in feed order: posts come newest first, ties by ID.
+// Comment threads page the same way, oldest first.
+type cursorPosition struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+// pageCursor is the content of a next_cursor token: the last post returned
+// and, for the global feed, where each shard resumes. A shard mapped to null
+// has no older posts; an unread shard failed before returning anything and
+// resumes from its newest post; a shard missing from both (e.g. added since
+// the cursor was issued) resumes after Last.
+type pageCursor struct {
+	Last   cursorPosition             `json:"last"`
+	Shards map[uint32]*cursorPosition `json:"shards,omitempty"`
+	Unread []uint32                   `json:"unread,omitempty"`
+}
+
+// position returns where a shard resumes (nil: from the newest post)
+func (c *pageCursor) position(shardID uint32) (position *cursorPosition, exhausted bool) {
+	if c == nil {
+		return nil, false
+	}
+	for _, id := range c.Unread {
+		if id == shardID {
+			return nil, false
+		}
+	}
+	if position, ok := c.Shards[shardID]; ok {
+		return position, position == nil
+	}
+	return &c.Last, false
+}
+
+func encodeCursor(cursor pageCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor token; an empty token means the first page
+func decodeCursor(token string) (*pageCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Last.ID == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// postsAfter returns the condition selecting posts that come after a position
+// in feed order, with placeholders numbered from $n
+func postsAfter(position *cursorPosition, n int) (string, []interface{}) {
+	if position == nil {
+		return "TRUE", nil
+	}
+	return fmt.Sprintf("(created_at, id) < ($%d, $%d)", n, n+1), []interface{}{position.CreatedAt, position.ID}
+}
+
+// commentsAfter returns the condition selecting comments that come after a
+// position in thread order, with placeholders numbered from $n
+func commentsAfter(position *cursorPosition, n int) (string, []interface{}) {
+	if position == nil {
+		return "TRUE", nil
+	}
+	return fmt.Sprintf("(created_at, id) > ($%d, $%d)", n, n+1), []interface{}{position.CreatedAt, position.ID}
+}
+
+// scatter runs fn against every listed shard concurrently and waits for all of
+// them. Each call gets its own SHARD_QUERY_TIMEOUT deadline; i is the shard's
+// index in shardIDs so callers can collect results without locking. The
+// returned errors are indexed the same way.
+func (q *QueryService) scatter(ctx context.Context, router shard.Router, shardIDs []uint32, fn func(ctx context.Context, i int, db *sql.DB) error) []error {
+	errs := make([]error, len(shardIDs))
+	
+	var wg sync.WaitGroup
+	for i, shardID := range shardIDs {
+		wg.Add(1)
+		go func(i int, shardID uint32) {
+			defer wg.Done()
+			
+			shardCtx, cancel := context.WithTimeout(ctx, q.shardTimeout)
+			defer cancel()
+			
+			db := router.DB(shardID)
+			if db == nil {
+				errs[i] = fmt.Errorf("shard %d is not connected", shardID)
+			} else {
+				errs[i] = fn(shardCtx, i, db)
+			}
+			
+			if errs[i] != nil {
+				shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "error").Inc()
+				q.logger.WithError(errs[i]).WithField("shard_id", shardID).Error("Shard query failed")
+				return
+			}
+			shardQueries.WithLabelValues(fmt.Sprintf("shard_%d", shardID), "success").Inc()
+		}(i, shardID)
+	}
+	wg.Wait()
+	
+	return errs
+}
+
+// shardFailures collects the shards that failed while answering one request
+type shardFailures map[uint32]bool
+
+func (f shardFailures) add(shardIDs []uint32, errs []error) {
+	for i, err := range errs {
+		if err != nil {
+			f[shardIDs[i]] = true
+		}
+	}
+}
+
+// IDs returns the failed shards in ascending order
+func (f shardFailures) IDs() []uint32 {
+	ids := make([]uint32, 0, len(f))
+	for id := range f {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// requireAllShards parses ?consistency=. "partial" (the default) answers with
+// whatever the reachable shards returned; "all" fails the request instead.
+func requireAllShards(r *http.Request) (bool, error) {
+	switch consistency := r.URL.Query().Get("consistency"); consistency {
+	case "", "partial":
+		return false, nil
+	case "all":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid consistency %q: must be \"partial\" or \"all\"", consistency)
+	}
+}
+
+// withFailures marks a response as partial when some shards did not answer
+func (q *QueryService) withFailures(response APIResponse, endpoint string, failures shardFailures) APIResponse {
+	if len(failures) > 0 {
+		response.Partial = true
+		response.FailedShards = failures.IDs()
+		partialResponses.WithLabelValues(endpoint).Inc()
+	}
+	return response
+}
+
+// respondUnavailable fails a request that could not be answered by every shard
+func (q *QueryService) respondUnavailable(w http.ResponseWriter, method, endpoint string, failed []uint32) {
+	queriesTotal.WithLabelValues(method, endpoint, "503").Inc()
+	q.respondWithJSON(w, http.StatusServiceUnavailable, APIResponse{
+		Success:      false,
+		Error:        fmt.Sprintf("%d shard(s) did not respond", len(failed)),
+		FailedShards: failed,
+	})
+}
+
+// newerPost orders posts newest first, breaking ties by ID
+func newerPost(a, b Post) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID > b.ID
+}
+
+// postCursor is the next unmerged post of one shard's result
+type postCursor struct {
+	shard int
+	posts []Post
+	next  int
+}
+
+// postHeap is a max-heap of shard results keyed by their next post
+type postHeap []*postCursor
+
+func (h postHeap) Len() int { return len(h) }
+func (h postHeap) Less(i, j int) bool {
+	return newerPost(h[i].posts[h[i].next], h[j].posts[h[j].next])
+}
+func (h postHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *postHeap) Push(x interface{}) { *h = append(*h, x.(*postCursor)) }
+func (h *postHeap) Pop() interface{} {
+	old := *h
+	cursor := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cursor
+}
+
+// mergePosts k-way merges per-shard results that are each sorted newest
+// first, stopping after limit posts. taken[i] counts the posts used from
+// results[i].
+func mergePosts(results [][]Post, limit int) (merged []Post, taken []int) {
+	taken = make([]int, len(results))
+	h := make(postHeap, 0, len(results))
+	for i, posts := range results {
+		if len(posts) > 0 {
+			h = append(h, &postCursor{shard: i, posts: posts})
+		}
+	}
+	heap.Init(&h)
+	
+	merged = make([]Post, 0, limit)
+	for h.Len() > 0 && len(merged) < limit {
+		cursor := h[0]
+		merged = append(merged, cursor.posts[cursor.next])
+		cursor.next++
+		taken[cursor.shard]++
+		if cursor.next < len(cursor.posts) {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	
+	return merged, taken
+}
+
+// GET /health
+func (q *QueryService) handleHealth(w http.ResponseWriter, r *http.Request) {
+	// Check database connections
+	pools := q.dbPool()
+	healthyShards := 0
+	for shardID, db := range pools {
+		if err := db.Ping(); err == nil {
+			healthyShards++
+		} else {
+			q.logger.WithError(err).WithField("shard_id", shardID).Warn("Unhealthy shard")
+		}
+	}
+	
+	status := "healthy"
+	if healthyShards < len(pools) {
+		status = "degraded"
+	}
+	
+	response := map[string]interface{}{
+		"service":           "query",
+		"status":            status,
+		"timestamp":         time.Now().UTC(),
+		"total_shards":      len(pools),
+		"healthy_shards":    healthyShards,
+		"shard_map_version": q.router.Version(),
+		"version":           "1.0.0",
+	}
+	
+	statusCode := http.StatusOK
+	if status == "degraded" {
+		statusCode = http.StatusServiceUnavailable
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (q *QueryService) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
 
 func (q *QueryService) respondWithError(w http.ResponseWriter, code int, message string) {
 	q.respondWithJSON(w, code, APIResponse{
@@ -570,9 +1847,12 @@ func (q *QueryService) setupRoutes() *mux.Router {
 	
 	// API routes
 	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/users/{user_id}", q.getUser).Methods("GET")
 	api.HandleFunc("/users/{user_id}/posts", q.getUserPosts).Methods("GET")
 	api.HandleFunc("/users/{user_id}/stats", q.getUserStats).Methods("GET")
+	api.HandleFunc("/users/{user_id}/feed", q.getUserFeed).Methods("GET")
 	api.HandleFunc("/posts/{post_id}", q.getPost).Methods("GET")
+	api.HandleFunc("/posts/{post_id}/comments", q.getPostComments).Methods("GET")
 	api.HandleFunc("/posts", q.getRecentPosts).Methods("GET")
 	
 	// Health and metrics
@@ -589,6 +1869,13 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
 func main() {
 	service, err := NewQueryService()
 	if err != nil {
@@ -596,6 +1883,11 @@ func main() {
 	}
 	defer service.Close()
 	
+	// Follow shard map changes in the master DB
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go service.router.Run(watchCtx)
+	
 	router := service.setupRoutes()
 	
 	// CORS middleware
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// post returns a post created the given number of minutes after epoch
+func post(id string, minute int) Post {
+	return Post{ID: id, CreatedAt: epoch.Add(time.Duration(minute) * time.Minute)}
+}
+
+func at(id string, minute int) *cursorPosition {
+	return &cursorPosition{CreatedAt: epoch.Add(time.Duration(minute) * time.Minute), ID: id}
+}
+
+func postIDs(posts []Post) []string {
+	ids := make([]string, len(posts))
+	for i, p := range posts {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+func TestMergePosts(t *testing.T) {
+	tests := []struct {
+		name      string
+		results   [][]Post
+		limit     int
+		want      []string
+		wantTaken []int
+	}{
+		{"no results", [][]Post{nil, nil}, 10, []string{}, []int{0, 0}},
+		{
+			name:      "interleaved",
+			results:   [][]Post{{post("a", 5), post("c", 3)}, {post("b", 4), post("d", 1)}},
+			limit:     10,
+			want:      []string{"a", "b", "c", "d"},
+			wantTaken: []int{2, 2},
+		},
+		{
+			name:      "limit reached",
+			results:   [][]Post{{post("a", 5), post("c", 3)}, {post("b", 4), post("d", 1)}},
+			limit:     3,
+			want:      []string{"a", "b", "c"},
+			wantTaken: []int{2, 1},
+		},
+		{
+			name:      "empty shard",
+			results:   [][]Post{nil, {post("a", 2), post("b", 1)}, nil},
+			limit:     10,
+			want:      []string{"a", "b"},
+			wantTaken: []int{0, 2, 0},
+		},
+		{
+			name:      "ties broken by ID",
+			results:   [][]Post{{post("c", 5), post("a", 5)}, {post("b", 5), post("d", 4)}},
+			limit:     3,
+			want:      []string{"c", "b", "a"},
+			wantTaken: []int{2, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, taken := mergePosts(tt.results, tt.limit)
+			if got := postIDs(merged); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(taken, tt.wantTaken) {
+				t.Errorf("taken = %v, want %v", taken, tt.wantTaken)
+			}
+		})
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name    string
+		token   string
+		want    *pageCursor
+		wantErr bool
+	}{
+		{name: "first page", token: ""},
+		{name: "not base64", token: "not a cursor!", wantErr: true},
+		{name: "not JSON", token: encode("not json"), wantErr: true},
+		{name: "no last post", token: encode(`{"last":{"t":"2024-01-01T00:00:00Z"}}`), wantErr: true},
+		{
+			name:  "last post only",
+			token: encode(`{"last":{"t":"2024-01-01T00:05:00Z","id":"a"}}`),
+			want:  &pageCursor{Last: *at("a", 5)},
+		},
+		{
+			name:  "shard positions",
+			token: encode(`{"last":{"t":"2024-01-01T00:05:00Z","id":"a"},"shards":{"1":{"t":"2024-01-01T00:03:00Z","id":"b"},"2":null},"unread":[3]}`),
+			want: &pageCursor{
+				Last:   *at("a", 5),
+				Shards: map[uint32]*cursorPosition{1: at("b", 3), 2: nil},
+				Unread: []uint32{3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCursor(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeCursor error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeCursor = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPageCursorPosition(t *testing.T) {
+	cursor := &pageCursor{
+		Last:   *at("a", 5),
+		Shards: map[uint32]*cursorPosition{1: at("b", 3), 2: nil},
+		Unread: []uint32{3},
+	}
+	tests := []struct {
+		name          string
+		cursor        *pageCursor
+		shardID       uint32
+		want          *cursorPosition
+		wantExhausted bool
+	}{
+		{"first page", nil, 1, nil, false},
+		{"shard with a position", cursor, 1, at("b", 3), false},
+		{"exhausted shard", cursor, 2, nil, true},
+		{"unread shard", cursor, 3, nil, false},
+		{"shard added since", cursor, 4, at("a", 5), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, exhausted := tt.cursor.position(tt.shardID)
+			if !reflect.DeepEqual(got, tt.want) || exhausted != tt.wantExhausted {
+				t.Errorf("position(%d) = %v, %v, want %v, %v", tt.shardID, got, exhausted, tt.want, tt.wantExhausted)
+			}
+		})
+	}
+}
+
+func TestNextPageCursor(t *testing.T) {
+	shardIDs := []uint32{1, 2, 3}
+	failed := errors.New("shard did not respond")
+
+	tests := []struct {
+		name string
+		// positions is where each shard was queried from, results what it
+		// returned (at most limit+1 posts) and errs whether it failed
+		positions []*cursorPosition
+		results   [][]Post
+		errs      []error
+		limit     int
+		want      *pageCursor
+	}{
+		{
+			name:      "empty page",
+			positions: []*cursorPosition{nil, nil, nil},
+			results:   [][]Post{nil, nil, nil},
+			errs:      []error{nil, nil, nil},
+			limit:     2,
+		},
+		{
+			name:      "every shard exhausted",
+			positions: []*cursorPosition{nil, nil, nil},
+			results:   [][]Post{{post("a", 5)}, {post("b", 4)}, nil},
+			errs:      []error{nil, nil, nil},
+			limit:     2,
+		},
+		{
+			name:      "one shard has more",
+			positions: []*cursorPosition{nil, nil, nil},
+			results:   [][]Post{{post("a", 5), post("b", 4), post("c", 3)}, {post("d", 1)}, nil},
+			errs:      []error{nil, nil, nil},
+			limit:     2,
+			want: &pageCursor{
+				Last:   *at("b", 4),
+				Shards: map[uint32]*cursorPosition{1: at("b", 4), 2: at("b", 4), 3: nil},
+			},
+		},
+		{
+			name:      "shard left out of the page",
+			positions: []*cursorPosition{nil, nil, nil},
+			results:   [][]Post{{post("a", 5), post("b", 4), post("c", 3)}, {post("d", 1), post("f", 0), post("e", 0)}, nil},
+			errs:      []error{nil, nil, nil},
+			limit:     2,
+			want: &pageCursor{
+				Last:   *at("b", 4),
+				Shards: map[uint32]*cursorPosition{1: at("b", 4), 2: at("b", 4), 3: nil},
+			},
+		},
+		{
+			name:      "failed shard keeps its position",
+			positions: []*cursorPosition{at("x", 9), at("y", 8), nil},
+			results:   [][]Post{{post("a", 5)}, nil, nil},
+			errs:      []error{nil, failed, nil},
+			limit:     2,
+			want: &pageCursor{
+				Last:   *at("a", 5),
+				Shards: map[uint32]*cursorPosition{1: nil, 2: at("y", 8), 3: nil},
+			},
+		},
+		{
+			name:      "failed shard never read",
+			positions: []*cursorPosition{nil, nil, nil},
+			results:   [][]Post{{post("a", 5)}, nil, nil},
+			errs:      []error{nil, failed, nil},
+			limit:     2,
+			want: &pageCursor{
+				Last:   *at("a", 5),
+				Shards: map[uint32]*cursorPosition{1: nil, 3: nil},
+				Unread: []uint32{2},
+			},
+		},
+		{
+			name:      "every shard failed but one",
+			positions: []*cursorPosition{nil, nil, at("z", 7)},
+			results:   [][]Post{{post("a", 5), post("b", 4), post("c", 3)}, nil, nil},
+			errs:      []error{nil, failed, failed},
+			limit:     2,
+			want: &pageCursor{
+				Last:   *at("b", 4),
+				Shards: map[uint32]*cursorPosition{1: at("b", 4), 3: at("z", 7)},
+				Unread: []uint32{2},
+			},
+		},
+		{
+			name:      "ties on created_at",
+			positions: []*cursorPosition{nil, nil, nil},
+			results:   [][]Post{{post("c", 5), post("a", 5), post("e", 4)}, {post("d", 5), post("b", 5), post("f", 4)}, nil},
+			errs:      []error{nil, nil, nil},
+			limit:     3,
+			want: &pageCursor{
+				Last:   *at("b", 5),
+				Shards: map[uint32]*cursorPosition{1: at("c", 5), 2: at("b", 5), 3: nil},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, taken := mergePosts(tt.results, tt.limit)
+			token := nextPageCursor(shardIDs, tt.positions, tt.results, taken, tt.errs, merged, tt.limit)
+
+			if tt.want == nil {
+				if token != "" {
+					t.Fatalf("nextPageCursor = %q, want no next page", token)
+				}
+				return
+			}
+			got, err := decodeCursor(token)
+			if err != nil {
+				t.Fatalf("decodeCursor(nextPageCursor) failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("next cursor = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
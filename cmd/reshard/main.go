@@ -0,0 +1,1449 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+
+	"social-media-db/internal/dedup"
+	"social-media-db/internal/directory"
+	"social-media-db/internal/events"
+	"social-media-db/internal/feed"
+	"social-media-db/internal/shard"
+	"social-media-db/internal/stats"
+	"social-media-db/internal/writes"
+)
+
+// ShardMap is a complete routing configuration
+type ShardMap struct {
+	VirtualNodes int            `json:"virtual_nodes"`
+	Shards       []shard.Config `json:"shards"`
+}
+
+// Router returns a router for the map over the given pools
+func (m ShardMap) Router(dbs map[uint32]*sql.DB) (*shard.RingRouter, error) {
+	return shard.NewRingRouter(m.Shards, dbs, m.VirtualNodes)
+}
+
+// Move is a user whose rows have to be copied to another shard
+type Move struct {
+	UserID string
+	From   uint32
+	To     uint32
+}
+
+// Topics mirrored while a migration runs
+var topics = []string{"posts", "comments", "likes", "users", "follows"}
+
+// Consumer group whose committed offsets mark what has not been written yet
+const writerGroup = "db-writer-group"
+
+type Resharder struct {
+	masterDB   *sql.DB
+	directory  *directory.Directory
+	decoder    *events.Registry
+	placements shard.Placements
+	feed       feed.Config
+	current    ShardMap
+	target     ShardMap
+	dbPool     map[uint32]*sql.DB
+	logger     *logrus.Logger
+
+	currentRouter shard.Router
+	targetRouter  shard.Router
+}
+
+// NewResharder prepares a migration from the current map to target. A target
+// without shards keeps the current map (used by colocate).
+func NewResharder(target ShardMap, logger *logrus.Logger) (*Resharder, error) {
+	placements, err := shard.LoadPlacements()
+	if err != nil {
+		return nil, err
+	}
+
+	feedConfig, err := feed.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	schemas, err := events.LoadSchemas(getEnv("SCHEMA_REGISTRY", "schemas/registry.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	masterDB, err := shard.OpenMaster()
+	if err != nil {
+		return nil, err
+	}
+
+	configs, err := shard.LoadConfig(masterDB, logger)
+	if err != nil {
+		masterDB.Close()
+		return nil, fmt.Errorf("failed to load shard config: %w", err)
+	}
+
+	current := ShardMap{VirtualNodes: shard.VirtualNodes(), Shards: configs}
+	if len(target.Shards) == 0 {
+		target = current
+	}
+	if target.VirtualNodes == 0 {
+		target.VirtualNodes = current.VirtualNodes
+	}
+	// The shards table has no place for the virtual node count, so services
+	// keep routing with their own SHARD_VIRTUAL_NODES after the switch. Data
+	// moved along another ring would then be looked up in the wrong place.
+	if target.VirtualNodes != current.VirtualNodes {
+		masterDB.Close()
+		return nil, fmt.Errorf("target map has %d virtual nodes but the services use %d (SHARD_VIRTUAL_NODES); resharding cannot change it",
+			target.VirtualNodes, current.VirtualNodes)
+	}
+
+	// Connect to every shard in either map
+	seen := make(map[uint32]bool)
+	var all []shard.Config
+	for _, config := range append(append([]shard.Config(nil), current.Shards...), target.Shards...) {
+		if !seen[config.ID] {
+			seen[config.ID] = true
+			all = append(all, config)
+		}
+	}
+
+	dbPool, err := shard.Connect(all, logger)
+	if err != nil {
+		masterDB.Close()
+		return nil, fmt.Errorf("failed to initialize DB connections: %w", err)
+	}
+
+	currentRouter, err := current.Router(dbPool)
+	if err != nil {
+		closeAll(dbPool)
+		masterDB.Close()
+		return nil, fmt.Errorf("invalid current map: %w", err)
+	}
+	targetRouter, err := target.Router(dbPool)
+	if err != nil {
+		closeAll(dbPool)
+		masterDB.Close()
+		return nil, fmt.Errorf("invalid target map: %w", err)
+	}
+
+	return &Resharder{
+		masterDB:      masterDB,
+		directory:     directory.New(masterDB),
+		decoder:       events.NewRegistry(schemas),
+		placements:    placements,
+		feed:          feedConfig,
+		current:       current,
+		target:        target,
+		dbPool:        dbPool,
+		logger:        logger,
+		currentRouter: currentRouter,
+		targetRouter:  targetRouter,
+	}, nil
+}
+
+func (r *Resharder) Close() {
+	closeAll(r.dbPool)
+	r.masterDB.Close()
+}
+
+func closeAll(dbPool map[uint32]*sql.DB) {
+	for _, db := range dbPool {
+		db.Close()
+	}
+}
+
+// loadTargetMap reads a shard map from a JSON file; ${VAR} references are expanded
+func loadTargetMap(path string) (ShardMap, error) {
+	var target ShardMap
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return target, fmt.Errorf("failed to read target map: %w", err)
+	}
+	if err := json.Unmarshal([]byte(os.ExpandEnv(string(data))), &target); err != nil {
+		return target, fmt.Errorf("failed to parse target map: %w", err)
+	}
+	if len(target.Shards) == 0 {
+		return target, fmt.Errorf("target map has no shards")
+	}
+
+	return target, nil
+}
+
+// Plan finds every user stored on a shard other than the one the target map routes it to
+func (r *Resharder) Plan(ctx context.Context) ([]Move, error) {
+	// Rows placed by post follow the post's author, who is listed in posts
+	query := "SELECT id::text FROM users UNION SELECT user_id FROM posts" +
+		" UNION SELECT follower_id FROM follows UNION SELECT user_id FROM timelines"
+	for _, table := range []string{"comments", "likes"} {
+		if r.placements.For(table) == shard.PlaceByAuthor {
+			query += " UNION SELECT user_id FROM " + table
+		}
+	}
+
+	var moves []Move
+	for _, config := range r.current.Shards {
+		rows, err := r.dbPool[config.ID].QueryContext(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list users on shard %d: %w", config.ID, err)
+		}
+
+		for rows.Next() {
+			var userID string
+			if err := rows.Scan(&userID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan user on shard %d: %w", config.ID, err)
+			}
+			if to := r.targetRouter.ShardFor(userID); to != config.ID {
+				moves = append(moves, Move{UserID: userID, From: config.ID, To: to})
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list users on shard %d: %w", config.ID, err)
+		}
+	}
+
+	return moves, nil
+}
+
+// moveFor reports whether the target map routes a user away from its current shard.
+// This also covers users whose first event arrives while the migration runs.
+func (r *Resharder) moveFor(userID string) (Move, bool) {
+	move := Move{
+		UserID: userID,
+		From:   r.currentRouter.ShardFor(userID),
+		To:     r.targetRouter.ShardFor(userID),
+	}
+	return move, move.From != move.To
+}
+
+// ownedBy returns the condition selecting the rows of a table stored under a
+// user ($1). Rows placed by post, and post counters, belong to the author of
+// their post, which lives on the same shard. users.id is a UUID while other
+// user IDs are free text, so it is compared as text.
+func (r *Resharder) ownedBy(table string) string {
+	switch table {
+	case "users":
+		return "id::text = $1"
+	case "follows":
+		return "follower_id = $1"
+	case "timelines":
+		return "user_id = $1"
+	case "post_stats":
+		return "post_id IN (SELECT id FROM posts WHERE user_id = $1)"
+	}
+	if r.placements.For(table) == shard.PlaceByPost {
+		return "post_id IN (SELECT id FROM posts WHERE user_id = $1)"
+	}
+	return "user_id = $1"
+}
+
+// rowKey returns the column identifying a row among a user's rows of a table
+func rowKey(table string) string {
+	if table == "timelines" || table == "post_stats" {
+		return "post_id"
+	}
+	return "id::text"
+}
+
+// placementKey returns the user whose shard stores a comment or like
+func (r *Resharder) placementKey(ctx context.Context, table, postID, authorID string) (string, error) {
+	if r.placements.For(table) != shard.PlaceByPost {
+		return authorID, nil
+	}
+
+	ownerID, found, err := r.directory.PostOwner(ctx, postID)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("post %s is not in the post directory", postID)
+	}
+	return ownerID, nil
+}
+
+// Sync makes the destination shard hold exactly the source shard's rows for a
+// user and returns the number of rows that had to change.
+func (r *Resharder) Sync(ctx context.Context, move Move) (int, error) {
+	src, dst := r.dbPool[move.From], r.dbPool[move.To]
+
+	tx, err := dst.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction on shard %d: %w", move.To, err)
+	}
+	defer tx.Rollback()
+
+	changed := 0
+	for _, table := range []struct {
+		name    string
+		columns string
+		row     func() []interface{}
+		upsert  string
+	}{
+		{"users", "id, username, email, created_at, updated_at",
+			func() []interface{} {
+				return []interface{}{new(string), new(string), new(string), new(time.Time), new(time.Time)}
+			},
+			`INSERT INTO users (id, username, email, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT (id) DO UPDATE SET username = EXCLUDED.username, email = EXCLUDED.email, updated_at = EXCLUDED.updated_at
+			 WHERE users.username IS DISTINCT FROM EXCLUDED.username OR users.email IS DISTINCT FROM EXCLUDED.email`},
+		{"posts", "id, user_id, content, created_at, updated_at, deleted_at",
+			func() []interface{} {
+				return []interface{}{new(string), new(string), new(string), new(time.Time), new(time.Time), new(sql.NullTime)}
+			},
+			`INSERT INTO posts (id, user_id, content, created_at, updated_at, deleted_at) VALUES ($1, $2, $3, $4, $5, $6)
+			 ON CONFLICT (id) DO UPDATE SET content = EXCLUDED.content, updated_at = EXCLUDED.updated_at, deleted_at = EXCLUDED.deleted_at
+			 WHERE posts.content IS DISTINCT FROM EXCLUDED.content OR posts.deleted_at IS DISTINCT FROM EXCLUDED.deleted_at`},
+		{"comments", "id, post_id, user_id, content, parent_comment_id, created_at, updated_at, deleted_at",
+			func() []interface{} {
+				return []interface{}{new(string), new(string), new(string), new(string), new(sql.NullString), new(time.Time), new(time.Time), new(sql.NullTime)}
+			},
+			`INSERT INTO comments (id, post_id, user_id, content, parent_comment_id, created_at, updated_at, deleted_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			 ON CONFLICT (id) DO UPDATE SET content = EXCLUDED.content, updated_at = EXCLUDED.updated_at, deleted_at = EXCLUDED.deleted_at
+			 WHERE comments.content IS DISTINCT FROM EXCLUDED.content OR comments.deleted_at IS DISTINCT FROM EXCLUDED.deleted_at`},
+		{"likes", "id, post_id, user_id, reaction, created_at",
+			func() []interface{} {
+				return []interface{}{new(string), new(string), new(string), new(string), new(time.Time)}
+			},
+			`INSERT INTO likes (id, post_id, user_id, reaction, created_at) VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT (post_id, user_id) DO UPDATE SET reaction = EXCLUDED.reaction
+			 WHERE likes.reaction <> EXCLUDED.reaction`},
+		{"follows", "id, follower_id, followee_id, created_at",
+			func() []interface{} {
+				return []interface{}{new(string), new(string), new(string), new(time.Time)}
+			},
+			`INSERT INTO follows (id, follower_id, followee_id, created_at) VALUES ($1, $2, $3, $4)
+			 ON CONFLICT DO NOTHING`},
+		{"timelines", "post_id, user_id, author_id, created_at",
+			func() []interface{} {
+				return []interface{}{new(string), new(string), new(string), new(time.Time)}
+			},
+			`INSERT INTO timelines (post_id, user_id, author_id, created_at) VALUES ($1, $2, $3, $4)
+			 ON CONFLICT DO NOTHING`},
+	} {
+		rows, err := src.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE %s", table.columns, table.name, r.ownedBy(table.name)), move.UserID)
+		if err != nil {
+			return changed, fmt.Errorf("failed to read %s from shard %d: %w", table.name, move.From, err)
+		}
+
+		var ids []string
+		for rows.Next() {
+			row := table.row()
+			if err := rows.Scan(row...); err != nil {
+				rows.Close()
+				return changed, fmt.Errorf("failed to scan %s row: %w", table.name, err)
+			}
+			ids = append(ids, *row[0].(*string))
+
+			result, err := tx.ExecContext(ctx, table.upsert, row...)
+			if err != nil {
+				rows.Close()
+				return changed, fmt.Errorf("failed to copy %s row to shard %d: %w", table.name, move.To, err)
+			}
+			n, _ := result.RowsAffected()
+			changed += int(n)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return changed, fmt.Errorf("failed to read %s from shard %d: %w", table.name, move.From, err)
+		}
+
+		// Remove rows that no longer exist on the source (e.g. unliked meanwhile)
+		result, err := tx.ExecContext(ctx,
+			fmt.Sprintf("DELETE FROM %s WHERE %s AND NOT (%s = ANY($2))", table.name, r.ownedBy(table.name), rowKey(table.name)),
+			move.UserID, stringArray(ids))
+		if err != nil {
+			return changed, fmt.Errorf("failed to prune %s on shard %d: %w", table.name, move.To, err)
+		}
+		n, _ := result.RowsAffected()
+		changed += int(n)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return changed, fmt.Errorf("failed to commit copy to shard %d: %w", move.To, err)
+	}
+
+	n, err := r.syncStats(ctx, move)
+	return changed + n, err
+}
+
+// syncStats recounts the counters of a user's posts and writes those that
+// differ to the destination. The source counters are not copied: they may
+// have missed changes, and a recount converges however they drifted.
+func (r *Resharder) syncStats(ctx context.Context, move Move) (int, error) {
+	counts, err := r.recountPosts(ctx, move)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for postID, recounted := range counts {
+		stored, err := stats.Read(ctx, r.dbPool[move.To], postID)
+		if err != nil {
+			return changed, err
+		}
+		if sameCounts(stored, recounted) {
+			continue
+		}
+		if err := stats.Write(ctx, r.dbPool[move.To], postID, recounted); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// verifyStats reports whether the destination counters of a user's posts
+// match a recount of their comments and likes
+func (r *Resharder) verifyStats(ctx context.Context, move Move) (bool, error) {
+	counts, err := r.recountPosts(ctx, move)
+	if err != nil {
+		return false, err
+	}
+
+	for postID, recounted := range counts {
+		stored, err := stats.Read(ctx, r.dbPool[move.To], postID)
+		if err != nil {
+			return false, err
+		}
+		if !sameCounts(stored, recounted) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// recountPosts counts the comments and reactions of the posts a user has on
+// the source shard. They may be stored on any shard of either map, and rows
+// of moving users are on two shards at once, so every shard is read and rows
+// are told apart by their key. A comment deleted on either copy is deleted.
+func (r *Resharder) recountPosts(ctx context.Context, move Move) (map[string]stats.Counts, error) {
+	rows, err := r.dbPool[move.From].QueryContext(ctx, "SELECT id::text FROM posts WHERE user_id = $1", move.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list posts of %s on shard %d: %w", move.UserID, move.From, err)
+	}
+	var postIDs []string
+	for rows.Next() {
+		var postID string
+		if err := rows.Scan(&postID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan post on shard %d: %w", move.From, err)
+		}
+		postIDs = append(postIDs, postID)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list posts of %s on shard %d: %w", move.UserID, move.From, err)
+	}
+	if len(postIDs) == 0 {
+		return nil, nil
+	}
+
+	type comment struct {
+		postID  string
+		deleted bool
+	}
+	type like struct{ postID, userID string }
+	comments := make(map[string]comment)
+	reactions := make(map[like]string)
+
+	for shardID, db := range r.dbPool {
+		for _, count := range []struct {
+			what  string
+			query string
+			add   func(rows *sql.Rows) error
+		}{
+			{"comments", "SELECT id::text, post_id::text, deleted_at IS NOT NULL FROM comments WHERE post_id::text = ANY($1)", func(rows *sql.Rows) error {
+				var id string
+				var c comment
+				if err := rows.Scan(&id, &c.postID, &c.deleted); err != nil {
+					return err
+				}
+				c.deleted = c.deleted || comments[id].deleted
+				comments[id] = c
+				return nil
+			}},
+			{"likes", "SELECT post_id::text, user_id, reaction FROM likes WHERE post_id::text = ANY($1)", func(rows *sql.Rows) error {
+				var l like
+				var reaction string
+				if err := rows.Scan(&l.postID, &l.userID, &reaction); err != nil {
+					return err
+				}
+				reactions[l] = reaction
+				return nil
+			}},
+		} {
+			rows, err := db.QueryContext(ctx, count.query, stringArray(postIDs))
+			if err != nil {
+				return nil, fmt.Errorf("failed to count %s on shard %d: %w", count.what, shardID, err)
+			}
+			for rows.Next() {
+				if err := count.add(rows); err != nil {
+					rows.Close()
+					return nil, fmt.Errorf("failed to scan %s on shard %d: %w", count.what, shardID, err)
+				}
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to count %s on shard %d: %w", count.what, shardID, err)
+			}
+		}
+	}
+
+	counts := make(map[string]stats.Counts, len(postIDs))
+	for _, postID := range postIDs {
+		counts[postID] = stats.Counts{Reactions: make(map[string]int)}
+	}
+	for _, c := range comments {
+		if !c.deleted {
+			counted := counts[c.postID]
+			counted.Comments++
+			counts[c.postID] = counted
+		}
+	}
+	for l, reaction := range reactions {
+		counted := counts[l.postID]
+		counted.Likes++
+		counted.Reactions[reaction]++
+		counts[l.postID] = counted
+	}
+	return counts, nil
+}
+
+// sameCounts reports whether two sets of counters are equal
+func sameCounts(a, b stats.Counts) bool {
+	if a.Comments != b.Comments || a.Likes != b.Likes || len(a.Reactions) != len(b.Reactions) {
+		return false
+	}
+	for reaction, n := range a.Reactions {
+		if b.Reactions[reaction] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify compares row counts and IDs of a user on the source and destination,
+// and the destination counters of the user's posts with a recount
+func (r *Resharder) Verify(ctx context.Context, move Move) (bool, error) {
+	for _, table := range []string{"users", "posts", "comments", "likes", "follows", "timelines"} {
+		key := rowKey(table)
+		query := fmt.Sprintf("SELECT COALESCE(string_agg(%s, ',' ORDER BY %s), '') FROM %s WHERE %s", key, key, table, r.ownedBy(table))
+
+		var srcIDs, dstIDs string
+		if err := r.dbPool[move.From].QueryRowContext(ctx, query, move.UserID).Scan(&srcIDs); err != nil {
+			return false, fmt.Errorf("failed to verify %s on shard %d: %w", table, move.From, err)
+		}
+		if err := r.dbPool[move.To].QueryRowContext(ctx, query, move.UserID).Scan(&dstIDs); err != nil {
+			return false, fmt.Errorf("failed to verify %s on shard %d: %w", table, move.To, err)
+		}
+		if srcIDs != dstIDs {
+			return false, nil
+		}
+	}
+	return r.verifyStats(ctx, move)
+}
+
+// Switch atomically replaces the shard map in the master DB with the target map
+func (r *Resharder) Switch(ctx context.Context) error {
+	tx, err := r.masterDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction on master DB: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Serialize with any other writer of the shard map
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE shards IN EXCLUSIVE MODE"); err != nil {
+		return fmt.Errorf("failed to lock shards table: %w", err)
+	}
+
+	ids := make([]string, 0, len(r.target.Shards))
+	for _, config := range r.target.Shards {
+		ids = append(ids, strconv.FormatUint(uint64(config.ID), 10))
+
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO shards (shard_id, host, port, db_name, username, password, weight)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (shard_id) DO UPDATE SET
+				host = EXCLUDED.host, port = EXCLUDED.port, db_name = EXCLUDED.db_name,
+				username = EXCLUDED.username, password = EXCLUDED.password, weight = EXCLUDED.weight`,
+			config.ID, config.Host, config.Port, config.Database, config.Username, config.Password, config.Weight)
+		if err != nil {
+			return fmt.Errorf("failed to write shard %d: %w", config.ID, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM shards WHERE NOT (shard_id::text = ANY($1))", stringArray(ids)); err != nil {
+		return fmt.Errorf("failed to remove old shards: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit shard map: %w", err)
+	}
+
+	return nil
+}
+
+// Cleanup deletes a moved user's rows from the source shard
+func (r *Resharder) Cleanup(ctx context.Context, move Move) error {
+	tx, err := r.dbPool[move.From].BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction on shard %d: %w", move.From, err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"timelines", "follows", "likes", "comments", "post_stats", "posts", "users"} {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s", table, r.ownedBy(table)), move.UserID); err != nil {
+			return fmt.Errorf("failed to delete %s from shard %d: %w", table, move.From, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RecountStats rebuilds post_stats from the comments and likes on every shard,
+// e.g. for posts created before the counters existed. Recorded counter changes
+// are marked applied, as the recount already includes them, so run it while
+// the consumers are stopped. It returns the number of posts counted.
+func (r *Resharder) RecountStats(ctx context.Context) (int, error) {
+	postShards := make(map[string]uint32)
+	counts := make(map[string]*stats.Counts)
+	countsOf := func(postID string) *stats.Counts {
+		if counts[postID] == nil {
+			counts[postID] = &stats.Counts{Reactions: make(map[string]int)}
+		}
+		return counts[postID]
+	}
+
+	for _, config := range r.current.Shards {
+		db := r.dbPool[config.ID]
+
+		if _, err := db.ExecContext(ctx, "UPDATE post_stats_events SET applied = true WHERE NOT applied"); err != nil {
+			return 0, fmt.Errorf("failed to settle counter changes on shard %d: %w", config.ID, err)
+		}
+
+		for _, count := range []struct {
+			what  string
+			query string
+			add   func(rows *sql.Rows) error
+		}{
+			{"posts", "SELECT id FROM posts", func(rows *sql.Rows) error {
+				var postID string
+				if err := rows.Scan(&postID); err != nil {
+					return err
+				}
+				postShards[postID] = config.ID
+				return nil
+			}},
+			{"comments", "SELECT post_id, COUNT(*) FROM comments WHERE deleted_at IS NULL GROUP BY post_id", func(rows *sql.Rows) error {
+				var postID string
+				var n int
+				if err := rows.Scan(&postID, &n); err != nil {
+					return err
+				}
+				countsOf(postID).Comments += n
+				return nil
+			}},
+			{"likes", "SELECT post_id, reaction, COUNT(*) FROM likes GROUP BY post_id, reaction", func(rows *sql.Rows) error {
+				var postID, reaction string
+				var n int
+				if err := rows.Scan(&postID, &reaction, &n); err != nil {
+					return err
+				}
+				c := countsOf(postID)
+				c.Likes += n
+				c.Reactions[reaction] += n
+				return nil
+			}},
+		} {
+			rows, err := db.QueryContext(ctx, count.query)
+			if err != nil {
+				return 0, fmt.Errorf("failed to count %s on shard %d: %w", count.what, config.ID, err)
+			}
+			for rows.Next() {
+				if err := count.add(rows); err != nil {
+					rows.Close()
+					return 0, fmt.Errorf("failed to scan %s count on shard %d: %w", count.what, config.ID, err)
+				}
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return 0, fmt.Errorf("failed to count %s on shard %d: %w", count.what, config.ID, err)
+			}
+		}
+	}
+
+	for postID, shardID := range postShards {
+		c := countsOf(postID)
+		if err := stats.Write(ctx, r.dbPool[shardID], postID, *c); err != nil {
+			return 0, err
+		}
+	}
+	return len(postShards), nil
+}
+
+// Colocation is the outcome of moving one table's rows to the shard their
+// placement requires
+type Colocation struct {
+	Table   string
+	Moved   int
+	Skipped int // rows whose post is unknown, left in place
+}
+
+// BackfillDirectory registers every stored post and participant in the post
+// directory, including rows written before the directory existed, and returns
+// the owner of every post. Comments written before threading are registered
+// as top-level comments; replies are registered by the consumer.
+func (r *Resharder) BackfillDirectory(ctx context.Context) (map[string]string, error) {
+	owners := make(map[string]string)
+	for _, config := range r.current.Shards {
+		db := r.dbPool[config.ID]
+
+		rows, err := db.QueryContext(ctx, "SELECT id, user_id FROM posts")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list posts on shard %d: %w", config.ID, err)
+		}
+		for rows.Next() {
+			var postID, userID string
+			if err := rows.Scan(&postID, &userID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan post on shard %d: %w", config.ID, err)
+			}
+			owners[postID] = userID
+			if err := r.directory.RegisterPost(ctx, postID, userID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list posts on shard %d: %w", config.ID, err)
+		}
+
+		rows, err = db.QueryContext(ctx, "SELECT post_id, user_id FROM comments UNION SELECT post_id, user_id FROM likes")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list participants on shard %d: %w", config.ID, err)
+		}
+		for rows.Next() {
+			var postID, userID string
+			if err := rows.Scan(&postID, &userID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan participant on shard %d: %w", config.ID, err)
+			}
+			if err := r.directory.AddParticipant(ctx, postID, userID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list participants on shard %d: %w", config.ID, err)
+		}
+
+		rows, err = db.QueryContext(ctx, "SELECT id, post_id FROM comments WHERE parent_comment_id IS NULL")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list comments on shard %d: %w", config.ID, err)
+		}
+		for rows.Next() {
+			var entry directory.CommentEntry
+			if err := rows.Scan(&entry.CommentID, &entry.PostID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan comment on shard %d: %w", config.ID, err)
+			}
+			if err := r.directory.RegisterComment(ctx, entry); err != nil {
+				rows.Close()
+				return nil, err
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list comments on shard %d: %w", config.ID, err)
+		}
+	}
+
+	return owners, nil
+}
+
+// Colocate moves comments and likes to the shard their configured placement
+// routes them to under the current map. Each row is copied before it is
+// deleted from its old shard, so an interrupted run can simply be repeated.
+func (r *Resharder) Colocate(ctx context.Context, owners map[string]string, dryRun bool) ([]Colocation, error) {
+	var results []Colocation
+	for _, table := range []struct {
+		name    string
+		columns string
+		row     func() []interface{}
+		insert  string
+	}{
+		{"comments", "id, post_id, user_id, content, parent_comment_id, created_at, updated_at, deleted_at",
+			func() []interface{} {
+				return []interface{}{new(string), new(string), new(string), new(string), new(sql.NullString), new(time.Time), new(time.Time), new(sql.NullTime)}
+			},
+			`INSERT INTO comments (id, post_id, user_id, content, parent_comment_id, created_at, updated_at, deleted_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			 ON CONFLICT (id) DO NOTHING`},
+		{"likes", "id, post_id, user_id, reaction, created_at",
+			func() []interface{} {
+				return []interface{}{new(string), new(string), new(string), new(string), new(time.Time)}
+			},
+			`INSERT INTO likes (id, post_id, user_id, reaction, created_at) VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT DO NOTHING`},
+	} {
+		result := Colocation{Table: table.name}
+		placement := r.placements.For(table.name)
+
+		for _, config := range r.current.Shards {
+			src := r.dbPool[config.ID]
+
+			// Collect first: rows are deleted from this shard while moving
+			rows, err := src.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", table.columns, table.name))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s from shard %d: %w", table.name, config.ID, err)
+			}
+			var moving [][]interface{}
+			var targets []uint32
+			for rows.Next() {
+				row := table.row()
+				if err := rows.Scan(row...); err != nil {
+					rows.Close()
+					return nil, fmt.Errorf("failed to scan %s row: %w", table.name, err)
+				}
+
+				key := *row[2].(*string)
+				if placement == shard.PlaceByPost {
+					owner, ok := owners[*row[1].(*string)]
+					if !ok {
+						result.Skipped++
+						continue
+					}
+					key = owner
+				}
+
+				if to := r.currentRouter.ShardFor(key); to != config.ID {
+					moving = append(moving, row)
+					targets = append(targets, to)
+				}
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s from shard %d: %w", table.name, config.ID, err)
+			}
+
+			for i, row := range moving {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if dryRun {
+					result.Moved++
+					continue
+				}
+
+				to := targets[i]
+				if _, err := r.dbPool[to].ExecContext(ctx, table.insert, row...); err != nil {
+					return nil, fmt.Errorf("failed to copy %s row to shard %d: %w", table.name, to, err)
+				}
+				if _, err := src.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = $1", table.name), row[0]); err != nil {
+					return nil, fmt.Errorf("failed to delete %s row from shard %d: %w", table.name, config.ID, err)
+				}
+				result.Moved++
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// Mirror applies events for moving users to their destination shard (the dual
+// write) until ctx is cancelled. It starts from the writer group's committed
+// offsets, so anything the consumer has not yet committed is mirrored too.
+func (r *Resharder) Mirror(ctx context.Context, ready chan<- error) {
+	kafkaServers := strings.Split(getEnv("KAFKA_BOOTSTRAP_SERVERS", "localhost:9092"), ",")
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_6_0_0
+
+	client, err := sarama.NewClient(kafkaServers, config)
+	if err != nil {
+		ready <- fmt.Errorf("failed to connect to Kafka: %w", err)
+		return
+	}
+	defer client.Close()
+
+	offsets, err := committedOffsets(client)
+	if err != nil {
+		ready <- err
+		return
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		ready <- fmt.Errorf("failed to create consumer: %w", err)
+		return
+	}
+	defer consumer.Close()
+
+	var wg sync.WaitGroup
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			pc, err := consumer.ConsumePartition(topic, partition, offset)
+			if err != nil {
+				ready <- fmt.Errorf("failed to consume %s/%d: %w", topic, partition, err)
+				return
+			}
+
+			wg.Add(1)
+			go func(pc sarama.PartitionConsumer) {
+				defer wg.Done()
+				defer pc.Close()
+
+				for {
+					select {
+					case message, ok := <-pc.Messages():
+						if !ok {
+							return
+						}
+						r.mirrorMessage(ctx, message)
+					case <-ctx.Done():
+						return
+					}
+				}
+			}(pc)
+		}
+	}
+
+	r.logger.Info("Dual writes to destination shards started")
+	ready <- nil
+
+	wg.Wait()
+}
+
+func committedOffsets(client sarama.Client) (map[string]map[int32]int64, error) {
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cluster admin: %w", err)
+	}
+
+	partitions := make(map[string][]int32)
+	for _, topic := range topics {
+		ids, err := client.Partitions(topic)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list partitions of %s: %w", topic, err)
+		}
+		partitions[topic] = ids
+	}
+
+	response, err := admin.ListConsumerGroupOffsets(writerGroup, partitions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch offsets of %s: %w", writerGroup, err)
+	}
+
+	offsets := make(map[string]map[int32]int64)
+	for topic, ids := range partitions {
+		offsets[topic] = make(map[int32]int64)
+		for _, partition := range ids {
+			offset := sarama.OffsetOldest
+			if block := response.GetBlock(topic, partition); block != nil && block.Offset >= 0 {
+				offset = block.Offset
+			}
+			offsets[topic][partition] = offset
+		}
+	}
+
+	return offsets, nil
+}
+
+func (r *Resharder) mirrorMessage(ctx context.Context, message *sarama.ConsumerMessage) {
+	var contentType string
+	for _, header := range message.Headers {
+		if header != nil && string(header.Key) == events.HeaderContentType {
+			contentType = string(header.Value)
+		}
+	}
+	envelope, err := r.decoder.Decode(message.Topic, contentType, message.Value)
+
+	// Each case finds the user whose shard stores the event and the writes to
+	// make there, as the consumer would make them
+	var userID string
+	var write func(tx *sql.Tx) error
+	counted := false
+	switch envelope.EventType {
+	case events.TypePostCreated:
+		var event events.Post
+		if err = envelope.Unmarshal(&event); err == nil {
+			userID = event.UserID
+			write = func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `INSERT INTO posts (id, user_id, content, created_at, updated_at)
+					VALUES ($1, $2, $3, $4, $4) ON CONFLICT (id) DO NOTHING`,
+					event.ID, event.UserID, event.Content, event.Timestamp)
+				return err
+			}
+			if r.feed.Mode == feed.FanOutOnWrite {
+				err = r.mirrorFanOut(ctx, event)
+			}
+		}
+	case events.TypePostUpdated:
+		var event events.PostUpdated
+		if err = envelope.Unmarshal(&event); err == nil {
+			userID = event.UserID
+			write = func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `UPDATE posts SET content = $1
+					WHERE id = $2 AND user_id = $3 AND deleted_at IS NULL`,
+					event.Content, event.ID, event.UserID)
+				return err
+			}
+		}
+	case events.TypePostDeleted:
+		var event events.PostDeleted
+		if err = envelope.Unmarshal(&event); err == nil {
+			userID = event.UserID
+			write = func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `UPDATE posts SET deleted_at = $1
+					WHERE id = $2 AND user_id = $3 AND deleted_at IS NULL`,
+					event.Timestamp, event.ID, event.UserID)
+				return err
+			}
+		}
+	case events.TypeCommentCreated:
+		var event events.Comment
+		if err = envelope.Unmarshal(&event); err == nil {
+			userID, err = r.placementKey(ctx, "comments", event.PostID, event.UserID)
+			write = stats.Counted(ctx, envelope.EventID, event.PostID, func(tx *sql.Tx) (stats.Delta, error) {
+				return writes.InsertComment(ctx, tx, event)
+			})
+			counted = true
+		}
+	case events.TypeCommentUpdated:
+		var event events.CommentUpdated
+		if err = envelope.Unmarshal(&event); err == nil {
+			userID, err = r.placementKey(ctx, "comments", event.PostID, event.UserID)
+			write = func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `UPDATE comments SET content = $1
+					WHERE id = $2 AND post_id = $3 AND user_id = $4 AND deleted_at IS NULL`,
+					event.Content, event.ID, event.PostID, event.UserID)
+				return err
+			}
+		}
+	case events.TypeCommentDeleted:
+		var event events.CommentDeleted
+		if err = envelope.Unmarshal(&event); err == nil {
+			userID, err = r.placementKey(ctx, "comments", event.PostID, event.UserID)
+			write = stats.Counted(ctx, envelope.EventID, event.PostID, func(tx *sql.Tx) (stats.Delta, error) {
+				return writes.DeleteComment(ctx, tx, event)
+			})
+			counted = true
+		}
+	case events.TypeLikeChanged:
+		var event events.Like
+		if err = envelope.Unmarshal(&event); err == nil {
+			userID, err = r.placementKey(ctx, "likes", event.PostID, event.UserID)
+			counted = true
+			switch event.Action {
+			case "like":
+				write = stats.Counted(ctx, envelope.EventID, event.PostID, func(tx *sql.Tx) (stats.Delta, error) {
+					return writes.SetReaction(ctx, tx, event)
+				})
+			case "unlike":
+				write = stats.Counted(ctx, envelope.EventID, event.PostID, func(tx *sql.Tx) (stats.Delta, error) {
+					return writes.RemoveReaction(ctx, tx, event)
+				})
+			}
+		}
+	case events.TypeFollowChanged:
+		var event events.Follow
+		if err = envelope.Unmarshal(&event); err == nil {
+			userID = event.FollowerID
+			switch event.Action {
+			case "follow":
+				write = func(tx *sql.Tx) error {
+					_, err := tx.ExecContext(ctx, `INSERT INTO follows (id, follower_id, followee_id, created_at)
+						VALUES ($1, $2, $3, $4) ON CONFLICT (follower_id, followee_id) DO NOTHING`,
+						event.ID, event.FollowerID, event.FolloweeID, event.Timestamp)
+					if err == nil && r.feed.Mode == feed.FanOutOnWrite {
+						authorDB := r.dbPool[r.currentRouter.ShardFor(event.FolloweeID)]
+						err = feed.Backfill(ctx, authorDB, tx, event.FollowerID, event.FolloweeID, r.feed.Backfill)
+					}
+					return err
+				}
+			case "unfollow":
+				write = func(tx *sql.Tx) error {
+					_, err := tx.ExecContext(ctx, `DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2`,
+						event.FollowerID, event.FolloweeID)
+					if err == nil {
+						err = feed.Remove(ctx, tx, event.FollowerID, event.FolloweeID)
+					}
+					return err
+				}
+			}
+		}
+	case events.TypeUserCreated:
+		var event events.UserCreated
+		if err = envelope.Unmarshal(&event); err == nil {
+			userID = event.ID
+			write = func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `INSERT INTO users (id, username, email, created_at, updated_at)
+					VALUES ($1, $2, $3, $4, $4) ON CONFLICT (id) DO NOTHING`,
+					event.ID, event.Username, event.Email, event.Timestamp)
+				return err
+			}
+		}
+	case events.TypeUserUpdated:
+		var event events.UserUpdated
+		if err = envelope.Unmarshal(&event); err == nil {
+			userID = event.ID
+			write = func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `UPDATE users SET username = COALESCE(NULLIF($2, ''), username),
+					email = COALESCE(NULLIF($3, ''), email) WHERE id = $1`,
+					event.ID, event.Username, event.Email)
+				return err
+			}
+		}
+	}
+
+	// The writes, their counter changes and the event's processed_events row
+	// commit together on the destination, so after the switch the consumer
+	// skips the event there but still applies its counter change
+	if err == nil && write != nil {
+		if move, ok := r.moveFor(userID); ok {
+			_, err = dedup.WriteOnce(ctx, r.dbPool[move.To], envelope.EventID, envelope.EventType, write)
+			if err == nil && counted {
+				err = r.mirrorStats(ctx, r.dbPool[move.To], envelope.EventID)
+			}
+		}
+	}
+
+	if err != nil && ctx.Err() == nil {
+		// The verification pass re-syncs the user, so a failed mirror write is not fatal
+		r.logger.WithError(err).WithFields(logrus.Fields{
+			"topic":     message.Topic,
+			"partition": message.Partition,
+			"offset":    message.Offset,
+			"user_id":   userID,
+		}).Warn("Failed to mirror event")
+	}
+}
+
+// mirrorStats applies the counter change of a mirrored comment or like to the
+// destination counters of its post when the post moves too. Sync rewrites
+// those counters from a recount, so they only miss changes made after it,
+// which are the ones mirrored here. Counters of posts that stay are kept by
+// the consumer, so the change is left pending for it.
+func (r *Resharder) mirrorStats(ctx context.Context, rowDB *sql.DB, eventID string) error {
+	return stats.Apply(ctx, rowDB, eventID, func(postID string) (*sql.DB, error) {
+		ownerID, found, err := r.directory.PostOwner(ctx, postID)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("post %s is not in the post directory", postID)
+		}
+		move, ok := r.moveFor(ownerID)
+		if !ok {
+			return nil, nil
+		}
+		return r.dbPool[move.To], nil
+	})
+}
+
+// mirrorFanOut adds a new post to the destination timelines of moving
+// followers. Followers are read from the current shards, which still hold
+// every follow until cleanup.
+func (r *Resharder) mirrorFanOut(ctx context.Context, event events.Post) error {
+	followers, err := feed.Followers(ctx, r.currentRouter, event.UserID)
+	if err != nil {
+		return err
+	}
+
+	entry := feed.Entry{PostID: event.ID, AuthorID: event.UserID, CreatedAt: event.Timestamp}
+	moving := make(map[uint32][]string)
+	for _, followerID := range followers {
+		if move, ok := r.moveFor(followerID); ok {
+			moving[move.To] = append(moving[move.To], followerID)
+		}
+	}
+	for shardID, followerIDs := range moving {
+		if err := feed.FanOut(ctx, r.dbPool[shardID], followerIDs, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commands
+
+func printPlan(current, target ShardMap, moves []Move) {
+	counts := make(map[[2]uint32]int)
+	for _, move := range moves {
+		counts[[2]uint32{move.From, move.To}]++
+	}
+
+	keys := make([][2]uint32, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] == keys[j][0] {
+			return keys[i][1] < keys[j][1]
+		}
+		return keys[i][0] < keys[j][0]
+	})
+
+	fmt.Printf("Current map: %d shard(s), %d virtual nodes\n", len(current.Shards), current.VirtualNodes)
+	fmt.Printf("Target map:  %d shard(s), %d virtual nodes\n", len(target.Shards), target.VirtualNodes)
+	for _, key := range keys {
+		fmt.Printf("  shard %d -> shard %d: %d user(s)\n", key[0], key[1], counts[key])
+	}
+	fmt.Printf("%d user(s) to move\n", len(moves))
+}
+
+func runPlan(ctx context.Context, r *Resharder) error {
+	moves, err := r.Plan(ctx)
+	if err != nil {
+		return err
+	}
+	printPlan(r.current, r.target, moves)
+	return nil
+}
+
+func runMigration(ctx context.Context, r *Resharder, maxPasses int, drain time.Duration, cleanup bool) error {
+	// Start dual writes before planning and copying so no event falls between them
+	mirrorCtx, stopMirror := context.WithCancel(ctx)
+	defer stopMirror()
+
+	ready := make(chan error, 1)
+	mirrorDone := make(chan struct{})
+	go func() {
+		defer close(mirrorDone)
+		r.Mirror(mirrorCtx, ready)
+	}()
+	if err := <-ready; err != nil {
+		return err
+	}
+
+	moves, err := r.Plan(ctx)
+	if err != nil {
+		return err
+	}
+	printPlan(r.current, r.target, moves)
+
+	// Copy, then keep re-syncing until every user verifies
+	pending := moves
+	for pass := 1; len(pending) > 0; pass++ {
+		if pass > maxPasses {
+			return fmt.Errorf("%d user(s) still differ after %d passes; shard map left unchanged", len(pending), maxPasses)
+		}
+
+		var unverified []Move
+		for i, move := range pending {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if _, err := r.Sync(ctx, move); err != nil {
+				return fmt.Errorf("failed to copy user %s: %w", move.UserID, err)
+			}
+
+			ok, err := r.Verify(ctx, move)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				unverified = append(unverified, move)
+			}
+
+			if (i+1)%1000 == 0 {
+				r.logger.WithFields(logrus.Fields{"pass": pass, "users": i + 1, "total": len(pending)}).Info("Copy progress")
+			}
+		}
+
+		r.logger.WithFields(logrus.Fields{
+			"pass":       pass,
+			"copied":     len(pending),
+			"unverified": len(unverified),
+		}).Info("Copy pass completed")
+		pending = unverified
+	}
+
+	if err := r.Switch(ctx); err != nil {
+		return err
+	}
+	r.logger.Info("Shard map switched to target")
+
+	// Services still routing with the old map keep writing to the source
+	// shards; keep mirroring those writes while they pick up the new map.
+	r.logger.WithField("drain", drain.String()).Info("Mirroring writes while services reload the shard map")
+	select {
+	case <-time.After(drain):
+	case <-ctx.Done():
+	}
+	stopMirror()
+	<-mirrorDone
+
+	if cleanup {
+		for _, move := range moves {
+			if err := r.Cleanup(context.Background(), move); err != nil {
+				return fmt.Errorf("failed to clean up user %s: %w", move.UserID, err)
+			}
+		}
+		r.logger.WithField("users", len(moves)).Info("Moved rows removed from source shards")
+	}
+
+	fmt.Printf("Migration completed: %d user(s) moved\n", len(moves))
+	return nil
+}
+
+func runColocate(ctx context.Context, r *Resharder, dryRun bool) error {
+	owners, err := r.BackfillDirectory(ctx)
+	if err != nil {
+		return err
+	}
+	r.logger.WithField("posts", len(owners)).Info("Post directory backfilled")
+
+	results, err := r.Colocate(ctx, owners, dryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "moved"
+	if dryRun {
+		verb = "to move"
+	}
+	for _, result := range results {
+		fmt.Printf("%s (placed by %s): %d row(s) %s, %d row(s) skipped (unknown post)\n",
+			result.Table, r.placements.For(result.Table), result.Moved, verb, result.Skipped)
+	}
+	return nil
+}
+
+func runRecountStats(ctx context.Context, r *Resharder) error {
+	posts, err := r.RecountStats(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Counters rebuilt for %d post(s)\n", posts)
+	return nil
+}
+
+// stringArray formats a Postgres text[] literal
+func stringArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: reshard <command> [-target <file>] [flags]
+
+Commands:
+  plan      Show which users move between shards under the target map
+  run       Copy moving users, verify, and switch the master shard map
+  colocate  Backfill the post directory and move comments and likes to the shard
+            their COMMENT_PLACEMENT / LIKE_PLACEMENT routes them to (no -target)
+  stats     Rebuild post_stats from the stored comments and likes; run it with the
+            consumers stopped (no -target)
+
+The target map is a JSON file:
+  {"virtual_nodes": 160, "shards": [{"id": 0, "host": "pg_shard_0", "port": 5432,
+    "db_name": "posts", "username": "postgres", "password": "${PG_SHARD_PASS}", "weight": 1}]}
+virtual_nodes is optional and must match SHARD_VIRTUAL_NODES.
+`)
+}
+
+func main() {
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	if err := godotenv.Load(); err != nil {
+		logger.Warn("No .env file found")
+	}
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	command := os.Args[1]
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	targetPath := fs.String("target", "", "path to the target shard map (JSON)")
+	maxPasses := fs.Int("max-passes", 5, "copy passes before giving up on convergence")
+	drain := fs.Duration("drain", 2*time.Minute, "how long to keep dual writes running after the switch")
+	cleanup := fs.Bool("cleanup", false, "delete moved rows from the source shards afterwards")
+	dryRun := fs.Bool("dry-run", false, "colocate: only count the rows that would move")
+	fs.Parse(os.Args[2:])
+
+	if command != "plan" && command != "run" && command != "colocate" && command != "stats" {
+		usage()
+		os.Exit(2)
+	}
+
+	var target ShardMap
+	if command == "plan" || command == "run" {
+		if *targetPath == "" {
+			logger.Fatal("-target is required")
+		}
+
+		var err error
+		target, err = loadTargetMap(*targetPath)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load target map")
+		}
+	}
+
+	resharder, err := NewResharder(target, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to create resharder")
+	}
+	defer resharder.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	switch command {
+	case "plan":
+		err = runPlan(ctx, resharder)
+	case "colocate":
+		err = runColocate(ctx, resharder, *dryRun)
+	case "stats":
+		err = runRecountStats(ctx, resharder)
+	default:
+		err = runMigration(ctx, resharder, *maxPasses, *drain, *cleanup)
+	}
+
+	if err != nil {
+		logger.WithError(err).Fatal("Resharding failed")
+	}
+}
@@ -0,0 +1,76 @@
+// Package dedup remembers which events a shard has processed. The consumer
+// records an event in processed_events in the same transaction as its writes,
+// so the writes and the record commit together. A message delivered again
+// (after a rebalance, a restart before its offset was committed or a replay
+// from the DLQ) finds the record and is skipped, even when an event that came
+// after it has changed the same rows since.
+package dedup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Execer is a *sql.Tx, or a *sql.DB for writes made outside a transaction
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Claim records an event as processed. It returns false when the event was
+// already recorded and its writes must be skipped. A concurrent claim of the
+// same event waits for the first transaction and then returns false. Events
+// without an ID cannot be recognised and are always claimed.
+func Claim(ctx context.Context, q Execer, eventID, eventType string) (bool, error) {
+	if eventID == "" {
+		return true, nil
+	}
+
+	result, err := q.ExecContext(ctx,
+		`INSERT INTO processed_events (event_id, event_type) VALUES ($1, $2)
+		 ON CONFLICT (event_id) DO NOTHING`,
+		eventID, eventType)
+	if err != nil {
+		return false, fmt.Errorf("failed to record event %s as processed: %w", eventID, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record event %s as processed: %w", eventID, err)
+	}
+	return n == 1, nil
+}
+
+// WriteOnce runs write in a transaction on db that also claims the event, so
+// the writes and the claim commit together. It returns false without calling
+// write when db has already processed the event. An error from write rolls
+// the transaction back and is returned as is.
+func WriteOnce(ctx context.Context, db *sql.DB, eventID, eventType string, write func(tx *sql.Tx) error) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	first, err := Claim(ctx, tx, eventID, eventType)
+	if err != nil || !first {
+		return false, err
+	}
+	if err := write(tx); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit event %s: %w", eventID, err)
+	}
+	return true, nil
+}
+
+// Prune forgets the events processed before a time and returns how many it
+// forgot. Keep them for as long as Kafka may deliver the event again.
+func Prune(ctx context.Context, db *sql.DB, before time.Time) (int64, error) {
+	result, err := db.ExecContext(ctx, `DELETE FROM processed_events WHERE processed_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune processed events: %w", err)
+	}
+	return result.RowsAffected()
+}
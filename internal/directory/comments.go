@@ -0,0 +1,46 @@
+package directory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// CommentEntry is the thread position of a comment
+type CommentEntry struct {
+	CommentID       string
+	PostID          string
+	ParentCommentID string // empty for top-level comments
+	Depth           int
+}
+
+// RegisterComment records the thread position of a comment. Registering the
+// same comment again is a no-op.
+func (d *Directory) RegisterComment(ctx context.Context, entry CommentEntry) error {
+	_, err := d.db.ExecContext(ctx,
+		`INSERT INTO comment_directory (comment_id, post_id, parent_comment_id, depth)
+		 VALUES ($1, $2, NULLIF($3, ''), $4)
+		 ON CONFLICT (comment_id) DO NOTHING`,
+		entry.CommentID, entry.PostID, entry.ParentCommentID, entry.Depth)
+	if err != nil {
+		return fmt.Errorf("failed to register comment %s: %w", entry.CommentID, err)
+	}
+	return nil
+}
+
+// Comment returns the thread position of a comment; found is false for
+// comments the directory does not know about
+func (d *Directory) Comment(ctx context.Context, commentID string) (entry CommentEntry, found bool, err error) {
+	var parentID sql.NullString
+	err = d.db.QueryRowContext(ctx,
+		`SELECT comment_id, post_id, parent_comment_id, depth FROM comment_directory WHERE comment_id = $1`,
+		commentID).Scan(&entry.CommentID, &entry.PostID, &parentID, &entry.Depth)
+	if err == sql.ErrNoRows {
+		return CommentEntry{}, false, nil
+	}
+	if err != nil {
+		return CommentEntry{}, false, fmt.Errorf("failed to look up comment %s: %w", commentID, err)
+	}
+	entry.ParentCommentID = parentID.String
+	return entry, true, nil
+}
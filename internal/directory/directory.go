@@ -0,0 +1,78 @@
+// Package directory keeps the post, comment and user directories in the master
+// database. The post directory maps a post to the user that owns it and to the
+// users that commented on or liked it. Readers resolve those user IDs to shards
+// with the router, so the directory stays valid across resharding.
+package directory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Directory reads and writes the post, comment and user directories
+type Directory struct {
+	db *sql.DB
+}
+
+func New(db *sql.DB) *Directory {
+	return &Directory{db: db}
+}
+
+// RegisterPost records the owner of a post
+func (d *Directory) RegisterPost(ctx context.Context, postID, userID string) error {
+	_, err := d.db.ExecContext(ctx,
+		`INSERT INTO post_directory (post_id, user_id) VALUES ($1, $2)
+		 ON CONFLICT (post_id) DO NOTHING`,
+		postID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to register post %s: %w", postID, err)
+	}
+	return nil
+}
+
+// AddParticipant records that a user wrote a comment or like on a post
+func (d *Directory) AddParticipant(ctx context.Context, postID, userID string) error {
+	_, err := d.db.ExecContext(ctx,
+		`INSERT INTO post_participants (post_id, user_id) VALUES ($1, $2)
+		 ON CONFLICT (post_id, user_id) DO NOTHING`,
+		postID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to add participant to post %s: %w", postID, err)
+	}
+	return nil
+}
+
+// PostOwner returns the user that owns a post; found is false for posts the
+// directory does not know about (e.g. written before it existed)
+func (d *Directory) PostOwner(ctx context.Context, postID string) (userID string, found bool, err error) {
+	err = d.db.QueryRowContext(ctx,
+		`SELECT user_id FROM post_directory WHERE post_id = $1`, postID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up post %s: %w", postID, err)
+	}
+	return userID, true, nil
+}
+
+// Participants returns the users that commented on or liked a post
+func (d *Directory) Participants(ctx context.Context, postID string) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT user_id FROM post_participants WHERE post_id = $1`, postID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list participants of post %s: %w", postID, err)
+	}
+	defer rows.Close()
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("failed to scan participant: %w", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
@@ -0,0 +1,87 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// ErrUserTaken is returned when another user already has the username or email
+var ErrUserTaken = errors.New("username or email is already taken")
+
+// uniqueViolation is the Postgres error code of a unique constraint failure
+const uniqueViolation = "23505"
+
+// RegisterUser claims a username and email for a new user. Registering the
+// same user again is a no-op.
+func (d *Directory) RegisterUser(ctx context.Context, userID, username, email string) error {
+	_, err := d.db.ExecContext(ctx,
+		`INSERT INTO user_directory (user_id, username, email) VALUES ($1, $2, $3)
+		 ON CONFLICT (user_id) DO NOTHING`,
+		userID, username, email)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("failed to register user %s: %w", userID, ErrUserTaken)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to register user %s: %w", userID, err)
+	}
+	return nil
+}
+
+// UpdateUser changes a user's username and email; empty values are left
+// unchanged. found is false for users the directory does not know about.
+func (d *Directory) UpdateUser(ctx context.Context, userID, username, email string) (found bool, err error) {
+	result, err := d.db.ExecContext(ctx,
+		`UPDATE user_directory
+		 SET username = COALESCE(NULLIF($2, ''), username),
+		     email = COALESCE(NULLIF($3, ''), email),
+		     updated_at = now()
+		 WHERE user_id = $1`,
+		userID, username, email)
+	if isUniqueViolation(err) {
+		return false, fmt.Errorf("failed to update user %s: %w", userID, ErrUserTaken)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update user %s: %w", userID, err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to update user %s: %w", userID, err)
+	}
+	return rows > 0, nil
+}
+
+// UserExists reports whether a user is registered
+func (d *Directory) UserExists(ctx context.Context, userID string) (bool, error) {
+	var exists bool
+	err := d.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM user_directory WHERE user_id = $1)`, userID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up user %s: %w", userID, err)
+	}
+	return exists, nil
+}
+
+// UserTaken reports whether a user other than userID has the username or
+// email. Empty values are not checked.
+func (d *Directory) UserTaken(ctx context.Context, userID, username, email string) (bool, error) {
+	var taken bool
+	err := d.db.QueryRowContext(ctx,
+		`SELECT EXISTS (
+		   SELECT 1 FROM user_directory
+		   WHERE user_id <> $1 AND (username = NULLIF($2, '') OR email = NULLIF($3, ''))
+		 )`,
+		userID, username, email).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("failed to check username and email: %w", err)
+	}
+	return taken, nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
+}
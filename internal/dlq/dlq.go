@@ -0,0 +1,163 @@
+// Package dlq describes how failed events are parked on dead-letter topics.
+//
+// A dead-lettered message keeps the original key and value untouched so it can
+// be re-published as-is. Everything the consumer knew about the failure is
+// carried in Kafka headers.
+package dlq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// TopicSuffix is appended to a source topic to name its dead-letter topic
+const TopicSuffix = ".dlq"
+
+// Header keys attached to every dead-lettered message
+const (
+	HeaderSourceTopic     = "dlq-source-topic"
+	HeaderSourcePartition = "dlq-source-partition"
+	HeaderSourceOffset    = "dlq-source-offset"
+	HeaderError           = "dlq-error"
+	HeaderShardID         = "dlq-shard-id"
+	HeaderAttempts        = "dlq-attempts"
+	HeaderFailedAt        = "dlq-failed-at"
+)
+
+// TopicFor returns the dead-letter topic for a source topic
+func TopicFor(topic string) string {
+	return topic + TopicSuffix
+}
+
+// SourceTopic returns the source topic of a dead-letter topic
+func SourceTopic(dlqTopic string) string {
+	return strings.TrimSuffix(dlqTopic, TopicSuffix)
+}
+
+// Metadata describes why and where an event failed
+type Metadata struct {
+	SourceTopic     string    `json:"source_topic"`
+	SourcePartition int32     `json:"source_partition"`
+	SourceOffset    int64     `json:"source_offset"`
+	Error           string    `json:"error"`
+	ShardID         *uint32   `json:"shard_id,omitempty"`
+	Attempts        int       `json:"attempts"`
+	FailedAt        time.Time `json:"failed_at"`
+}
+
+// NewMessage builds the dead-letter message for a failed source message. The
+// source's own headers (e.g. its content type) are kept for replay.
+func NewMessage(source *sarama.ConsumerMessage, meta Metadata) *sarama.ProducerMessage {
+	var headers []sarama.RecordHeader
+	for _, header := range source.Headers {
+		if header != nil && !strings.HasPrefix(string(header.Key), "dlq-") {
+			headers = append(headers, *header)
+		}
+	}
+	headers = append(headers, []sarama.RecordHeader{
+		{Key: []byte(HeaderSourceTopic), Value: []byte(meta.SourceTopic)},
+		{Key: []byte(HeaderSourcePartition), Value: []byte(strconv.FormatInt(int64(meta.SourcePartition), 10))},
+		{Key: []byte(HeaderSourceOffset), Value: []byte(strconv.FormatInt(meta.SourceOffset, 10))},
+		{Key: []byte(HeaderError), Value: []byte(meta.Error)},
+		{Key: []byte(HeaderAttempts), Value: []byte(strconv.Itoa(meta.Attempts))},
+		{Key: []byte(HeaderFailedAt), Value: []byte(meta.FailedAt.UTC().Format(time.RFC3339Nano))},
+	}...)
+	if meta.ShardID != nil {
+		headers = append(headers, sarama.RecordHeader{
+			Key:   []byte(HeaderShardID),
+			Value: []byte(strconv.FormatUint(uint64(*meta.ShardID), 10)),
+		})
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic:   TopicFor(meta.SourceTopic),
+		Value:   sarama.ByteEncoder(source.Value),
+		Headers: headers,
+	}
+	if source.Key != nil {
+		msg.Key = sarama.ByteEncoder(source.Key)
+	}
+	return msg
+}
+
+// ParseMetadata reads the failure metadata back from a dead-lettered message
+func ParseMetadata(message *sarama.ConsumerMessage) (Metadata, error) {
+	meta := Metadata{SourceTopic: SourceTopic(message.Topic)}
+
+	for _, header := range message.Headers {
+		if header == nil {
+			continue
+		}
+		value := string(header.Value)
+
+		switch string(header.Key) {
+		case HeaderSourceTopic:
+			meta.SourceTopic = value
+		case HeaderSourcePartition:
+			partition, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return meta, fmt.Errorf("invalid %s header: %w", HeaderSourcePartition, err)
+			}
+			meta.SourcePartition = int32(partition)
+		case HeaderSourceOffset:
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return meta, fmt.Errorf("invalid %s header: %w", HeaderSourceOffset, err)
+			}
+			meta.SourceOffset = offset
+		case HeaderError:
+			meta.Error = value
+		case HeaderShardID:
+			shardID, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return meta, fmt.Errorf("invalid %s header: %w", HeaderShardID, err)
+			}
+			id := uint32(shardID)
+			meta.ShardID = &id
+		case HeaderAttempts:
+			attempts, err := strconv.Atoi(value)
+			if err != nil {
+				return meta, fmt.Errorf("invalid %s header: %w", HeaderAttempts, err)
+			}
+			meta.Attempts = attempts
+		case HeaderFailedAt:
+			failedAt, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return meta, fmt.Errorf("invalid %s header: %w", HeaderFailedAt, err)
+			}
+			meta.FailedAt = failedAt
+		}
+	}
+
+	return meta, nil
+}
+
+// ResolutionsTopic records which dead-lettered messages have been handled.
+// It is keyed by EntryID so it can be log-compacted.
+const ResolutionsTopic = "dlq.resolutions"
+
+// HeaderReplayedFrom is set on events re-published from a dead-letter topic
+const HeaderReplayedFrom = "dlq-replayed-from"
+
+// Resolution actions
+const (
+	ActionReplayed = "replayed"
+	ActionDropped  = "dropped"
+)
+
+// Resolution is the value written to ResolutionsTopic
+type Resolution struct {
+	EntryID    string    `json:"entry_id"`
+	Action     string    `json:"action"`
+	ResolvedAt time.Time `json:"resolved_at"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// EntryID identifies a message on a dead-letter topic, e.g. "posts.dlq/0/42"
+func EntryID(dlqTopic string, partition int32, offset int64) string {
+	return fmt.Sprintf("%s/%d/%d", dlqTopic, partition, offset)
+}
@@ -0,0 +1,169 @@
+// Package events defines the messages exchanged over Kafka. Every event is
+// wrapped in a versioned Envelope so producers can add fields to a payload
+// without breaking consumers that still have older messages in flight.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types carried in Envelope.EventType
+const (
+	TypePostCreated    = "post.created"
+	TypePostUpdated    = "post.updated"
+	TypePostDeleted    = "post.deleted"
+	TypeCommentCreated = "comment.created"
+	TypeCommentUpdated = "comment.updated"
+	TypeCommentDeleted = "comment.deleted"
+	TypeLikeChanged    = "like.changed"
+	TypeUserCreated    = "user.created"
+	TypeUserUpdated    = "user.updated"
+	TypeFollowChanged  = "follow.changed"
+)
+
+// Envelope wraps an event payload with the metadata needed to decode it
+type Envelope struct {
+	EventType     string          `json:"event_type"`
+	SchemaVersion int             `json:"schema_version"`
+	EventID       string          `json:"event_id"`
+	ProducedAt    time.Time       `json:"produced_at"`
+	TraceID       string          `json:"trace_id,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// Post is the payload of post.created
+type Post struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// PostUpdated is the payload of post.updated. UserID is the user making the
+// edit, who must be the post's author.
+type PostUpdated struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// PostDeleted is the payload of post.deleted
+type PostDeleted struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Comment is the payload of comment.created. ParentCommentID is set on
+// replies (since v2).
+type Comment struct {
+	ID              string    `json:"id"`
+	PostID          string    `json:"post_id"`
+	UserID          string    `json:"user_id"`
+	Content         string    `json:"content"`
+	ParentCommentID string    `json:"parent_comment_id,omitempty"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// CommentUpdated is the payload of comment.updated. UserID is the user making
+// the edit, who must be the comment's author.
+type CommentUpdated struct {
+	ID        string    `json:"id"`
+	PostID    string    `json:"post_id"`
+	UserID    string    `json:"user_id"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// CommentDeleted is the payload of comment.deleted
+type CommentDeleted struct {
+	ID        string    `json:"id"`
+	PostID    string    `json:"post_id"`
+	UserID    string    `json:"user_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Like is the payload of like.changed. "like" sets the user's reaction to the
+// post, replacing any earlier one; "unlike" removes it. Reaction is one of
+// Reactions (since v2).
+type Like struct {
+	ID        string    `json:"id"`
+	PostID    string    `json:"post_id"`
+	UserID    string    `json:"user_id"`
+	Action    string    `json:"action"` // "like" or "unlike"
+	Reaction  string    `json:"reaction"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Reactions are the reaction types a user can give a post
+var Reactions = []string{"like", "love", "laugh", "wow", "sad", "angry"}
+
+// IsReaction reports whether reaction is one of Reactions
+func IsReaction(reaction string) bool {
+	for _, r := range Reactions {
+		if r == reaction {
+			return true
+		}
+	}
+	return false
+}
+
+// UserCreated is the payload of user.created
+type UserCreated struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// UserUpdated is the payload of user.updated. Empty fields are left unchanged.
+type UserUpdated struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Follow is the payload of follow.changed
+type Follow struct {
+	ID         string    `json:"id"`
+	FollowerID string    `json:"follower_id"`
+	FolloweeID string    `json:"followee_id"`
+	Action     string    `json:"action"` // "follow" or "unfollow"
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// New wraps a payload in an envelope at the current schema version of its type
+func New(eventType string, payload interface{}, traceID string) (Envelope, error) {
+	version, ok := currentVersions[eventType]
+	if !ok {
+		return Envelope{}, fmt.Errorf("unknown event type %q", eventType)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("failed to marshal %s payload: %w", eventType, err)
+	}
+
+	return Envelope{
+		EventType:     eventType,
+		SchemaVersion: version,
+		EventID:       uuid.New().String(),
+		ProducedAt:    time.Now().UTC(),
+		TraceID:       traceID,
+		Payload:       data,
+	}, nil
+}
+
+// Unmarshal decodes the envelope's payload into v
+func (e Envelope) Unmarshal(v interface{}) error {
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s v%d payload: %w", e.EventType, e.SchemaVersion, err)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Kafka header naming how a message value is encoded. Messages without it
+// are JSON.
+const (
+	HeaderContentType   = "content-type"
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Protobuf field numbers of the envelope (see schemas/events.proto)
+const (
+	envelopeEventType     protowire.Number = 1
+	envelopeSchemaVersion protowire.Number = 2
+	envelopeEventID       protowire.Number = 3
+	envelopeProducedAt    protowire.Number = 4
+	envelopeTraceID       protowire.Number = 5
+	envelopePayload       protowire.Number = 6
+)
+
+// Encode serializes an envelope with the given content type. Protobuf
+// payloads are encoded with the registered schema of their version.
+func Encode(envelope Envelope, contentType string, schemas Schemas) ([]byte, error) {
+	switch contentType {
+	case ContentTypeJSON:
+		return json.Marshal(envelope)
+	case ContentTypeProtobuf:
+		return marshalProto(envelope, schemas)
+	default:
+		return nil, fmt.Errorf("unknown content type %q", contentType)
+	}
+}
+
+func marshalProto(envelope Envelope, schemas Schemas) ([]byte, error) {
+	fields, ok := schemas.Fields(envelope.EventType, envelope.SchemaVersion)
+	if !ok {
+		return nil, fmt.Errorf("%s v%d is not in the schema registry", envelope.EventType, envelope.SchemaVersion)
+	}
+
+	payload, err := encodePayload(envelope.Payload, fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s payload: %w", envelope.EventType, err)
+	}
+
+	var b []byte
+	b = appendString(b, envelopeEventType, envelope.EventType)
+	b = appendVarint(b, envelopeSchemaVersion, uint64(envelope.SchemaVersion))
+	b = appendString(b, envelopeEventID, envelope.EventID)
+	b = appendTimestamp(b, envelopeProducedAt, envelope.ProducedAt)
+	b = appendString(b, envelopeTraceID, envelope.TraceID)
+	b = protowire.AppendTag(b, envelopePayload, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+	return b, nil
+}
+
+// unmarshalProto decodes a protobuf envelope. Its payload is turned back into
+// JSON so upgraders and handlers work the same for both encodings.
+func unmarshalProto(value []byte, schemas Schemas) (Envelope, error) {
+	var envelope Envelope
+	var payload []byte
+	err := consumeMessage(value, func(number protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch number {
+		case envelopeEventType:
+			return consumeString(typ, data, &envelope.EventType)
+		case envelopeSchemaVersion:
+			var version uint64
+			n, err := consumeVarint(typ, data, &version)
+			envelope.SchemaVersion = int(version)
+			return n, err
+		case envelopeEventID:
+			return consumeString(typ, data, &envelope.EventID)
+		case envelopeProducedAt:
+			return consumeTimestamp(typ, data, &envelope.ProducedAt)
+		case envelopeTraceID:
+			return consumeString(typ, data, &envelope.TraceID)
+		case envelopePayload:
+			return consumeBytes(typ, data, &payload)
+		}
+		return protowire.ConsumeFieldValue(number, typ, data), nil
+	})
+	if err != nil {
+		return Envelope{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	fields, ok := schemas.Fields(envelope.EventType, envelope.SchemaVersion)
+	if !ok {
+		return Envelope{}, fmt.Errorf("%w: %s v%d is not in the schema registry", ErrUnsupported, envelope.EventType, envelope.SchemaVersion)
+	}
+
+	envelope.Payload, err = decodePayload(payload, fields)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("%w: %s payload: %v", ErrMalformed, envelope.EventType, err)
+	}
+	return envelope, nil
+}
+
+// encodePayload encodes a JSON payload field by field. A field missing from
+// the schema is an error rather than being dropped.
+func encodePayload(payload json.RawMessage, fields []Field) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	for _, field := range fields {
+		value, ok := values[field.Name]
+		delete(values, field.Name)
+		if !ok || value == nil {
+			continue
+		}
+
+		number := protowire.Number(field.Number)
+		var valid bool
+		switch field.Type {
+		case FieldString:
+			var s string
+			if s, valid = value.(string); valid {
+				b = appendString(b, number, s)
+			}
+		case FieldInt64:
+			var n json.Number
+			if n, valid = value.(json.Number); valid {
+				i, err := n.Int64()
+				if err != nil {
+					return nil, fmt.Errorf("field %q: %w", field.Name, err)
+				}
+				b = appendVarint(b, number, uint64(i))
+			}
+		case FieldBool:
+			var v bool
+			if v, valid = value.(bool); valid && v {
+				b = appendVarint(b, number, 1)
+			}
+		case FieldTimestamp:
+			var s string
+			if s, valid = value.(string); valid {
+				t, err := time.Parse(time.RFC3339Nano, s)
+				if err != nil {
+					return nil, fmt.Errorf("field %q: %w", field.Name, err)
+				}
+				b = appendTimestamp(b, number, t)
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("field %q is not a %s", field.Name, field.Type)
+		}
+	}
+
+	for name := range values {
+		return nil, fmt.Errorf("field %q is not in the schema", name)
+	}
+	return b, nil
+}
+
+// decodePayload decodes a protobuf payload into JSON. Unknown field numbers
+// come from newer producers and are skipped.
+func decodePayload(data []byte, fields []Field) (json.RawMessage, error) {
+	byNumber := make(map[protowire.Number]Field, len(fields))
+	for _, field := range fields {
+		byNumber[protowire.Number(field.Number)] = field
+	}
+
+	values := make(map[string]interface{})
+	err := consumeMessage(data, func(number protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		field, ok := byNumber[number]
+		if !ok {
+			return protowire.ConsumeFieldValue(number, typ, data), nil
+		}
+
+		switch field.Type {
+		case FieldString:
+			var s string
+			n, err := consumeString(typ, data, &s)
+			values[field.Name] = s
+			return n, err
+		case FieldInt64:
+			var v uint64
+			n, err := consumeVarint(typ, data, &v)
+			values[field.Name] = int64(v)
+			return n, err
+		case FieldBool:
+			var v uint64
+			n, err := consumeVarint(typ, data, &v)
+			values[field.Name] = v != 0
+			return n, err
+		default:
+			var t time.Time
+			n, err := consumeTimestamp(typ, data, &t)
+			values[field.Name] = t.Format(time.RFC3339Nano)
+			return n, err
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(values)
+}
+
+// consumeMessage calls fn for each field of a protobuf message. fn returns how
+// many bytes of data the field's value used, or a negative protowire code.
+func consumeMessage(b []byte, fn func(number protowire.Number, typ protowire.Type, data []byte) (int, error)) error {
+	for len(b) > 0 {
+		number, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := fn(number, typ, b)
+		if err != nil {
+			return fmt.Errorf("field %d: %w", number, err)
+		}
+		if n < 0 {
+			return fmt.Errorf("field %d: %w", number, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+var errWireType = errors.New("unexpected wire type")
+
+func consumeString(typ protowire.Type, b []byte, s *string) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, errWireType
+	}
+	v, n := protowire.ConsumeString(b)
+	*s = v
+	return n, nil
+}
+
+func consumeBytes(typ protowire.Type, b []byte, v *[]byte) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, errWireType
+	}
+	data, n := protowire.ConsumeBytes(b)
+	*v = data
+	return n, nil
+}
+
+func consumeVarint(typ protowire.Type, b []byte, v *uint64) (int, error) {
+	if typ != protowire.VarintType {
+		return 0, errWireType
+	}
+	value, n := protowire.ConsumeVarint(b)
+	*v = value
+	return n, nil
+}
+
+// consumeTimestamp reads a google.protobuf.Timestamp
+func consumeTimestamp(typ protowire.Type, b []byte, t *time.Time) (int, error) {
+	var data []byte
+	n, err := consumeBytes(typ, b, &data)
+	if err != nil || n < 0 {
+		return n, err
+	}
+
+	var seconds, nanos uint64
+	err = consumeMessage(data, func(number protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch number {
+		case 1:
+			return consumeVarint(typ, data, &seconds)
+		case 2:
+			return consumeVarint(typ, data, &nanos)
+		}
+		return protowire.ConsumeFieldValue(number, typ, data), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	*t = time.Unix(int64(seconds), int64(int32(nanos))).UTC()
+	return n, nil
+}
+
+func appendString(b []byte, number protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, number protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendTimestamp writes t as a google.protobuf.Timestamp
+func appendTimestamp(b []byte, number protowire.Number, t time.Time) []byte {
+	var ts []byte
+	ts = appendVarint(ts, 1, uint64(t.Unix()))
+	ts = appendVarint(ts, 2, uint64(t.Nanosecond()))
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendBytes(b, ts)
+}
@@ -0,0 +1,170 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by Registry.Decode. Retrying does not fix either of them.
+var (
+	ErrMalformed   = errors.New("malformed event")
+	ErrUnsupported = errors.New("unsupported event")
+)
+
+// Upgrader rewrites a payload from one schema version to the next
+type Upgrader func(payload json.RawMessage) (json.RawMessage, error)
+
+// Schema history. Bump a type's version here when its payload changes and
+// register an Upgrader from the previous version in NewRegistry.
+var currentVersions = map[string]int{
+	TypePostCreated:    1,
+	TypePostUpdated:    1,
+	TypePostDeleted:    1,
+	TypeCommentCreated: 2,
+	TypeCommentUpdated: 1,
+	TypeCommentDeleted: 1,
+	TypeLikeChanged:    2,
+	TypeUserCreated:    1,
+	TypeUserUpdated:    1,
+	TypeFollowChanged:  1,
+}
+
+// Messages published before the envelope existed are bare payloads. They are
+// decoded as version 0 of the type their topic carried.
+var legacyTypes = map[string]string{
+	"posts":    TypePostCreated,
+	"comments": TypeCommentCreated,
+	"likes":    TypeLikeChanged,
+}
+
+// Registry decodes envelopes and upgrades their payloads to the current schema
+type Registry struct {
+	current  map[string]int
+	upgrades map[string]map[int]Upgrader
+	legacy   map[string]string
+	schemas  Schemas
+}
+
+// NewRegistry returns a registry that knows every schema version ever
+// produced. schemas is needed to decode protobuf messages.
+func NewRegistry(schemas Schemas) *Registry {
+	r := &Registry{
+		current:  currentVersions,
+		upgrades: make(map[string]map[int]Upgrader),
+		legacy:   legacyTypes,
+		schemas:  schemas,
+	}
+
+	// Version 1 only moved the payload into the envelope
+	r.RegisterUpgrade(TypePostCreated, 0, unchanged)
+	r.RegisterUpgrade(TypeCommentCreated, 0, unchanged)
+	r.RegisterUpgrade(TypeLikeChanged, 0, unchanged)
+
+	// Version 2 added parent_comment_id; older comments are top-level
+	r.RegisterUpgrade(TypeCommentCreated, 1, unchanged)
+
+	// Version 2 added reaction types; older likes were plain likes
+	r.RegisterUpgrade(TypeLikeChanged, 1, defaultReaction)
+
+	return r
+}
+
+// RegisterUpgrade registers how to turn a payload of version from into from+1
+func (r *Registry) RegisterUpgrade(eventType string, from int, upgrade Upgrader) {
+	if r.upgrades[eventType] == nil {
+		r.upgrades[eventType] = make(map[int]Upgrader)
+	}
+	r.upgrades[eventType][from] = upgrade
+}
+
+// Decode parses a message published on topic with the given content type (the
+// value of its content-type header, empty for JSON) and upgrades its payload
+// to the current version of its type
+func (r *Registry) Decode(topic, contentType string, value []byte) (Envelope, error) {
+	envelope, err := r.parse(topic, contentType, value)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	current, ok := r.current[envelope.EventType]
+	if !ok {
+		return Envelope{}, fmt.Errorf("%w: unknown event type %q", ErrUnsupported, envelope.EventType)
+	}
+	if envelope.SchemaVersion > current {
+		return Envelope{}, fmt.Errorf("%w: %s v%d is newer than v%d", ErrUnsupported, envelope.EventType, envelope.SchemaVersion, current)
+	}
+
+	for envelope.SchemaVersion < current {
+		upgrade, ok := r.upgrades[envelope.EventType][envelope.SchemaVersion]
+		if !ok {
+			return Envelope{}, fmt.Errorf("%w: no upgrade for %s v%d", ErrUnsupported, envelope.EventType, envelope.SchemaVersion)
+		}
+
+		payload, err := upgrade(envelope.Payload)
+		if err != nil {
+			return Envelope{}, fmt.Errorf("%w: failed to upgrade %s v%d: %v", ErrMalformed, envelope.EventType, envelope.SchemaVersion, err)
+		}
+		envelope.Payload = payload
+		envelope.SchemaVersion++
+	}
+
+	return envelope, nil
+}
+
+func (r *Registry) parse(topic, contentType string, value []byte) (Envelope, error) {
+	switch contentType {
+	case "", ContentTypeJSON:
+	case ContentTypeProtobuf:
+		return unmarshalProto(value, r.schemas)
+	default:
+		return Envelope{}, fmt.Errorf("%w: unknown content type %q", ErrUnsupported, contentType)
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(value, &envelope); err != nil {
+		return Envelope{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if envelope.EventType == "" && envelope.Payload == nil {
+		return r.legacyEnvelope(topic, value)
+	}
+	return envelope, nil
+}
+
+// legacyEnvelope wraps an unversioned payload. Every legacy event got a fresh
+// ID, so that ID stands in for the event ID.
+func (r *Registry) legacyEnvelope(topic string, value []byte) (Envelope, error) {
+	eventType, ok := r.legacy[topic]
+	if !ok {
+		return Envelope{}, fmt.Errorf("%w: message on %s has no event_type", ErrUnsupported, topic)
+	}
+
+	var ids struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(value, &ids); err != nil {
+		return Envelope{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	return Envelope{
+		EventType:     eventType,
+		SchemaVersion: 0,
+		EventID:       ids.ID,
+		Payload:       json.RawMessage(value),
+	}, nil
+}
+
+func unchanged(payload json.RawMessage) (json.RawMessage, error) {
+	return payload, nil
+}
+
+func defaultReaction(payload json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["reaction"]; !ok {
+		fields["reaction"] = json.RawMessage(`"like"`)
+	}
+	return json.Marshal(fields)
+}
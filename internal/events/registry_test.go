@@ -0,0 +1,270 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var timestamp = time.Date(2024, 1, 1, 12, 30, 0, 500, time.UTC)
+
+func loadRegistry(t *testing.T) *Registry {
+	t.Helper()
+	schemas, err := LoadSchemas("../../schemas/registry.json")
+	if err != nil {
+		t.Fatalf("LoadSchemas: %v", err)
+	}
+	return NewRegistry(schemas)
+}
+
+// envelopeJSON encodes an envelope of any version around a raw JSON payload
+func envelopeJSON(t *testing.T, eventType string, version int, payload string) []byte {
+	t.Helper()
+	value, err := json.Marshal(Envelope{
+		EventType:     eventType,
+		SchemaVersion: version,
+		EventID:       "event-1",
+		ProducedAt:    timestamp,
+		Payload:       json.RawMessage(payload),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestDecodeLegacyPayloads(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		value string
+		// want is the payload decoded into a fresh value of its type
+		want interface{}
+	}{
+		{
+			name:  "post",
+			topic: "posts",
+			value: `{"id":"p1","user_id":"u1","content":"hello","timestamp":"2024-01-01T12:30:00.0000005Z"}`,
+			want:  &Post{ID: "p1", UserID: "u1", Content: "hello", Timestamp: timestamp},
+		},
+		{
+			name:  "comment without a parent",
+			topic: "comments",
+			value: `{"id":"c1","post_id":"p1","user_id":"u1","content":"hi","timestamp":"2024-01-01T12:30:00.0000005Z"}`,
+			want:  &Comment{ID: "c1", PostID: "p1", UserID: "u1", Content: "hi", Timestamp: timestamp},
+		},
+		{
+			name:  "like becomes a like reaction",
+			topic: "likes",
+			value: `{"id":"l1","post_id":"p1","user_id":"u1","action":"like","timestamp":"2024-01-01T12:30:00.0000005Z"}`,
+			want:  &Like{ID: "l1", PostID: "p1", UserID: "u1", Action: "like", Reaction: "like", Timestamp: timestamp},
+		},
+	}
+	registry := loadRegistry(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := registry.Decode(tt.topic, "", []byte(tt.value))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if envelope.EventType != legacyTypes[tt.topic] || envelope.SchemaVersion != currentVersions[envelope.EventType] {
+				t.Errorf("decoded %s v%d, want %s v%d", envelope.EventType, envelope.SchemaVersion,
+					legacyTypes[tt.topic], currentVersions[legacyTypes[tt.topic]])
+			}
+			// The payload's own ID stands in for the event ID
+			want := reflect.ValueOf(tt.want).Elem()
+			if id := want.FieldByName("ID").String(); envelope.EventID != id {
+				t.Errorf("EventID = %q, want %q", envelope.EventID, id)
+			}
+
+			got := reflect.New(want.Type())
+			if err := envelope.Unmarshal(got.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Interface(), tt.want) {
+				t.Errorf("payload = %+v, want %+v", got.Interface(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeUpgradesOldVersions(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType string
+		version   int
+		payload   string
+		want      interface{}
+	}{
+		{
+			name:      "comment v1 is a top-level comment",
+			eventType: TypeCommentCreated,
+			version:   1,
+			payload:   `{"id":"c1","post_id":"p1","user_id":"u1","content":"hi","timestamp":"2024-01-01T12:30:00.0000005Z"}`,
+			want:      &Comment{ID: "c1", PostID: "p1", UserID: "u1", Content: "hi", Timestamp: timestamp},
+		},
+		{
+			name:      "comment v0 to v2",
+			eventType: TypeCommentCreated,
+			version:   0,
+			payload:   `{"id":"c1","post_id":"p1","user_id":"u1","content":"hi","timestamp":"2024-01-01T12:30:00.0000005Z"}`,
+			want:      &Comment{ID: "c1", PostID: "p1", UserID: "u1", Content: "hi", Timestamp: timestamp},
+		},
+		{
+			name:      "like v1 gets the like reaction",
+			eventType: TypeLikeChanged,
+			version:   1,
+			payload:   `{"id":"l1","post_id":"p1","user_id":"u1","action":"like","timestamp":"2024-01-01T12:30:00.0000005Z"}`,
+			want:      &Like{ID: "l1", PostID: "p1", UserID: "u1", Action: "like", Reaction: "like", Timestamp: timestamp},
+		},
+		{
+			name:      "like v0 to v2",
+			eventType: TypeLikeChanged,
+			version:   0,
+			payload:   `{"id":"l1","post_id":"p1","user_id":"u1","action":"unlike","timestamp":"2024-01-01T12:30:00.0000005Z"}`,
+			want:      &Like{ID: "l1", PostID: "p1", UserID: "u1", Action: "unlike", Reaction: "like", Timestamp: timestamp},
+		},
+		{
+			name:      "like v1 keeps a reaction it has",
+			eventType: TypeLikeChanged,
+			version:   1,
+			payload:   `{"id":"l1","post_id":"p1","user_id":"u1","action":"like","reaction":"love","timestamp":"2024-01-01T12:30:00.0000005Z"}`,
+			want:      &Like{ID: "l1", PostID: "p1", UserID: "u1", Action: "like", Reaction: "love", Timestamp: timestamp},
+		},
+		{
+			name:      "current version is left as is",
+			eventType: TypeLikeChanged,
+			version:   2,
+			payload:   `{"id":"l1","post_id":"p1","user_id":"u1","action":"like","reaction":"wow","timestamp":"2024-01-01T12:30:00.0000005Z"}`,
+			want:      &Like{ID: "l1", PostID: "p1", UserID: "u1", Action: "like", Reaction: "wow", Timestamp: timestamp},
+		},
+	}
+	registry := loadRegistry(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := registry.Decode("any", ContentTypeJSON, envelopeJSON(t, tt.eventType, tt.version, tt.payload))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if want := currentVersions[tt.eventType]; envelope.SchemaVersion != want {
+				t.Errorf("SchemaVersion = %d, want %d", envelope.SchemaVersion, want)
+			}
+			if envelope.EventID != "event-1" {
+				t.Errorf("EventID = %q, want event-1", envelope.EventID)
+			}
+
+			got := reflect.New(reflect.TypeOf(tt.want).Elem())
+			if err := envelope.Unmarshal(got.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Interface(), tt.want) {
+				t.Errorf("payload = %+v, want %+v", got.Interface(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	registry := loadRegistry(t)
+	like := `{"id":"l1","post_id":"p1","user_id":"u1","action":"like"}`
+
+	tests := []struct {
+		name        string
+		topic       string
+		contentType string
+		value       []byte
+		want        error
+	}{
+		{"newer version", "likes", "", envelopeJSON(t, TypeLikeChanged, 3, like), ErrUnsupported},
+		{"unknown event type", "likes", "", envelopeJSON(t, "like.exploded", 1, like), ErrUnsupported},
+		{"no upgrade path", "posts", "", envelopeJSON(t, TypePostUpdated, 0, `{"id":"p1"}`), ErrUnsupported},
+		{"unknown content type", "likes", "text/plain", []byte(like), ErrUnsupported},
+		{"legacy payload on a new topic", "users", "", []byte(`{"id":"u1","username":"ann"}`), ErrUnsupported},
+		{"not JSON", "likes", "", []byte("{"), ErrMalformed},
+		{"payload an upgrade cannot read", "likes", "", envelopeJSON(t, TypeLikeChanged, 1, `["like"]`), ErrMalformed},
+		{"truncated protobuf", "likes", ContentTypeProtobuf, []byte{0x0a, 0x10, 'l'}, ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := registry.Decode(tt.topic, tt.contentType, tt.value)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Decode error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONAndProtobufDecodeAlike(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType string
+		version   int
+		payload   interface{}
+	}{
+		{"post", TypePostCreated, 1, Post{ID: "p1", UserID: "u1", Content: "hello", Timestamp: timestamp}},
+		{"post update", TypePostUpdated, 1, PostUpdated{ID: "p1", UserID: "u1", Content: "edited", Timestamp: timestamp}},
+		{"post delete", TypePostDeleted, 1, PostDeleted{ID: "p1", UserID: "u1", Timestamp: timestamp}},
+		{"top-level comment", TypeCommentCreated, 2, Comment{ID: "c1", PostID: "p1", UserID: "u1", Content: "hi", Timestamp: timestamp}},
+		{"reply", TypeCommentCreated, 2, Comment{ID: "c2", PostID: "p1", UserID: "u2", Content: "re", ParentCommentID: "c1", Timestamp: timestamp}},
+		{"comment v1", TypeCommentCreated, 1, Comment{ID: "c1", PostID: "p1", UserID: "u1", Content: "hi", Timestamp: timestamp}},
+		{"reaction", TypeLikeChanged, 2, Like{ID: "l1", PostID: "p1", UserID: "u1", Action: "like", Reaction: "laugh", Timestamp: timestamp}},
+		{"like v1", TypeLikeChanged, 1, struct {
+			ID        string    `json:"id"`
+			PostID    string    `json:"post_id"`
+			UserID    string    `json:"user_id"`
+			Action    string    `json:"action"`
+			Timestamp time.Time `json:"timestamp"`
+		}{"l1", "p1", "u1", "like", timestamp}},
+		{"user", TypeUserCreated, 1, UserCreated{ID: "u1", Username: "ann", Email: "ann@example.com", Timestamp: timestamp}},
+		{"follow", TypeFollowChanged, 1, Follow{ID: "f1", FollowerID: "u1", FolloweeID: "u2", Action: "follow", Timestamp: timestamp}},
+	}
+	registry := loadRegistry(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := json.Marshal(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			envelope := Envelope{
+				EventType:     tt.eventType,
+				SchemaVersion: tt.version,
+				EventID:       "event-1",
+				ProducedAt:    timestamp,
+				TraceID:       "trace-1",
+				Payload:       payload,
+			}
+
+			decoded := make(map[string]Envelope)
+			for _, contentType := range []string{ContentTypeJSON, ContentTypeProtobuf} {
+				value, err := Encode(envelope, contentType, registry.schemas)
+				if err != nil {
+					t.Fatalf("Encode %s: %v", contentType, err)
+				}
+				decoded[contentType], err = registry.Decode("any", contentType, value)
+				if err != nil {
+					t.Fatalf("Decode %s: %v", contentType, err)
+				}
+			}
+
+			fromJSON, fromProto := decoded[ContentTypeJSON], decoded[ContentTypeProtobuf]
+			if fromJSON.SchemaVersion != currentVersions[tt.eventType] {
+				t.Errorf("SchemaVersion = %d, want %d", fromJSON.SchemaVersion, currentVersions[tt.eventType])
+			}
+			payloads := [2]map[string]interface{}{}
+			for i, e := range []*Envelope{&fromJSON, &fromProto} {
+				if err := json.Unmarshal(e.Payload, &payloads[i]); err != nil {
+					t.Fatal(err)
+				}
+				e.Payload = nil
+			}
+			if !reflect.DeepEqual(fromJSON, fromProto) {
+				t.Errorf("protobuf envelope = %+v, JSON envelope = %+v", fromProto, fromJSON)
+			}
+			if !reflect.DeepEqual(payloads[0], payloads[1]) {
+				t.Errorf("protobuf payload = %v, JSON payload = %v", payloads[1], payloads[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Field types a payload schema may use
+const (
+	FieldString    = "string"
+	FieldInt64     = "int64"
+	FieldBool      = "bool"
+	FieldTimestamp = "timestamp"
+)
+
+// Field maps a JSON payload field to its protobuf field number
+type Field struct {
+	Number int    `json:"number"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+}
+
+// Schema is one version of a payload
+type Schema struct {
+	Version int     `json:"version"`
+	Fields  []Field `json:"fields"`
+}
+
+// Schemas is the file-based schema registry: every registered version of
+// every event type's payload, keyed by event type
+type Schemas map[string][]Schema
+
+// Payload types produced at the current schema version, checked against the
+// registry so no field is silently dropped by the protobuf encoding
+var payloadTypes = map[string]reflect.Type{
+	TypePostCreated:    reflect.TypeOf(Post{}),
+	TypePostUpdated:    reflect.TypeOf(PostUpdated{}),
+	TypePostDeleted:    reflect.TypeOf(PostDeleted{}),
+	TypeCommentCreated: reflect.TypeOf(Comment{}),
+	TypeCommentUpdated: reflect.TypeOf(CommentUpdated{}),
+	TypeCommentDeleted: reflect.TypeOf(CommentDeleted{}),
+	TypeLikeChanged:    reflect.TypeOf(Like{}),
+	TypeUserCreated:    reflect.TypeOf(UserCreated{}),
+	TypeUserUpdated:    reflect.TypeOf(UserUpdated{}),
+	TypeFollowChanged:  reflect.TypeOf(Follow{}),
+}
+
+// LoadSchemas reads the schema registry file and checks it is compatible with
+// itself and with the payloads this build produces
+func LoadSchemas(path string) (Schemas, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema registry: %w", err)
+	}
+
+	var schemas Schemas
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return nil, fmt.Errorf("failed to parse schema registry %s: %w", path, err)
+	}
+
+	if err := schemas.Validate(); err != nil {
+		return nil, fmt.Errorf("schema registry %s: %w", path, err)
+	}
+	return schemas, nil
+}
+
+// Fields returns the fields of one version of an event type's payload
+func (s Schemas) Fields(eventType string, version int) ([]Field, bool) {
+	for _, schema := range s[eventType] {
+		if schema.Version == version {
+			return schema.Fields, true
+		}
+	}
+	return nil, false
+}
+
+// Validate checks that every version can be read by later ones: a field number
+// keeps its name and type for good, and a name keeps its number. It also
+// checks that the current version of each payload is registered and covers
+// every field of its Go type.
+func (s Schemas) Validate() error {
+	for eventType, versions := range s {
+		sorted := append([]Schema(nil), versions...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+		byNumber := make(map[int]Field)
+		byName := make(map[string]int)
+		for i, schema := range sorted {
+			if i > 0 && schema.Version == sorted[i-1].Version {
+				return fmt.Errorf("%s v%d is registered twice", eventType, schema.Version)
+			}
+
+			seen := make(map[int]bool)
+			for _, field := range schema.Fields {
+				switch {
+				case field.Number < 1:
+					return fmt.Errorf("%s v%d: field %q has invalid number %d", eventType, schema.Version, field.Name, field.Number)
+				case seen[field.Number]:
+					return fmt.Errorf("%s v%d: field number %d is used twice", eventType, schema.Version, field.Number)
+				}
+				switch field.Type {
+				case FieldString, FieldInt64, FieldBool, FieldTimestamp:
+				default:
+					return fmt.Errorf("%s v%d: field %q has unknown type %q", eventType, schema.Version, field.Name, field.Type)
+				}
+				seen[field.Number] = true
+
+				if previous, ok := byNumber[field.Number]; ok && (previous.Name != field.Name || previous.Type != field.Type) {
+					return fmt.Errorf("%s v%d: field %d was %s %q and cannot become %s %q",
+						eventType, schema.Version, field.Number, previous.Type, previous.Name, field.Type, field.Name)
+				}
+				if number, ok := byName[field.Name]; ok && number != field.Number {
+					return fmt.Errorf("%s v%d: field %q moved from number %d to %d", eventType, schema.Version, field.Name, number, field.Number)
+				}
+				byNumber[field.Number] = field
+				byName[field.Name] = field.Number
+			}
+		}
+	}
+
+	for eventType, version := range currentVersions {
+		fields, ok := s.Fields(eventType, version)
+		if !ok {
+			return fmt.Errorf("%s v%d is not registered", eventType, version)
+		}
+
+		names := make(map[string]bool)
+		for _, field := range fields {
+			names[field.Name] = true
+		}
+		payloadType := payloadTypes[eventType]
+		for i := 0; i < payloadType.NumField(); i++ {
+			name := strings.Split(payloadType.Field(i).Tag.Get("json"), ",")[0]
+			if name != "" && name != "-" && !names[name] {
+				return fmt.Errorf("%s v%d has no field for %q", eventType, version, name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+// Package feed maintains home timelines. Follows are stored on the follower's
+// shard. In read mode the query service merges the posts of everyone a user
+// follows when the feed is requested. In write mode the consumer copies every
+// new post into the timeline of each follower, on the follower's shard, so a
+// feed is read from a single shard.
+package feed
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"social-media-db/internal/shard"
+)
+
+// Mode selects how home feeds are built
+type Mode string
+
+const (
+	// FanOutOnRead merges the followed users' posts at read time
+	FanOutOnRead Mode = "read"
+	// FanOutOnWrite copies posts into the timelines table as they are created
+	FanOutOnWrite Mode = "write"
+)
+
+// Config is the feed configuration shared by every service
+type Config struct {
+	Mode Mode
+	// Backfill is how many recent posts of a newly followed user are copied
+	// into the follower's timeline in write mode
+	Backfill int
+}
+
+// LoadConfig reads FEED_MODE ("read" or "write", default "read") and
+// FEED_BACKFILL_POSTS (default 50). Every service must use the same mode.
+func LoadConfig() (Config, error) {
+	config := Config{Mode: FanOutOnRead, Backfill: 50}
+
+	switch mode := Mode(os.Getenv("FEED_MODE")); mode {
+	case "":
+	case FanOutOnRead, FanOutOnWrite:
+		config.Mode = mode
+	default:
+		return Config{}, fmt.Errorf("invalid FEED_MODE %q: must be %q or %q", mode, FanOutOnRead, FanOutOnWrite)
+	}
+
+	if value, err := strconv.Atoi(os.Getenv("FEED_BACKFILL_POSTS")); err == nil && value >= 0 {
+		config.Backfill = value
+	}
+	return config, nil
+}
+
+// Execer is a *sql.DB, or a *sql.Tx to write a timeline in the transaction
+// that changes a follow
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Entry is a post in a timeline
+type Entry struct {
+	PostID    string
+	AuthorID  string
+	CreatedAt time.Time
+}
+
+// Followers returns the users following userID. Follows live on the
+// follower's shard, so every shard is asked, all at once.
+func Followers(ctx context.Context, router shard.Router, userID string) ([]string, error) {
+	configs := router.All()
+	results := make([][]string, len(configs))
+	errs := make([]error, len(configs))
+
+	var wg sync.WaitGroup
+	for i, config := range configs {
+		wg.Add(1)
+		go func(i int, shardID uint32) {
+			defer wg.Done()
+			results[i], errs[i] = followersOn(ctx, router.DB(shardID), shardID, userID)
+		}(i, config.ID)
+	}
+	wg.Wait()
+
+	var followers []string
+	for i := range configs {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		followers = append(followers, results[i]...)
+	}
+	return followers, nil
+}
+
+// followersOn returns the followers of userID stored on one shard
+func followersOn(ctx context.Context, db *sql.DB, shardID uint32, userID string) ([]string, error) {
+	if db == nil {
+		return nil, fmt.Errorf("shard %d is not connected", shardID)
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT follower_id FROM follows WHERE followee_id = $1`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list followers of %s on shard %d: %w", userID, shardID, err)
+	}
+	defer rows.Close()
+
+	var followers []string
+	for rows.Next() {
+		var followerID string
+		if err := rows.Scan(&followerID); err != nil {
+			return nil, fmt.Errorf("failed to scan follower: %w", err)
+		}
+		followers = append(followers, followerID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list followers of %s on shard %d: %w", userID, shardID, err)
+	}
+	return followers, nil
+}
+
+// ByShard groups users by the shard that stores their data
+func ByShard(router shard.Router, userIDs []string) map[uint32][]string {
+	groups := make(map[uint32][]string)
+	for _, userID := range userIDs {
+		shardID := router.ShardFor(userID)
+		groups[shardID] = append(groups[shardID], userID)
+	}
+	return groups
+}
+
+// FanOut adds a post to the timelines of followers that are all stored on db
+func FanOut(ctx context.Context, db Execer, followerIDs []string, entry Entry) error {
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO timelines (user_id, post_id, author_id, created_at)
+		 SELECT unnest($1::text[]), $2, $3, $4
+		 ON CONFLICT (user_id, post_id) DO NOTHING`,
+		pq.Array(followerIDs), entry.PostID, entry.AuthorID, entry.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to fan out post %s: %w", entry.PostID, err)
+	}
+	return nil
+}
+
+// Backfill copies the latest posts of authorID (read from authorDB) into the
+// timeline of followerID (stored on followerDB)
+func Backfill(ctx context.Context, authorDB *sql.DB, followerDB Execer, followerID, authorID string, limit int) error {
+	if limit == 0 {
+		return nil
+	}
+
+	rows, err := authorDB.QueryContext(ctx,
+		`SELECT id, created_at FROM posts
+		 WHERE user_id = $1 AND deleted_at IS NULL
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT $2`,
+		authorID, limit)
+	if err != nil {
+		return fmt.Errorf("failed to read posts of %s: %w", authorID, err)
+	}
+	var entries []Entry
+	for rows.Next() {
+		entry := Entry{AuthorID: authorID}
+		if err := rows.Scan(&entry.PostID, &entry.CreatedAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan post: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read posts of %s: %w", authorID, err)
+	}
+
+	for _, entry := range entries {
+		if err := FanOut(ctx, followerDB, []string{followerID}, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillFollow runs Backfill once a follow is committed, in a transaction
+// that holds the follow so that a concurrent unfollow waits for it. Nothing is
+// copied when the follow is gone, e.g. for a follow replayed after an
+// unfollow.
+//
+// A post written while the follow was being written can miss both its own
+// fan-out, which did not see the follow yet, and a backfill inside the
+// follow's transaction, which did not see the post yet. Reading the posts
+// after the follow is committed sees every such post.
+func BackfillFollow(ctx context.Context, authorDB, followerDB *sql.DB, followerID, authorID string, limit int) error {
+	if limit == 0 {
+		return nil
+	}
+
+	tx, err := followerDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin backfill of %s for %s: %w", authorID, followerID, err)
+	}
+	defer tx.Rollback()
+
+	var following bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT true FROM follows WHERE follower_id = $1 AND followee_id = $2 FOR SHARE`,
+		followerID, authorID).Scan(&following)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock follow of %s by %s: %w", authorID, followerID, err)
+	}
+
+	if err := Backfill(ctx, authorDB, tx, followerID, authorID, limit); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit backfill of %s for %s: %w", authorID, followerID, err)
+	}
+	return nil
+}
+
+// Remove drops the posts of authorID from the timeline of followerID
+func Remove(ctx context.Context, followerDB Execer, followerID, authorID string) error {
+	_, err := followerDB.ExecContext(ctx,
+		`DELETE FROM timelines WHERE user_id = $1 AND author_id = $2`, followerID, authorID)
+	if err != nil {
+		return fmt.Errorf("failed to remove posts of %s from the timeline of %s: %w", authorID, followerID, err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Package hashring implements a weighted consistent-hash ring with virtual nodes.
+//
+// Each node is placed on the ring vnodes*weight times. A key belongs to the first
+// virtual node clockwise from its hash, so adding or removing a node only moves
+// the keys that land on that node's virtual nodes (about 1/N of the keyspace).
+package hashring
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of virtual nodes per unit of weight
+const DefaultVirtualNodes = 160
+
+// Node is a member of the ring
+type Node struct {
+	ID     uint32
+	Weight int
+}
+
+type point struct {
+	hash uint64
+	id   uint32
+}
+
+// Ring maps keys to node IDs. It is immutable and safe for concurrent use.
+type Ring struct {
+	points       []point
+	nodes        []Node
+	virtualNodes int
+}
+
+// New builds a ring. Nodes with a weight of zero own no keys, which lets a node
+// be drained before it is removed.
+func New(nodes []Node, virtualNodes int) (*Ring, error) {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+
+	seen := make(map[uint32]bool, len(nodes))
+	var points []point
+	for _, node := range nodes {
+		if node.Weight < 0 {
+			return nil, fmt.Errorf("node %d has negative weight %d", node.ID, node.Weight)
+		}
+		if seen[node.ID] {
+			return nil, fmt.Errorf("duplicate node %d", node.ID)
+		}
+		seen[node.ID] = true
+
+		for i := 0; i < virtualNodes*node.Weight; i++ {
+			points = append(points, point{
+				hash: hash("node-" + strconv.FormatUint(uint64(node.ID), 10) + "#" + strconv.Itoa(i)),
+				id:   node.ID,
+			})
+		}
+	}
+
+	if len(points) == 0 {
+		return nil, fmt.Errorf("ring has no nodes with a positive weight")
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].id < points[j].id
+		}
+		return points[i].hash < points[j].hash
+	})
+
+	ring := &Ring{
+		points:       points,
+		nodes:        append([]Node(nil), nodes...),
+		virtualNodes: virtualNodes,
+	}
+	sort.Slice(ring.nodes, func(i, j int) bool { return ring.nodes[i].ID < ring.nodes[j].ID })
+
+	return ring, nil
+}
+
+// Get returns the node that owns key
+func (r *Ring) Get(key string) uint32 {
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].id
+}
+
+// Nodes returns the ring members ordered by ID
+func (r *Ring) Nodes() []Node {
+	return append([]Node(nil), r.nodes...)
+}
+
+// VirtualNodes returns the number of virtual nodes per unit of weight
+func (r *Ring) VirtualNodes() int {
+	return r.virtualNodes
+}
+
+// hash is FNV-1a followed by a 64-bit finalizer; FNV alone clusters badly on
+// short keys that only differ in their last characters.
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
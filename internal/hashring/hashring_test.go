@@ -0,0 +1,205 @@
+package hashring
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// keys returns n distinct keys shaped like the user IDs the services route
+func keys(n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = "user-" + strconv.Itoa(i)
+	}
+	return out
+}
+
+func TestNewRejectsInvalidNodes(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []Node
+	}{
+		{"no nodes", nil},
+		{"only zero weights", []Node{{ID: 1, Weight: 0}, {ID: 2, Weight: 0}}},
+		{"negative weight", []Node{{ID: 1, Weight: 1}, {ID: 2, Weight: -1}}},
+		{"duplicate node", []Node{{ID: 1, Weight: 1}, {ID: 1, Weight: 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.nodes, 0); err == nil {
+				t.Fatal("New succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestNewDefaultsVirtualNodes(t *testing.T) {
+	ring, err := New([]Node{{ID: 1, Weight: 1}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ring.VirtualNodes(); got != DefaultVirtualNodes {
+		t.Errorf("VirtualNodes() = %d, want %d", got, DefaultVirtualNodes)
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []Node
+	}{
+		{"equal weights", []Node{{ID: 1, Weight: 1}, {ID: 2, Weight: 1}, {ID: 3, Weight: 1}}},
+		{"weighted", []Node{{ID: 1, Weight: 1}, {ID: 2, Weight: 2}, {ID: 3, Weight: 1}}},
+		{"drained node", []Node{{ID: 1, Weight: 1}, {ID: 2, Weight: 0}, {ID: 3, Weight: 1}}},
+		{"many nodes", []Node{{ID: 1, Weight: 1}, {ID: 2, Weight: 1}, {ID: 3, Weight: 1}, {ID: 4, Weight: 1}, {ID: 5, Weight: 1}, {ID: 6, Weight: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring, err := New(tt.nodes, DefaultVirtualNodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			counts := make(map[uint32]int)
+			all := keys(100000)
+			for _, key := range all {
+				counts[ring.Get(key)]++
+			}
+
+			total := 0
+			for _, node := range tt.nodes {
+				total += node.Weight
+			}
+			for _, node := range tt.nodes {
+				want := float64(node.Weight) / float64(total)
+				got := float64(counts[node.ID]) / float64(len(all))
+				if node.Weight == 0 && counts[node.ID] != 0 {
+					t.Errorf("node %d has weight 0 but owns %d keys", node.ID, counts[node.ID])
+				}
+				if math.Abs(got-want) > 0.05 {
+					t.Errorf("node %d owns %.3f of the keys, want %.3f ± 0.05", node.ID, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetIsStable(t *testing.T) {
+	nodes := []Node{{ID: 1, Weight: 1}, {ID: 2, Weight: 2}, {ID: 3, Weight: 1}}
+	reversed := []Node{nodes[2], nodes[1], nodes[0]}
+
+	a, err := New(nodes, DefaultVirtualNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(reversed, DefaultVirtualNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys(10000) {
+		first := a.Get(key)
+		if again := a.Get(key); again != first {
+			t.Fatalf("Get(%q) = %d, then %d", key, first, again)
+		}
+		if other := b.Get(key); other != first {
+			t.Fatalf("Get(%q) = %d, but %d when the nodes are listed in another order", key, first, other)
+		}
+	}
+}
+
+func TestMembershipChangesMoveFewKeys(t *testing.T) {
+	three := []Node{{ID: 1, Weight: 1}, {ID: 2, Weight: 1}, {ID: 3, Weight: 1}}
+	tests := []struct {
+		name   string
+		before []Node
+		after  []Node
+		// moved is the share of keys expected to change node
+		moved float64
+		// target is the only node keys may move to (0: any node)
+		target uint32
+		// source is the only node keys may move from (0: any node)
+		source uint32
+	}{
+		{
+			name:   "add a node",
+			before: three,
+			after:  append(append([]Node(nil), three...), Node{ID: 4, Weight: 1}),
+			moved:  0.25,
+			target: 4,
+		},
+		{
+			name:   "add a heavy node",
+			before: three,
+			after:  append(append([]Node(nil), three...), Node{ID: 4, Weight: 3}),
+			moved:  0.5,
+			target: 4,
+		},
+		{
+			name:   "drain a node",
+			before: three,
+			after:  []Node{{ID: 1, Weight: 1}, {ID: 2, Weight: 1}, {ID: 3, Weight: 0}},
+			moved:  1.0 / 3,
+			source: 3,
+		},
+		{
+			name:   "remove a node",
+			before: three,
+			after:  []Node{{ID: 1, Weight: 1}, {ID: 2, Weight: 1}},
+			moved:  1.0 / 3,
+			source: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := New(tt.before, DefaultVirtualNodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := New(tt.after, DefaultVirtualNodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			all := keys(100000)
+			moved := 0
+			for _, key := range all {
+				from, to := before.Get(key), after.Get(key)
+				if from == to {
+					continue
+				}
+				moved++
+				if tt.target != 0 && to != tt.target {
+					t.Fatalf("key %q moved from %d to %d, want only moves to %d", key, from, to, tt.target)
+				}
+				if tt.source != 0 && from != tt.source {
+					t.Fatalf("key %q moved from %d to %d, want only moves from %d", key, from, to, tt.source)
+				}
+			}
+
+			if got := float64(moved) / float64(len(all)); math.Abs(got-tt.moved) > 0.05 {
+				t.Errorf("%.3f of the keys moved, want %.3f ± 0.05", got, tt.moved)
+			}
+		})
+	}
+}
+
+func TestNodesAreSortedCopies(t *testing.T) {
+	ring, err := New([]Node{{ID: 3, Weight: 1}, {ID: 1, Weight: 2}, {ID: 2, Weight: 0}}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := ring.Nodes()
+	for i, want := range []uint32{1, 2, 3} {
+		if nodes[i].ID != want {
+			t.Fatalf("Nodes() = %v, want IDs 1, 2, 3", nodes)
+		}
+	}
+
+	nodes[0].Weight = 100
+	if ring.Nodes()[0].Weight != 2 {
+		t.Error("changing the result of Nodes() changed the ring")
+	}
+}
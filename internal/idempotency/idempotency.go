@@ -0,0 +1,179 @@
+// Package idempotency remembers the responses of requests that carried an
+// Idempotency-Key so a client retry can be answered without doing the work
+// again.
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInProgress is returned while another request holds the key
+	ErrInProgress = errors.New("a request with this idempotency key is in progress")
+	// ErrMismatch is returned when a key is reused for a different request
+	ErrMismatch = errors.New("idempotency key was used for a different request")
+)
+
+// Record is the stored response of a completed request
+type Record struct {
+	Status      int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+	// Partial marks a response that a retry may finish, such as a batch with
+	// failed items. It is handed back to the retry instead of being replayed.
+	Partial bool
+}
+
+// Store keeps idempotency keys for a limited window
+type Store interface {
+	// Reserve claims key for a request identified by fingerprint. It returns
+	// the stored record if the key already completed, ErrInProgress if another
+	// request holds it and ErrMismatch if it belongs to a different request.
+	// A nil record and error mean the caller owns the key until it calls
+	// Complete or Release. So does a partial record, which the caller
+	// finishes.
+	Reserve(ctx context.Context, key, fingerprint string) (*Record, error)
+	// Complete stores the response of a reserved key for the rest of the window
+	Complete(ctx context.Context, key string, record Record) error
+	// Release drops a reservation so the request can be retried. A key
+	// reserved to finish a partial record keeps that record.
+	Release(ctx context.Context, key string) error
+}
+
+// New returns the store named by kind; only "memory" is built in
+func New(kind string, window time.Duration) (Store, error) {
+	switch kind {
+	case "memory":
+		return NewMemoryStore(window), nil
+	default:
+		return nil, fmt.Errorf("unknown idempotency store %q", kind)
+	}
+}
+
+// reservationTimeout bounds how long an unfinished request holds its key, so
+// a request that never completes does not block retries for the whole window
+const reservationTimeout = time.Minute
+
+type entry struct {
+	fingerprint string
+	record      *Record // nil while the request is in progress
+	partial     *Record // the partial record a request in progress finishes
+	expires     time.Time
+}
+
+// MemoryStore keeps keys in process memory. Keys are lost on restart and are
+// not shared between replicas.
+type MemoryStore struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+}
+
+func NewMemoryStore(window time.Duration) *MemoryStore {
+	return &MemoryStore{
+		window:    window,
+		entries:   make(map[string]*entry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *MemoryStore) Reserve(ctx context.Context, key, fingerprint string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	e, ok := s.entries[key]
+	if ok {
+		s.restore(e, now)
+	}
+	if ok && now.Before(e.expires) {
+		if e.fingerprint != fingerprint {
+			return nil, ErrMismatch
+		}
+		if e.record == nil {
+			return nil, ErrInProgress
+		}
+		record := *e.record
+		if record.Partial {
+			e.partial, e.record = e.record, nil
+			e.expires = now.Add(s.reservation())
+		}
+		return &record, nil
+	}
+
+	s.entries[key] = &entry{fingerprint: fingerprint, expires: now.Add(s.reservation())}
+	return nil, nil
+}
+
+func (s *MemoryStore) Complete(ctx context.Context, key string, record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return fmt.Errorf("idempotency key %q is not reserved", key)
+	}
+	e.record = &record
+	e.partial = nil
+	e.expires = time.Now().Add(s.window)
+	return nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if e.partial == nil {
+		delete(s.entries, key)
+		return nil
+	}
+	e.expires = time.Now()
+	s.restore(e, e.expires)
+	return nil
+}
+
+// reservation is how long a request holds its key, at most the window
+func (s *MemoryStore) reservation() time.Duration {
+	if s.window < reservationTimeout {
+		return s.window
+	}
+	return reservationTimeout
+}
+
+// restore gives a key back its partial record once the request finishing it
+// has released the key or timed out; callers hold mu
+func (s *MemoryStore) restore(e *entry, now time.Time) {
+	if e.partial == nil || now.Before(e.expires) {
+		return
+	}
+	e.record, e.partial = e.partial, nil
+	e.expires = e.record.CreatedAt.Add(s.window)
+}
+
+// sweep drops expired keys at most once a minute; callers hold mu
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for key, e := range s.entries {
+		s.restore(e, now)
+		if !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+func reserve(t *testing.T, s Store, key, fingerprint string) *Record {
+	t.Helper()
+	record, err := s.Reserve(ctx, key, fingerprint)
+	if err != nil {
+		t.Fatalf("Reserve(%q, %q): %v", key, fingerprint, err)
+	}
+	return record
+}
+
+func complete(t *testing.T, s Store, key string, record Record) {
+	t.Helper()
+	if err := s.Complete(ctx, key, record); err != nil {
+		t.Fatalf("Complete(%q): %v", key, err)
+	}
+}
+
+func TestConcurrentReservationsOfOneKey(t *testing.T) {
+	s := NewMemoryStore(time.Hour)
+
+	const requests = 50
+	var wg sync.WaitGroup
+	errs := make([]error, requests)
+	records := make([]*Record, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			records[i], errs[i] = s.Reserve(ctx, "key", "request")
+		}(i)
+	}
+	wg.Wait()
+
+	owners := 0
+	for i := range errs {
+		switch {
+		case errs[i] == nil && records[i] == nil:
+			owners++
+		case errors.Is(errs[i], ErrInProgress):
+		default:
+			t.Errorf("Reserve = %v, %v, want the key or ErrInProgress", records[i], errs[i])
+		}
+	}
+	if owners != 1 {
+		t.Errorf("%d requests got the key, want 1", owners)
+	}
+}
+
+func TestReserveChecksFingerprint(t *testing.T) {
+	tests := []struct {
+		name        string
+		completed   bool
+		fingerprint string
+		wantErr     error
+		wantReplay  bool
+	}{
+		{"in progress, same request", false, "request", ErrInProgress, false},
+		{"in progress, other request", false, "other", ErrMismatch, false},
+		{"completed, same request", true, "request", nil, true},
+		{"completed, other request", true, "other", ErrMismatch, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore(time.Hour)
+			reserve(t, s, "key", "request")
+			if tt.completed {
+				complete(t, s, "key", Record{Status: 202, Body: []byte("done"), CreatedAt: time.Now()})
+			}
+
+			record, err := s.Reserve(ctx, "key", tt.fingerprint)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Reserve error = %v, want %v", err, tt.wantErr)
+			}
+			if got := record != nil; got != tt.wantReplay {
+				t.Fatalf("Reserve returned record %v, want a replay: %v", record, tt.wantReplay)
+			}
+			if tt.wantReplay && (record.Status != 202 || string(record.Body) != "done") {
+				t.Errorf("replayed %d %q, want 202 \"done\"", record.Status, record.Body)
+			}
+		})
+	}
+}
+
+func TestKeysExpire(t *testing.T) {
+	const window = 50 * time.Millisecond
+
+	t.Run("reservation", func(t *testing.T) {
+		s := NewMemoryStore(window)
+		reserve(t, s, "key", "request")
+		if _, err := s.Reserve(ctx, "key", "request"); !errors.Is(err, ErrInProgress) {
+			t.Fatalf("Reserve error = %v, want ErrInProgress", err)
+		}
+
+		// A request that never completes gives the key up after the timeout
+		time.Sleep(window + 10*time.Millisecond)
+		if record := reserve(t, s, "key", "other"); record != nil {
+			t.Errorf("Reserve after the timeout = %v, want the key", record)
+		}
+	})
+
+	t.Run("completed", func(t *testing.T) {
+		s := NewMemoryStore(window)
+		reserve(t, s, "key", "request")
+		complete(t, s, "key", Record{Status: 202, CreatedAt: time.Now()})
+		if record := reserve(t, s, "key", "request"); record == nil {
+			t.Fatal("Reserve within the window returned no record")
+		}
+
+		time.Sleep(window + 10*time.Millisecond)
+		if record := reserve(t, s, "key", "request"); record != nil {
+			t.Errorf("Reserve after the window = %v, want the key", record)
+		}
+	})
+
+	t.Run("released", func(t *testing.T) {
+		s := NewMemoryStore(time.Hour)
+		reserve(t, s, "key", "request")
+		if err := s.Release(ctx, "key"); err != nil {
+			t.Fatal(err)
+		}
+		if record := reserve(t, s, "key", "request"); record != nil {
+			t.Errorf("Reserve after Release = %v, want the key", record)
+		}
+	})
+}
+
+func TestPartialRecordsAreResumed(t *testing.T) {
+	s := NewMemoryStore(time.Hour)
+	reserve(t, s, "key", "batch")
+	complete(t, s, "key", Record{Status: 207, Body: []byte("partial"), CreatedAt: time.Now(), Partial: true})
+
+	// A retry gets the partial record and owns the key while finishing it
+	record := reserve(t, s, "key", "batch")
+	if record == nil || !record.Partial || string(record.Body) != "partial" {
+		t.Fatalf("Reserve = %+v, want the partial record", record)
+	}
+	if _, err := s.Reserve(ctx, "key", "batch"); !errors.Is(err, ErrInProgress) {
+		t.Fatalf("second Reserve error = %v, want ErrInProgress", err)
+	}
+	if _, err := s.Reserve(ctx, "key", "other"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("Reserve for another request error = %v, want ErrMismatch", err)
+	}
+
+	// Releasing keeps the partial record for the next retry
+	if err := s.Release(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	record = reserve(t, s, "key", "batch")
+	if record == nil || !record.Partial {
+		t.Fatalf("Reserve after Release = %+v, want the partial record again", record)
+	}
+
+	// Once finished, the full response is replayed
+	complete(t, s, "key", Record{Status: 202, Body: []byte("done"), CreatedAt: time.Now()})
+	record = reserve(t, s, "key", "batch")
+	if record == nil || record.Partial || string(record.Body) != "done" {
+		t.Errorf("Reserve after finishing = %+v, want the complete record", record)
+	}
+}
+
+func TestAbandonedPartialRecordIsRestored(t *testing.T) {
+	s := NewMemoryStore(time.Hour)
+	reserve(t, s, "key", "batch")
+	complete(t, s, "key", Record{Status: 207, Body: []byte("partial"), CreatedAt: time.Now(), Partial: true})
+	reserve(t, s, "key", "batch")
+
+	// The retry finishing it never completes; once its reservation times out
+	// the partial record is handed to the next retry
+	s.mu.Lock()
+	s.entries["key"].expires = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+
+	record := reserve(t, s, "key", "batch")
+	if record == nil || !record.Partial || string(record.Body) != "partial" {
+		t.Errorf("Reserve after the timeout = %+v, want the partial record", record)
+	}
+}
+
+func TestCompleteNeedsAReservation(t *testing.T) {
+	s := NewMemoryStore(time.Hour)
+	if err := s.Complete(ctx, "key", Record{Status: 202}); err == nil {
+		t.Error("Complete without Reserve succeeded, want an error")
+	}
+}
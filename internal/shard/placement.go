@@ -0,0 +1,56 @@
+package shard
+
+import "fmt"
+
+// Placement decides whose shard stores a comment or like
+type Placement string
+
+const (
+	// PlaceByAuthor stores a row on the shard of the user who wrote it
+	PlaceByAuthor Placement = "author"
+	// PlaceByPost stores a row on the shard of the post it belongs to, i.e. the
+	// shard of the post's author
+	PlaceByPost Placement = "post"
+)
+
+// Placements holds the placement of every table that can be co-located with
+// its post. Posts themselves are always placed by author.
+type Placements struct {
+	Comments Placement
+	Likes    Placement
+}
+
+// LoadPlacements reads COMMENT_PLACEMENT and LIKE_PLACEMENT ("author" or
+// "post", default "author"). Every service must use the same values.
+func LoadPlacements() (Placements, error) {
+	comments, err := parsePlacement("COMMENT_PLACEMENT")
+	if err != nil {
+		return Placements{}, err
+	}
+	likes, err := parsePlacement("LIKE_PLACEMENT")
+	if err != nil {
+		return Placements{}, err
+	}
+	return Placements{Comments: comments, Likes: likes}, nil
+}
+
+// For returns the placement of a table
+func (p Placements) For(table string) Placement {
+	switch table {
+	case "comments":
+		return p.Comments
+	case "likes":
+		return p.Likes
+	default:
+		return PlaceByAuthor
+	}
+}
+
+func parsePlacement(key string) (Placement, error) {
+	switch placement := Placement(getEnv(key, string(PlaceByAuthor))); placement {
+	case PlaceByAuthor, PlaceByPost:
+		return placement, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q: must be %q or %q", key, placement, PlaceByAuthor, PlaceByPost)
+	}
+}
@@ -0,0 +1,225 @@
+// Package shard loads the shard map from the master database and routes keys
+// to shards. Every service routes through it, so a key always lands on the same
+// shard no matter which service looks it up.
+package shard
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+
+	"social-media-db/internal/hashring"
+)
+
+// Config describes one shard as stored in the master `shards` table
+type Config struct {
+	ID       uint32 `json:"id"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Database string `json:"db_name"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Weight   int    `json:"weight"`
+}
+
+// ConnectionString returns the lib/pq DSN of the shard
+func (c Config) ConnectionString() string {
+	return fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		c.Host, c.Port, c.Username, c.Password, c.Database,
+	)
+}
+
+// Router maps keys to shards and hands out their connection pools
+type Router interface {
+	// ShardFor returns the shard that owns key
+	ShardFor(key string) uint32
+	// All returns every shard ordered by ID
+	All() []Config
+	// DB returns the connection pool of a shard, or nil if it is unknown
+	DB(id uint32) *sql.DB
+}
+
+// RingRouter routes keys with a consistent-hash ring over the shard weights
+type RingRouter struct {
+	configs []Config
+	ring    *hashring.Ring
+	dbs     map[uint32]*sql.DB
+}
+
+// NewRingRouter builds a router from shard configs and their pools. dbs may be
+// nil when only routing decisions are needed.
+func NewRingRouter(configs []Config, dbs map[uint32]*sql.DB, virtualNodes int) (*RingRouter, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no shards found in configuration")
+	}
+
+	nodes := make([]hashring.Node, 0, len(configs))
+	for _, config := range configs {
+		nodes = append(nodes, hashring.Node{ID: config.ID, Weight: config.Weight})
+	}
+
+	ring, err := hashring.New(nodes, virtualNodes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build shard ring: %w", err)
+	}
+
+	sorted := append([]Config(nil), configs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	return &RingRouter{
+		configs: sorted,
+		ring:    ring,
+		dbs:     dbs,
+	}, nil
+}
+
+func (r *RingRouter) ShardFor(key string) uint32 {
+	return r.ring.Get(key)
+}
+
+func (r *RingRouter) All() []Config {
+	return append([]Config(nil), r.configs...)
+}
+
+func (r *RingRouter) DB(id uint32) *sql.DB {
+	return r.dbs[id]
+}
+
+func (r *RingRouter) config(id uint32) (Config, bool) {
+	for _, config := range r.configs {
+		if config.ID == id {
+			return config, true
+		}
+	}
+	return Config{}, false
+}
+
+// Close closes every shard connection pool
+func (r *RingRouter) Close() error {
+	for _, db := range r.dbs {
+		db.Close()
+	}
+	return nil
+}
+
+// OpenMaster opens the master database configured by the PG_MASTER_* variables
+func OpenMaster() (*sql.DB, error) {
+	masterDB, err := sql.Open("postgres", fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		getEnv("PG_MASTER_HOST", "localhost"),
+		getEnv("PG_MASTER_PORT", "5440"),
+		getEnv("PG_MASTER_USER", "postgres"),
+		getEnv("PG_MASTER_PASS", "Genius171317@"),
+		getEnv("PG_MASTER_DB", "master"),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to master DB: %w", err)
+	}
+	return masterDB, nil
+}
+
+// LoadConfig reads the shard map from the master database
+func LoadConfig(masterDB *sql.DB, logger *logrus.Logger) ([]Config, error) {
+	return loadConfig(context.Background(), masterDB, logger)
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func loadConfig(ctx context.Context, q querier, logger *logrus.Logger) ([]Config, error) {
+	rows, err := q.QueryContext(ctx, "SELECT shard_id, host, port, db_name, username, password, weight FROM shards ORDER BY shard_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shards: %w", err)
+	}
+	defer rows.Close()
+
+	var configs []Config
+	for rows.Next() {
+		var config Config
+		err := rows.Scan(&config.ID, &config.Host, &config.Port, &config.Database, &config.Username, &config.Password, &config.Weight)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan shard row: %w", err)
+		}
+
+		configs = append(configs, config)
+		logger.WithFields(logrus.Fields{
+			"shard_id": config.ID,
+			"host":     config.Host,
+			"port":     config.Port,
+			"weight":   config.Weight,
+		}).Info("Loaded shard configuration")
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read shards: %w", err)
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no shards found in configuration")
+	}
+
+	return configs, nil
+}
+
+// Connect opens and pings a connection pool for every shard
+func Connect(configs []Config, logger *logrus.Logger) (map[uint32]*sql.DB, error) {
+	dbs := make(map[uint32]*sql.DB)
+
+	for _, config := range configs {
+		db, err := open(config)
+		if err != nil {
+			for _, opened := range dbs {
+				opened.Close()
+			}
+			return nil, err
+		}
+
+		dbs[config.ID] = db
+		logger.WithField("shard_id", config.ID).Info("Connected to database shard")
+	}
+
+	return dbs, nil
+}
+
+func open(config Config) (*sql.DB, error) {
+	db, err := sql.Open("postgres", config.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open connection to shard %d: %w", config.ID, err)
+	}
+
+	// Test the connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping shard %d: %w", config.ID, err)
+	}
+
+	// Configure connection pool
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(time.Hour)
+
+	return db, nil
+}
+
+// VirtualNodes returns the ring's virtual nodes per unit of weight (SHARD_VIRTUAL_NODES)
+func VirtualNodes() int {
+	if value, err := strconv.Atoi(os.Getenv("SHARD_VIRTUAL_NODES")); err == nil && value > 0 {
+		return value
+	}
+	return hashring.DefaultVirtualNodes
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
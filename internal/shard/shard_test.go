@@ -0,0 +1,184 @@
+package shard
+
+import (
+	"database/sql"
+	"strconv"
+	"testing"
+
+	"social-media-db/internal/hashring"
+)
+
+func configs(weights ...int) []Config {
+	out := make([]Config, len(weights))
+	for i, weight := range weights {
+		out[i] = Config{ID: uint32(i + 1), Host: "shard" + strconv.Itoa(i+1), Weight: weight}
+	}
+	return out
+}
+
+func TestNewRingRouterRejectsInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []Config
+	}{
+		{"no shards", nil},
+		{"only zero weights", configs(0, 0)},
+		{"negative weight", configs(1, -1)},
+		{"duplicate shard", []Config{{ID: 1, Weight: 1}, {ID: 1, Weight: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRingRouter(tt.configs, nil, 0); err == nil {
+				t.Fatal("NewRingRouter succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestRingRouterLookups(t *testing.T) {
+	pools := map[uint32]*sql.DB{1: new(sql.DB), 2: new(sql.DB), 3: new(sql.DB)}
+	ordered := configs(1, 1, 1)
+	shuffled := []Config{ordered[2], ordered[0], ordered[1]}
+
+	router, err := NewRingRouter(shuffled, pools, hashring.DefaultVirtualNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("All", func(t *testing.T) {
+		all := router.All()
+		if len(all) != 3 {
+			t.Fatalf("All() returned %d shards, want 3", len(all))
+		}
+		for i, config := range all {
+			if config.ID != uint32(i+1) {
+				t.Fatalf("All() = %v, want shards ordered by ID", all)
+			}
+		}
+		all[0].Host = "changed"
+		if router.All()[0].Host != "shard1" {
+			t.Error("changing the result of All() changed the router")
+		}
+	})
+
+	t.Run("DB", func(t *testing.T) {
+		tests := []struct {
+			id   uint32
+			want *sql.DB
+		}{
+			{1, pools[1]},
+			{2, pools[2]},
+			{3, pools[3]},
+			{4, nil},
+		}
+		for _, tt := range tests {
+			if got := router.DB(tt.id); got != tt.want {
+				t.Errorf("DB(%d) = %p, want %p", tt.id, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("config", func(t *testing.T) {
+		tests := []struct {
+			id     uint32
+			want   string
+			wantOK bool
+		}{
+			{1, "shard1", true},
+			{3, "shard3", true},
+			{4, "", false},
+		}
+		for _, tt := range tests {
+			config, ok := router.config(tt.id)
+			if ok != tt.wantOK || config.Host != tt.want {
+				t.Errorf("config(%d) = %q, %v, want %q, %v", tt.id, config.Host, ok, tt.want, tt.wantOK)
+			}
+		}
+	})
+
+	t.Run("ShardFor", func(t *testing.T) {
+		nodes := []hashring.Node{{ID: 1, Weight: 1}, {ID: 2, Weight: 1}, {ID: 3, Weight: 1}}
+		ring, err := hashring.New(nodes, hashring.DefaultVirtualNodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen := make(map[uint32]bool)
+		for i := 0; i < 1000; i++ {
+			key := "user-" + strconv.Itoa(i)
+			got := router.ShardFor(key)
+			if want := ring.Get(key); got != want {
+				t.Fatalf("ShardFor(%q) = %d, want %d as on the ring", key, got, want)
+			}
+			if router.DB(got) == nil {
+				t.Fatalf("ShardFor(%q) = %d, which has no pool", key, got)
+			}
+			seen[got] = true
+		}
+		if len(seen) != 3 {
+			t.Errorf("keys landed on %d shards, want all 3", len(seen))
+		}
+	})
+}
+
+func TestAddingAShardMovesKeysOnlyToIt(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []Config
+		after  []Config
+		added  uint32
+	}{
+		{"three to four", configs(1, 1, 1), configs(1, 1, 1, 1), 4},
+		{"weighted", configs(2, 1), configs(2, 1, 1), 3},
+		{"drained shard filled", configs(1, 1, 0), configs(1, 1, 1), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := NewRingRouter(tt.before, nil, hashring.DefaultVirtualNodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := NewRingRouter(tt.after, nil, hashring.DefaultVirtualNodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			moved := 0
+			for i := 0; i < 10000; i++ {
+				key := "user-" + strconv.Itoa(i)
+				from, to := before.ShardFor(key), after.ShardFor(key)
+				if from == to {
+					continue
+				}
+				moved++
+				if to != tt.added {
+					t.Fatalf("key %q moved from shard %d to %d, want only moves to shard %d", key, from, to, tt.added)
+				}
+			}
+			if moved == 0 {
+				t.Errorf("no key moved to shard %d", tt.added)
+			}
+		})
+	}
+}
+
+func TestVirtualNodes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", hashring.DefaultVirtualNodes},
+		{"64", 64},
+		{"0", hashring.DefaultVirtualNodes},
+		{"-5", hashring.DefaultVirtualNodes},
+		{"many", hashring.DefaultVirtualNodes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("SHARD_VIRTUAL_NODES", tt.value)
+			if got := VirtualNodes(); got != tt.want {
+				t.Errorf("VirtualNodes() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
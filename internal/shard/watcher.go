@@ -0,0 +1,227 @@
+package shard
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Watcher keeps a router in sync with the versioned shard map in the master
+// database. When the version changes it builds a new router, swaps it in
+// atomically and closes the pools that are no longer used once in-flight work
+// had time to finish.
+//
+// Watcher implements Router by delegating to the current router. Callers that
+// route and then query should take a snapshot with Current so both steps see
+// the same map.
+type Watcher struct {
+	masterDB     *sql.DB
+	logger       *logrus.Logger
+	pollInterval time.Duration
+	drainTimeout time.Duration
+
+	mu      sync.Mutex // serializes reloads
+	current atomic.Pointer[RingRouter]
+	version atomic.Int64
+}
+
+// NewWatcher loads the current shard map and connects to every shard.
+// SHARD_MAP_POLL_INTERVAL and SHARD_POOL_DRAIN_TIMEOUT tune the reload.
+func NewWatcher(logger *logrus.Logger) (*Watcher, error) {
+	masterDB, err := OpenMaster()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		masterDB:     masterDB,
+		logger:       logger,
+		pollInterval: getEnvDuration("SHARD_MAP_POLL_INTERVAL", 10*time.Second),
+		drainTimeout: getEnvDuration("SHARD_POOL_DRAIN_TIMEOUT", 30*time.Second),
+	}
+
+	if err := w.Reload(context.Background()); err != nil {
+		masterDB.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Current returns the router for the active shard map
+func (w *Watcher) Current() Router {
+	return w.current.Load()
+}
+
+// Master returns the connection pool of the master database
+func (w *Watcher) Master() *sql.DB {
+	return w.masterDB
+}
+
+// Version returns the version of the active shard map
+func (w *Watcher) Version() int64 {
+	return w.version.Load()
+}
+
+func (w *Watcher) ShardFor(key string) uint32 {
+	return w.current.Load().ShardFor(key)
+}
+
+func (w *Watcher) All() []Config {
+	return w.current.Load().All()
+}
+
+func (w *Watcher) DB(id uint32) *sql.DB {
+	return w.current.Load().DB(id)
+}
+
+// Run polls the shard map version until ctx is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Reload(ctx); err != nil {
+				w.logger.WithError(err).Error("Failed to reload shard map")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Reload swaps in the shard map from the master database if its version changed
+func (w *Watcher) Reload(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var version int64
+	if err := w.masterDB.QueryRowContext(ctx, "SELECT version FROM shard_map_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read shard map version: %w", err)
+	}
+
+	old := w.current.Load()
+	if old != nil && version == w.version.Load() {
+		return nil
+	}
+
+	version, configs, err := w.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Reuse the pools of shards whose connection settings did not change
+	reused := make(map[*sql.DB]bool)
+	dbs := make(map[uint32]*sql.DB)
+	var opened []*sql.DB
+	for _, config := range configs {
+		if old != nil {
+			if previous, ok := old.config(config.ID); ok && previous.ConnectionString() == config.ConnectionString() {
+				db := old.DB(config.ID)
+				dbs[config.ID] = db
+				reused[db] = true
+				continue
+			}
+		}
+
+		db, err := open(config)
+		if err != nil {
+			for _, db := range opened {
+				db.Close()
+			}
+			return err
+		}
+		dbs[config.ID] = db
+		opened = append(opened, db)
+		w.logger.WithField("shard_id", config.ID).Info("Connected to database shard")
+	}
+
+	router, err := NewRingRouter(configs, dbs, VirtualNodes())
+	if err != nil {
+		for _, db := range opened {
+			db.Close()
+		}
+		return err
+	}
+
+	w.current.Store(router)
+	w.version.Store(version)
+	w.logger.WithFields(logrus.Fields{
+		"version": version,
+		"shards":  len(configs),
+	}).Info("Shard map activated")
+
+	if old != nil {
+		var retired []*sql.DB
+		for _, db := range old.dbs {
+			if !reused[db] {
+				retired = append(retired, db)
+			}
+		}
+		w.drain(retired)
+	}
+
+	return nil
+}
+
+// load reads the version and the shards it describes from one snapshot
+func (w *Watcher) load(ctx context.Context) (int64, []Config, error) {
+	tx, err := w.masterDB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin shard map transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var version int64
+	if err := tx.QueryRowContext(ctx, "SELECT version FROM shard_map_version").Scan(&version); err != nil {
+		return 0, nil, fmt.Errorf("failed to read shard map version: %w", err)
+	}
+
+	configs, err := loadConfig(ctx, tx, w.logger)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to load shard config: %w", err)
+	}
+
+	return version, configs, nil
+}
+
+// drain closes retired pools once in-flight queries had time to complete
+func (w *Watcher) drain(retired []*sql.DB) {
+	if len(retired) == 0 {
+		return
+	}
+
+	go func() {
+		time.Sleep(w.drainTimeout)
+		for _, db := range retired {
+			db.Close()
+		}
+		w.logger.WithField("pools", len(retired)).Info("Closed retired shard connection pools")
+	}()
+}
+
+// Close closes the master connection and every shard pool
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if router := w.current.Load(); router != nil {
+		router.Close()
+	}
+	return w.masterDB.Close()
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
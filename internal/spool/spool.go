@@ -0,0 +1,479 @@
+// Package spool is a disk-backed write-ahead queue for events that could not
+// be handed to Kafka. Records are appended to segment files and fsynced before
+// Append returns; Read and Ack consume them in the order they were written.
+//
+// On disk a spool is a directory of segment files named by sequence number
+// (00000000000000000001.seg, ...) plus a checkpoint file recording how far the
+// oldest segment has been drained. Each record is a 4-byte big-endian length,
+// a 4-byte CRC-32 of the payload and the payload itself. Drained segments are
+// deleted.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentSuffix  = ".seg"
+	checkpointFile = "checkpoint"
+	headerSize     = 8
+)
+
+// Message is a spooled Kafka message
+type Message struct {
+	Topic       string `json:"topic"`
+	Key         string `json:"key"`
+	Value       []byte `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Spool is safe for concurrent use by one writer path and one drainer
+type Spool struct {
+	dir          string
+	segmentBytes int64
+
+	mu       sync.Mutex
+	segments []uint64    // sequence numbers, oldest first
+	active   segmentFile // last segment, open for appending
+	size     int64       // size of the active segment
+	readSeq  uint64      // segment being drained
+	readPos  int64       // offset of the next undrained record in readSeq
+	depth    int         // undrained records
+	unacked  []int64     // sizes of the records returned by the last Read
+}
+
+// segmentFile is the part of *os.File the active segment is written through
+type segmentFile interface {
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+// Open opens or creates the spool in dir. A new segment is started once the
+// active one exceeds segmentBytes.
+func Open(dir string, segmentBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Spool{dir: dir, segmentBytes: segmentBytes}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if err := s.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	// Count what is left to drain and drop a torn record at the tail (a crash
+	// during Append), which was never acknowledged to a client
+	for _, seq := range s.segments {
+		from := int64(0)
+		if seq == s.readSeq {
+			from = s.readPos
+		}
+		count, valid, err := s.scan(seq, from)
+		if err != nil {
+			return nil, err
+		}
+		s.depth += count
+		if seq == s.segments[len(s.segments)-1] {
+			if err := os.Truncate(s.path(seq), valid); err != nil {
+				return nil, fmt.Errorf("failed to repair spool segment %d: %w", seq, err)
+			}
+		}
+	}
+
+	if len(s.segments) > 0 {
+		if err := s.openActive(s.segments[len(s.segments)-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Make the directory itself and the segments removed above durable
+	if err := s.syncDir(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Append writes a message and fsyncs it before returning
+func (s *Spool) Append(msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode spool record: %w", err)
+	}
+
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[headerSize:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil || s.size >= s.segmentBytes {
+		// Numbering never goes back below the checkpoint, so a new segment is
+		// never mistaken for a drained one
+		next := s.readSeq
+		if len(s.segments) > 0 {
+			next = s.segments[len(s.segments)-1] + 1
+		}
+		if next == 0 {
+			next = 1
+		}
+		if err := s.openActive(next); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, next)
+		if len(s.segments) == 1 {
+			s.readSeq, s.readPos = next, 0
+		}
+	}
+
+	if _, err := s.active.Write(record); err != nil {
+		return s.rollback(fmt.Errorf("failed to write spool record: %w", err))
+	}
+	if err := s.active.Sync(); err != nil {
+		return s.rollback(fmt.Errorf("failed to sync spool segment: %w", err))
+	}
+
+	s.size += int64(len(record))
+	s.depth++
+	return nil
+}
+
+// rollback cuts the active segment back to its last complete record after a
+// failed Append, so a torn record never ends up in front of later ones. When
+// that fails too, the segment is closed and the next Append starts a new one.
+// Callers hold mu.
+func (s *Spool) rollback(cause error) error {
+	err := s.active.Truncate(s.size)
+	if err == nil {
+		_, err = s.active.Seek(s.size, io.SeekStart)
+	}
+	if err != nil {
+		s.active.Close()
+		s.active = nil
+		return fmt.Errorf("%w (and failed to repair segment: %v)", cause, err)
+	}
+	return cause
+}
+
+// Read returns up to max of the oldest undrained messages without consuming
+// them; Ack consumes them. It may return fewer at a segment boundary.
+func (s *Spool) Read(max int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unacked = nil
+	for s.depth > 0 {
+		messages, sizes, err := s.readSegment(max)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			s.unacked = sizes
+			return messages, nil
+		}
+
+		// The oldest segment is exhausted: move on to the next one
+		if len(s.segments) < 2 {
+			break
+		}
+		if err := s.retireOldest(); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// readSegment reads up to max records from the drain position; callers hold mu
+func (s *Spool) readSegment(max int) ([]Message, []int64, error) {
+	file, err := os.Open(s.path(s.readSeq))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open spool segment %d: %w", s.readSeq, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(s.readPos, io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("failed to seek spool segment %d: %w", s.readSeq, err)
+	}
+
+	reader := bufio.NewReader(file)
+	var messages []Message
+	var sizes []int64
+	for len(messages) < max {
+		payload, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read spool segment %d: %w", s.readSeq, err)
+		}
+
+		var msg Message
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode spool record: %w", err)
+		}
+		messages = append(messages, msg)
+		sizes = append(sizes, int64(headerSize+len(payload)))
+	}
+
+	return messages, sizes, nil
+}
+
+// Ack consumes the first n messages returned by the last Read
+func (s *Spool) Ack(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > len(s.unacked) {
+		return fmt.Errorf("cannot ack %d spool records, only %d were read", n, len(s.unacked))
+	}
+	for _, size := range s.unacked[:n] {
+		s.readPos += size
+		s.depth--
+	}
+	s.unacked = s.unacked[n:]
+
+	// Fully drained: start over with an empty spool
+	if s.depth == 0 {
+		return s.reset()
+	}
+
+	return s.saveCheckpoint()
+}
+
+// Depth returns the number of undrained messages
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active != nil {
+		return s.active.Close()
+	}
+	return nil
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+func (s *Spool) openActive(seq uint64) error {
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+
+	file, err := os.OpenFile(s.path(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment %d: %w", seq, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat spool segment %d: %w", seq, err)
+	}
+
+	// The segment may have just been created
+	if err := s.syncDir(); err != nil {
+		file.Close()
+		return err
+	}
+
+	s.active = file
+	s.size = info.Size()
+	return nil
+}
+
+// retireOldest deletes the drained oldest segment; callers hold mu
+func (s *Spool) retireOldest() error {
+	if err := os.Remove(s.path(s.segments[0])); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove spool segment %d: %w", s.segments[0], err)
+	}
+	s.segments = s.segments[1:]
+	s.readSeq, s.readPos = s.segments[0], 0
+	return s.saveCheckpoint()
+}
+
+// reset deletes every segment once all records are drained; callers hold mu
+func (s *Spool) reset() error {
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+	for _, seq := range s.segments {
+		if err := os.Remove(s.path(seq)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove spool segment %d: %w", seq, err)
+		}
+	}
+	last := uint64(0)
+	if len(s.segments) > 0 {
+		last = s.segments[len(s.segments)-1]
+	}
+	s.segments = nil
+	s.size = 0
+	// Keep numbering forward so a stale checkpoint never matches a new segment
+	s.readSeq, s.readPos = last+1, 0
+	return s.saveCheckpoint()
+}
+
+func (s *Spool) loadCheckpoint() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, checkpointFile))
+	if os.IsNotExist(err) {
+		if len(s.segments) > 0 {
+			s.readSeq = s.segments[0]
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spool checkpoint: %w", err)
+	}
+
+	var seq uint64
+	var pos int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &pos); err != nil {
+		return fmt.Errorf("invalid spool checkpoint: %w", err)
+	}
+
+	// Segments before the checkpoint were drained but not yet deleted
+	for len(s.segments) > 0 && s.segments[0] < seq {
+		if err := os.Remove(s.path(s.segments[0])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove spool segment %d: %w", s.segments[0], err)
+		}
+		s.segments = s.segments[1:]
+	}
+
+	s.readSeq, s.readPos = seq, pos
+	if len(s.segments) > 0 && s.segments[0] != seq {
+		s.readSeq, s.readPos = s.segments[0], 0
+	}
+	return nil
+}
+
+// saveCheckpoint atomically and durably records the drain position. Syncing
+// the directory also makes the segment removals before it durable; callers
+// hold mu.
+func (s *Spool) saveCheckpoint() error {
+	path := filepath.Join(s.dir, checkpointFile)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write spool checkpoint: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "%d %d\n", s.readSeq, s.readPos)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write spool checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write spool checkpoint: %w", err)
+	}
+	return s.syncDir()
+}
+
+// syncDir fsyncs the spool directory, so that the segments and checkpoints
+// created, renamed or removed in it survive a crash
+func (s *Spool) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to open spool directory: %w", err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool directory: %w", err)
+	}
+	return nil
+}
+
+// scan counts the complete records of a segment from an offset and returns the
+// offset just past the last one
+func (s *Spool) scan(seq uint64, from int64) (int, int64, error) {
+	file, err := os.Open(s.path(seq))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open spool segment %d: %w", seq, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(from, io.SeekStart); err != nil {
+		return 0, 0, fmt.Errorf("failed to seek spool segment %d: %w", seq, err)
+	}
+
+	reader := bufio.NewReader(file)
+	count, valid := 0, from
+	for {
+		payload, err := readRecord(reader)
+		if err != nil {
+			// io.EOF, a torn tail or a corrupt record all end the segment
+			return count, valid, nil
+		}
+		count++
+		valid += int64(headerSize + len(payload))
+	}
+}
+
+var errCorrupt = errors.New("corrupt spool record")
+
+func readRecord(reader *bufio.Reader) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF // torn header from an interrupted write
+		}
+		return nil, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errCorrupt
+	}
+	return payload, nil
+}
@@ -0,0 +1,375 @@
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func openSpool(t *testing.T, dir string, segmentBytes int64) *Spool {
+	t.Helper()
+	s, err := Open(dir, segmentBytes)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func appendKeys(t *testing.T, s *Spool, from, n int) {
+	t.Helper()
+	for i := from; i < from+n; i++ {
+		msg := Message{Topic: "posts", Key: "k-" + strconv.Itoa(i), Value: []byte(`{"n":` + strconv.Itoa(i) + `}`)}
+		if err := s.Append(msg); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func keyRange(from, to int) []string {
+	var keys []string
+	for i := from; i < to; i++ {
+		keys = append(keys, "k-"+strconv.Itoa(i))
+	}
+	return keys
+}
+
+// drain reads and acks every message left, batch by batch
+func drain(t *testing.T, s *Spool, batch int) []string {
+	t.Helper()
+	var keys []string
+	for {
+		messages, err := s.Read(batch)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if len(messages) == 0 {
+			return keys
+		}
+		for _, msg := range messages {
+			keys = append(keys, msg.Key)
+		}
+		if err := s.Ack(len(messages)); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func appendToFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingSegment fails the next write halfway through, or the next sync
+type failingSegment struct {
+	segmentFile
+	failWrite bool
+	failSync  bool
+}
+
+func (f *failingSegment) Write(p []byte) (int, error) {
+	if f.failWrite {
+		n, _ := f.segmentFile.Write(p[:len(p)/2])
+		return n, io.ErrShortWrite
+	}
+	return f.segmentFile.Write(p)
+}
+
+func (f *failingSegment) Sync() error {
+	if f.failSync {
+		return errors.New("sync failed")
+	}
+	return f.segmentFile.Sync()
+}
+
+func TestFailedAppendLeavesNoTornRecord(t *testing.T) {
+	tests := []struct {
+		name      string
+		failWrite bool
+		failSync  bool
+	}{
+		{"short write", true, false},
+		{"failed sync", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(dir, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendKeys(t, s, 0, 3)
+			segments := segmentFiles(t, dir)
+			if len(segments) != 1 {
+				t.Fatalf("found %d segments, want 1", len(segments))
+			}
+			before, err := os.Stat(segments[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			failing := &failingSegment{segmentFile: s.active, failWrite: tt.failWrite, failSync: tt.failSync}
+			s.active = failing
+			if err := s.Append(Message{Topic: "posts", Key: "failed"}); err == nil {
+				t.Fatal("Append succeeded, want an error")
+			}
+			after, err := os.Stat(segments[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Size() != before.Size() {
+				t.Errorf("segment is %d bytes after the failed Append, want %d", after.Size(), before.Size())
+			}
+			if got := s.Depth(); got != 3 {
+				t.Errorf("Depth() = %d after the failed Append, want 3", got)
+			}
+
+			// Later records follow the last good one, before and after reopening
+			failing.failWrite, failing.failSync = false, false
+			appendKeys(t, s, 3, 2)
+			s.Close()
+
+			s = openSpool(t, dir, 1<<20)
+			if got := s.Depth(); got != 5 {
+				t.Errorf("Depth() = %d after reopening, want 5", got)
+			}
+			if got, want := drain(t, s, 10), keyRange(0, 5); !reflect.DeepEqual(got, want) {
+				t.Errorf("drained %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestOpenRepairsDamagedTail(t *testing.T) {
+	payload := []byte(`{"topic":"posts","key":"lost"}`)
+	header := func(length int, crc uint32) []byte {
+		h := make([]byte, headerSize)
+		binary.BigEndian.PutUint32(h[0:4], uint32(length))
+		binary.BigEndian.PutUint32(h[4:8], crc)
+		return h
+	}
+
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{"torn header", header(len(payload), 0)[:5]},
+		{"torn payload", append(header(len(payload), crc32.ChecksumIEEE(payload)), payload[:10]...)},
+		{"bad checksum", append(header(len(payload), crc32.ChecksumIEEE(payload)+1), payload...)},
+		{"garbage length", append(header(1<<20, 0), payload...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(dir, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendKeys(t, s, 0, 3)
+			s.Close()
+
+			segments := segmentFiles(t, dir)
+			if len(segments) != 1 {
+				t.Fatalf("found %d segments, want 1", len(segments))
+			}
+			info, err := os.Stat(segments[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendToFile(t, segments[0], tt.tail)
+
+			// A crash during Append leaves the tail behind; reopening drops it
+			s = openSpool(t, dir, 1<<20)
+			if got := s.Depth(); got != 3 {
+				t.Errorf("Depth() = %d after reopening, want 3", got)
+			}
+			repaired, err := os.Stat(segments[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repaired.Size() != info.Size() {
+				t.Errorf("segment is %d bytes after reopening, want %d", repaired.Size(), info.Size())
+			}
+
+			// New records follow the last good one and stay readable
+			appendKeys(t, s, 3, 2)
+			if got, want := drain(t, s, 10), keyRange(0, 5); !reflect.DeepEqual(got, want) {
+				t.Errorf("drained %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReopenResumesFromCheckpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		// segmentBytes small enough puts every record in its own segment
+		segmentBytes int64
+		read         int
+		ack          int
+		want         []string
+	}{
+		{"nothing read", 1 << 20, 0, 0, keyRange(0, 10)},
+		{"read, not acked", 1 << 20, 4, 0, keyRange(0, 10)},
+		{"partly acked", 1 << 20, 4, 2, keyRange(2, 10)},
+		{"batch acked", 1 << 20, 4, 4, keyRange(4, 10)},
+		{"one record per segment", 1, 1, 1, keyRange(1, 10)},
+		{"segment boundary, partly acked", 100, 4, 1, keyRange(1, 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(dir, tt.segmentBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendKeys(t, s, 0, 10)
+			if tt.read > 0 {
+				messages, err := s.Read(tt.read)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(messages) < tt.ack {
+					t.Fatalf("Read returned %d messages, need %d to ack", len(messages), tt.ack)
+				}
+				if err := s.Ack(tt.ack); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.Close()
+
+			s = openSpool(t, dir, tt.segmentBytes)
+			if got := s.Depth(); got != len(tt.want) {
+				t.Errorf("Depth() = %d after reopening, want %d", got, len(tt.want))
+			}
+			if got := drain(t, s, 3); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("drained %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAckedSegmentsAreRemoved(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpool(t, dir, 1) // one record per segment
+	appendKeys(t, s, 0, 4)
+
+	if got := len(segmentFiles(t, dir)); got != 4 {
+		t.Fatalf("found %d segments, want 4", got)
+	}
+
+	// Reads stop at a segment boundary; the drained segment goes once the
+	// next read moves past it
+	for i := 0; i < 3; i++ {
+		messages, err := s.Read(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || messages[0].Key != "k-"+strconv.Itoa(i) {
+			t.Fatalf("Read returned %v, want only k-%d", messages, i)
+		}
+		if got, want := len(segmentFiles(t, dir)), 4-i; got != want {
+			t.Errorf("found %d segments before acking k-%d, want %d", got, i, want)
+		}
+		if err := s.Ack(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Acking the last record removes every segment
+	if got := drain(t, s, 10); !reflect.DeepEqual(got, []string{"k-3"}) {
+		t.Fatalf("drained %v, want [k-3]", got)
+	}
+	if got := segmentFiles(t, dir); len(got) != 0 {
+		t.Errorf("segments left after draining: %v", got)
+	}
+	if got := s.Depth(); got != 0 {
+		t.Errorf("Depth() = %d after draining, want 0", got)
+	}
+
+	// Numbering moves forward, so the checkpoint never matches a new segment
+	appendKeys(t, s, 4, 1)
+	segments := segmentFiles(t, dir)
+	if len(segments) != 1 || filepath.Base(segments[0]) != "00000000000000000005.seg" {
+		t.Errorf("segments after appending again: %v, want [00000000000000000005.seg]", segments)
+	}
+	if got := drain(t, s, 10); !reflect.DeepEqual(got, []string{"k-4"}) {
+		t.Errorf("drained %v, want [k-4]", got)
+	}
+}
+
+func TestOpenRemovesSegmentsBeforeCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendKeys(t, s, 0, 3)
+	drained := filepath.Join(dir, "00000000000000000001.seg")
+	contents, err := os.ReadFile(drained)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drain the first segment and move on to the second
+	if _, err := s.Read(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Read(10); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// A crash between the checkpoint and the delete leaves the segment behind
+	if err := os.WriteFile(drained, contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openSpool(t, dir, 1)
+	if _, err := os.Stat(drained); !os.IsNotExist(err) {
+		t.Errorf("drained segment still exists after reopening (err %v)", err)
+	}
+	if got, want := drain(t, s, 10), keyRange(1, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("drained %v, want %v", got, want)
+	}
+}
+
+func TestAckMoreThanRead(t *testing.T) {
+	s := openSpool(t, t.TempDir(), 1<<20)
+	appendKeys(t, s, 0, 3)
+
+	if _, err := s.Read(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ack(3); err == nil {
+		t.Error("Ack(3) after reading 2 succeeded, want an error")
+	}
+	if got := s.Depth(); got != 3 {
+		t.Errorf("Depth() = %d, want 3", got)
+	}
+}
@@ -0,0 +1,266 @@
+// Package stats maintains the per-post counters in post_stats, stored on the
+// shard of the post. Comments and likes may live on other shards, so a counter
+// cannot change in the same transaction as the row it counts. Instead the
+// consumer records the delta of each event next to the row it changed, keyed
+// by event ID, and Apply adds it to post_stats exactly once. A retried event
+// therefore neither loses nor doubles its increment.
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Delta is the change an event makes to the counters of a post
+type Delta struct {
+	Comments        int    // +1 for a new comment, -1 for a deleted one
+	ReactionAdded   string // reaction given, if any
+	ReactionRemoved string // reaction taken back, if any
+}
+
+// IsZero reports whether the delta changes no counter
+func (d Delta) IsZero() bool {
+	return d.Comments == 0 && d.ReactionAdded == d.ReactionRemoved
+}
+
+// Likes returns the change to the number of reactions. Changing a reaction's
+// type leaves it unchanged.
+func (d Delta) Likes() int {
+	switch {
+	case d.ReactionAdded != "" && d.ReactionRemoved == "":
+		return 1
+	case d.ReactionAdded == "" && d.ReactionRemoved != "":
+		return -1
+	}
+	return 0
+}
+
+// Counts are the counters of a post
+type Counts struct {
+	Comments  int
+	Likes     int
+	Reactions map[string]int
+}
+
+// Record stores the delta of an event in the transaction that changed the
+// counted row. Recording the same event again is a no-op.
+func Record(ctx context.Context, tx *sql.Tx, eventID, postID string, delta Delta) error {
+	if delta.IsZero() {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO post_stats_events (event_id, post_id, comment_delta, reaction_added, reaction_removed)
+		 VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''))
+		 ON CONFLICT (event_id) DO NOTHING`,
+		eventID, postID, delta.Comments, delta.ReactionAdded, delta.ReactionRemoved)
+	if err != nil {
+		return fmt.Errorf("failed to record stats of event %s: %w", eventID, err)
+	}
+	return nil
+}
+
+// Counted turns the write of a comment or like, which returns the change it
+// makes to the counters of postID, into a write that records that change in
+// the same transaction
+func Counted(ctx context.Context, eventID, postID string, write func(tx *sql.Tx) (Delta, error)) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		delta, err := write(tx)
+		if err != nil {
+			return err
+		}
+		return Record(ctx, tx, eventID, postID, delta)
+	}
+}
+
+// Apply adds the delta recorded for an event on rowDB to post_stats on the
+// shard of the post, which postShard returns. It does nothing when the event
+// changed no counter or was already applied, or when postShard returns a nil
+// DB to leave the delta pending.
+func Apply(ctx context.Context, rowDB *sql.DB, eventID string, postShard func(postID string) (*sql.DB, error)) error {
+	var postID string
+	var delta Delta
+	var added, removed sql.NullString
+	err := rowDB.QueryRowContext(ctx,
+		`SELECT post_id, comment_delta, reaction_added, reaction_removed
+		 FROM post_stats_events WHERE event_id = $1 AND NOT applied`,
+		eventID).Scan(&postID, &delta.Comments, &added, &removed)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read stats of event %s: %w", eventID, err)
+	}
+	delta.ReactionAdded, delta.ReactionRemoved = added.String, removed.String
+
+	postDB, err := postShard(postID)
+	if err != nil || postDB == nil {
+		return err
+	}
+	if postDB == rowDB {
+		return applyLocal(ctx, postDB, eventID)
+	}
+
+	tx, err := postDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The post's shard remembers the event, so a retry after a failure below
+	// finds it there and skips the increment
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO post_stats_events (event_id, post_id, comment_delta, reaction_added, reaction_removed, applied)
+		 VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), true)
+		 ON CONFLICT (event_id) DO NOTHING`,
+		eventID, postID, delta.Comments, delta.ReactionAdded, delta.ReactionRemoved)
+	if err != nil {
+		return fmt.Errorf("failed to record stats of event %s: %w", eventID, err)
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		if err := add(ctx, tx, postID, delta); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit stats of event %s: %w", eventID, err)
+	}
+
+	_, err = rowDB.ExecContext(ctx, `UPDATE post_stats_events SET applied = true WHERE event_id = $1`, eventID)
+	if err != nil {
+		return fmt.Errorf("failed to mark stats of event %s applied: %w", eventID, err)
+	}
+	return nil
+}
+
+// Prune deletes the applied deltas recorded before a time and returns how many
+// it deleted. The post's shard needs an applied event for as long as Kafka may
+// deliver the event again, so keep them for the Kafka retention. Pending
+// deltas are kept.
+func Prune(ctx context.Context, db *sql.DB, before time.Time) (int64, error) {
+	result, err := db.ExecContext(ctx,
+		`DELETE FROM post_stats_events WHERE applied AND created_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune applied stats events: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// applyLocal applies a delta recorded on the post's own shard in one transaction
+func applyLocal(ctx context.Context, db *sql.DB, eventID string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var postID string
+	var delta Delta
+	var added, removed sql.NullString
+	err = tx.QueryRowContext(ctx,
+		`UPDATE post_stats_events SET applied = true WHERE event_id = $1 AND NOT applied
+		 RETURNING post_id, comment_delta, reaction_added, reaction_removed`,
+		eventID).Scan(&postID, &delta.Comments, &added, &removed)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read stats of event %s: %w", eventID, err)
+	}
+	delta.ReactionAdded, delta.ReactionRemoved = added.String, removed.String
+
+	if err := add(ctx, tx, postID, delta); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit stats of event %s: %w", eventID, err)
+	}
+	return nil
+}
+
+// add changes the counters of a post by a delta
+func add(ctx context.Context, tx *sql.Tx, postID string, delta Delta) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO post_stats (post_id, comment_count, like_count) VALUES ($1, $2, $3)
+		 ON CONFLICT (post_id) DO UPDATE SET
+			comment_count = post_stats.comment_count + EXCLUDED.comment_count,
+			like_count = post_stats.like_count + EXCLUDED.like_count,
+			updated_at = now()`,
+		postID, delta.Comments, delta.Likes())
+	if err != nil {
+		return fmt.Errorf("failed to update stats of post %s: %w", postID, err)
+	}
+
+	if delta.ReactionAdded == delta.ReactionRemoved {
+		return nil
+	}
+	for _, change := range []struct {
+		reaction string
+		by       int
+	}{{delta.ReactionAdded, 1}, {delta.ReactionRemoved, -1}} {
+		if change.reaction == "" {
+			continue
+		}
+		_, err := tx.ExecContext(ctx,
+			`UPDATE post_stats
+			 SET reactions = reactions || jsonb_build_object($2::text, COALESCE((reactions->>$2)::bigint, 0) + $3)
+			 WHERE post_id = $1`,
+			postID, change.reaction, change.by)
+		if err != nil {
+			return fmt.Errorf("failed to update reactions of post %s: %w", postID, err)
+		}
+	}
+	return nil
+}
+
+// Read returns the counters of a post. Posts without counters have none of
+// their comments or likes counted yet and read as zero.
+func Read(ctx context.Context, db *sql.DB, postID string) (Counts, error) {
+	counts := Counts{Reactions: make(map[string]int)}
+
+	var reactions []byte
+	err := db.QueryRowContext(ctx,
+		`SELECT comment_count, like_count, reactions FROM post_stats WHERE post_id = $1`,
+		postID).Scan(&counts.Comments, &counts.Likes, &reactions)
+	if err == sql.ErrNoRows {
+		return counts, nil
+	}
+	if err != nil {
+		return Counts{}, fmt.Errorf("failed to read stats of post %s: %w", postID, err)
+	}
+
+	var all map[string]int
+	if err := json.Unmarshal(reactions, &all); err != nil {
+		return Counts{}, fmt.Errorf("failed to parse reactions of post %s: %w", postID, err)
+	}
+	for reaction, count := range all {
+		if count != 0 {
+			counts.Reactions[reaction] = count
+		}
+	}
+	return counts, nil
+}
+
+// Write replaces the counters of a post, e.g. after recounting its rows
+func Write(ctx context.Context, db *sql.DB, postID string, counts Counts) error {
+	reactions, err := json.Marshal(counts.Reactions)
+	if err != nil {
+		return fmt.Errorf("failed to encode reactions of post %s: %w", postID, err)
+	}
+
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO post_stats (post_id, comment_count, like_count, reactions) VALUES ($1, $2, $3, $4::jsonb)
+		 ON CONFLICT (post_id) DO UPDATE SET
+			comment_count = EXCLUDED.comment_count,
+			like_count = EXCLUDED.like_count,
+			reactions = EXCLUDED.reactions,
+			updated_at = now()`,
+		postID, counts.Comments, counts.Likes, string(reactions))
+	if err != nil {
+		return fmt.Errorf("failed to write stats of post %s: %w", postID, err)
+	}
+	return nil
+}
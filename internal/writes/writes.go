@@ -0,0 +1,84 @@
+// Package writes holds the shard writes of comments and likes, which change
+// the counters of their post. The consumer and the resharder's dual writes
+// share them, so an event records the same counter change on either path.
+// Each returns the change it made; a write that changed nothing returns a
+// zero Delta.
+package writes
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"social-media-db/internal/events"
+	"social-media-db/internal/stats"
+)
+
+// InsertComment stores a new comment. A comment that is already stored is
+// left as it is.
+func InsertComment(ctx context.Context, tx *sql.Tx, event events.Comment) (stats.Delta, error) {
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO comments (id, post_id, user_id, content, parent_comment_id, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $6)
+		 ON CONFLICT (id) DO NOTHING`,
+		event.ID, event.PostID, event.UserID, event.Content, event.ParentCommentID, event.Timestamp)
+	if err != nil {
+		return stats.Delta{}, fmt.Errorf("failed to insert comment %s: %w", event.ID, err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return stats.Delta{}, nil
+	}
+	return stats.Delta{Comments: 1}, nil
+}
+
+// DeleteComment soft-deletes a comment of event.UserID that is not deleted yet
+func DeleteComment(ctx context.Context, tx *sql.Tx, event events.CommentDeleted) (stats.Delta, error) {
+	result, err := tx.ExecContext(ctx,
+		`UPDATE comments SET deleted_at = $1
+		 WHERE id = $2 AND post_id = $3 AND user_id = $4 AND deleted_at IS NULL`,
+		event.Timestamp, event.ID, event.PostID, event.UserID)
+	if err != nil {
+		return stats.Delta{}, fmt.Errorf("failed to delete comment %s: %w", event.ID, err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return stats.Delta{}, nil
+	}
+	return stats.Delta{Comments: -1}, nil
+}
+
+// SetReaction stores the user's reaction to a post, replacing an earlier one
+func SetReaction(ctx context.Context, tx *sql.Tx, event events.Like) (stats.Delta, error) {
+	var previous string
+	err := tx.QueryRowContext(ctx,
+		`SELECT reaction FROM likes WHERE post_id = $1 AND user_id = $2 FOR UPDATE`,
+		event.PostID, event.UserID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return stats.Delta{}, fmt.Errorf("failed to read like of %s on %s: %w", event.UserID, event.PostID, err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO likes (id, post_id, user_id, reaction, created_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (post_id, user_id) DO UPDATE SET reaction = EXCLUDED.reaction
+		 WHERE likes.reaction <> EXCLUDED.reaction`,
+		event.ID, event.PostID, event.UserID, event.Reaction, event.Timestamp)
+	if err != nil {
+		return stats.Delta{}, fmt.Errorf("failed to insert like of %s on %s: %w", event.UserID, event.PostID, err)
+	}
+	return stats.Delta{ReactionAdded: event.Reaction, ReactionRemoved: previous}, nil
+}
+
+// RemoveReaction deletes the user's reaction to a post, whatever its type
+func RemoveReaction(ctx context.Context, tx *sql.Tx, event events.Like) (stats.Delta, error) {
+	var removed string
+	err := tx.QueryRowContext(ctx,
+		`DELETE FROM likes WHERE post_id = $1 AND user_id = $2 RETURNING reaction`,
+		event.PostID, event.UserID).Scan(&removed)
+	if err == sql.ErrNoRows {
+		return stats.Delta{}, nil
+	}
+	if err != nil {
+		return stats.Delta{}, fmt.Errorf("failed to delete like of %s on %s: %w", event.UserID, event.PostID, err)
+	}
+	return stats.Delta{ReactionRemoved: removed}, nil
+}
@@ -0,0 +1,12 @@
+-- Per-shard weight for the consistent-hash ring. A shard owns roughly
+-- weight / sum(weights) of the keyspace; weight 0 drains a shard.
+ALTER TABLE shards ADD COLUMN IF NOT EXISTS weight INT NOT NULL DEFAULT 1;
+
+DO $$ BEGIN
+  IF NOT EXISTS (
+    SELECT 1 FROM pg_constraint
+    WHERE conname = 'shards_weight_non_negative'
+  ) THEN
+    ALTER TABLE shards ADD CONSTRAINT shards_weight_non_negative CHECK (weight >= 0);
+  END IF;
+END$$;
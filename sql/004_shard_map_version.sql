@@ -0,0 +1,29 @@
+-- Version of the shard map. Every change to the shards table bumps it, and
+-- services poll it to know when to reload their routing and connection pools.
+CREATE TABLE IF NOT EXISTS shard_map_version (
+  id          BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+  version     BIGINT NOT NULL,
+  updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO shard_map_version (id, version) VALUES (TRUE, 1)
+  ON CONFLICT (id) DO NOTHING;
+
+CREATE OR REPLACE FUNCTION bump_shard_map_version()
+RETURNS TRIGGER LANGUAGE plpgsql AS $$
+BEGIN
+  UPDATE shard_map_version SET version = version + 1, updated_at = now();
+  RETURN NULL;
+END
+$$;
+
+DO $$ BEGIN
+  IF NOT EXISTS (
+    SELECT 1 FROM pg_trigger
+    WHERE tgname = 'trg_shards_version'
+  ) THEN
+    CREATE TRIGGER trg_shards_version
+      AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON shards
+      FOR EACH STATEMENT EXECUTE FUNCTION bump_shard_map_version();
+  END IF;
+END$$;
@@ -0,0 +1,15 @@
+-- Post directory: resolves a post to the users whose shards hold its data.
+-- Entries store user IDs rather than shard IDs so they survive resharding.
+CREATE TABLE IF NOT EXISTS post_directory (
+  post_id     TEXT PRIMARY KEY,
+  user_id     TEXT NOT NULL,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Users that commented on or liked a post
+CREATE TABLE IF NOT EXISTS post_participants (
+  post_id     TEXT NOT NULL,
+  user_id     TEXT NOT NULL,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (post_id, user_id)
+);
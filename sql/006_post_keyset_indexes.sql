@@ -0,0 +1,7 @@
+-- Keyset pagination: feeds page by (created_at, id) so posts created in the same
+-- instant still have a stable order
+CREATE INDEX IF NOT EXISTS idx_posts_created_at_id
+  ON posts (created_at DESC, id DESC);
+
+CREATE INDEX IF NOT EXISTS idx_posts_user_created_at_id
+  ON posts (user_id, created_at DESC, id DESC);
@@ -0,0 +1,4 @@
+-- Soft deletes: a deleted post or comment stays as a tombstone row with
+-- deleted_at set, so a replayed create cannot bring it back
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
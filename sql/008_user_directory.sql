@@ -0,0 +1,10 @@
+-- User directory: every registered user, kept in the master database so
+-- usernames and emails are unique across shards and ingestion can check that
+-- a user exists without knowing which shard holds it.
+CREATE TABLE IF NOT EXISTS user_directory (
+  user_id     TEXT PRIMARY KEY,
+  username    TEXT UNIQUE NOT NULL,
+  email       TEXT UNIQUE NOT NULL,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,29 @@
+-- FOLLOWS: stored on the follower's shard, like the rest of the follower's data
+CREATE TABLE IF NOT EXISTS follows (
+  id           TEXT PRIMARY KEY,
+  follower_id  TEXT NOT NULL,
+  followee_id  TEXT NOT NULL,
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  UNIQUE (follower_id, followee_id)
+);
+
+-- Fan-out on write looks up the followers of a post's author on every shard
+CREATE INDEX IF NOT EXISTS idx_follows_followee
+  ON follows (followee_id);
+
+-- TIMELINES: posts copied into the home feed of each follower when
+-- FEED_MODE=write, on the follower's shard. Only IDs are kept; the feed reads
+-- the posts themselves so edits and deletes need no fan-out.
+CREATE TABLE IF NOT EXISTS timelines (
+  user_id     TEXT NOT NULL,
+  post_id     TEXT NOT NULL,
+  author_id   TEXT NOT NULL,
+  created_at  TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (user_id, post_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_timelines_user_created_at_post
+  ON timelines (user_id, created_at DESC, post_id DESC);
+
+CREATE INDEX IF NOT EXISTS idx_timelines_user_author
+  ON timelines (user_id, author_id);
@@ -0,0 +1,6 @@
+-- Threaded comments: a reply points at the comment it answers. Top-level
+-- comments have no parent.
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS parent_comment_id TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_comments_post_parent_created_at
+  ON comments (post_id, parent_comment_id, created_at, id);
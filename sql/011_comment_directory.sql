@@ -0,0 +1,10 @@
+-- Comment directory: the thread position of every comment, kept in the master
+-- database so ingestion can check a reply's depth without knowing which shard
+-- holds its parent. Top-level comments have depth 0.
+CREATE TABLE IF NOT EXISTS comment_directory (
+  comment_id         TEXT PRIMARY KEY,
+  post_id            TEXT NOT NULL,
+  parent_comment_id  TEXT,
+  depth              INTEGER NOT NULL,
+  created_at         TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,4 @@
+-- Typed reactions: a likes row is a user's reaction to a post. The existing
+-- (post_id, user_id) constraint keeps it to one reaction per user per post,
+-- which can be changed. Rows written before reactions existed are likes.
+ALTER TABLE likes ADD COLUMN IF NOT EXISTS reaction TEXT NOT NULL DEFAULT 'like';
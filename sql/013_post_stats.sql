@@ -0,0 +1,27 @@
+-- Per-post counters, on the shard of the post. reactions maps each reaction
+-- type to its count.
+CREATE TABLE IF NOT EXISTS post_stats (
+  post_id        TEXT PRIMARY KEY,
+  comment_count  BIGINT NOT NULL DEFAULT 0,
+  like_count     BIGINT NOT NULL DEFAULT 0,
+  reactions      JSONB NOT NULL DEFAULT '{}',
+  updated_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Counter changes by event ID. The consumer records a change on the shard of
+-- the comment or like in the same transaction as the row, then applies it to
+-- post_stats; the post's shard keeps the applied event IDs so a retried event
+-- is only counted once. The consumer deletes applied rows once they are older
+-- than PROCESSED_EVENTS_RETENTION.
+CREATE TABLE IF NOT EXISTS post_stats_events (
+  event_id          TEXT PRIMARY KEY,
+  post_id           TEXT NOT NULL,
+  comment_delta     INTEGER NOT NULL DEFAULT 0,
+  reaction_added    TEXT,
+  reaction_removed  TEXT,
+  applied           BOOLEAN NOT NULL DEFAULT false,
+  created_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_post_stats_events_applied_created_at
+  ON post_stats_events (applied, created_at);
@@ -0,0 +1,12 @@
+-- Events a shard has processed, by event ID. The consumer inserts the event in
+-- the same transaction as the rows it writes and skips events that are already
+-- here, so a redelivered message changes nothing. Rows older than the Kafka
+-- retention are pruned by the consumer.
+CREATE TABLE IF NOT EXISTS processed_events (
+  event_id      TEXT PRIMARY KEY,
+  event_type    TEXT NOT NULL,
+  processed_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_processed_events_processed_at
+  ON processed_events (processed_at);